@@ -0,0 +1,428 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/esfragbag/bowdb"
+	"github.com/ndaniels/tools/util"
+)
+
+var flagCheckSalvage = ""
+
+var cmdBowDbCheck = &command{
+	name:            "bowdb-check",
+	positionalUsage: "bowdb-path",
+	shortHelp:       "verify a BOW database and salvage its readable entries",
+	help: `
+The bowdb-check command verifies the BOW database given without relying on
+the bowdb package, which may fail or silently return fewer entries when the
+database is damaged. It checks that:
+
+	the tar archive can be read to the end, and has a single directory
+	with a fragment library ('frag-lib.json') and BOWs ('bow.db')
+	the fragment library and the metadata stored with it can be decoded
+	every record in 'bow.db' can be decoded, and no record is truncated
+	every fragment index of every BOW is within the size of the library
+	no frequency is NaN, infinite or negative
+	no identifier is used by more than one entry
+
+Every problem found is reported, followed by a summary. The command exits
+with a non-zero status if there are any problems.
+
+With '-salvage', the entries that can be read are written to a new BOW
+database, along with the metadata of the original and the provenance and
+sequences of the entries written. Entries with invalid frequencies and all but the first entry with each
+identifier are left out. Indexes and columnar files are not copied, since
+they must be rebuilt for the new database.
+`,
+	flags: flag.NewFlagSet("bowdb-check", flag.ExitOnError),
+	run:   bowDbCheck,
+	addFlags: func(c *command) {
+		c.setOverwriteFlag()
+		c.flags.StringVar(&flagCheckSalvage, "salvage", flagCheckSalvage,
+			"When set, the readable entries are written to a new BOW\n"+
+				"database at the path given.")
+	},
+}
+
+// The most problems of each kind that are listed.
+const checkMaxListed = 20
+
+// The largest identifier and data (in bytes) that a record is assumed to
+// have. Larger lengths are taken to mean that the record is corrupt.
+const (
+	checkMaxIdLen   = 1 << 16
+	checkMaxDataLen = 1 << 30
+)
+
+// bowDbChecker collects the problems found in a BOW database.
+type bowDbChecker struct {
+	dbPath string
+	lib    fragbag.Library
+
+	// The number of problems of each kind and the first few of them, in the
+	// order they were found.
+	counts   map[string]int
+	problems map[string][]string
+	kinds    []string
+
+	// The entries that can be salvaged.
+	entries []bow.Bowed
+	records int
+}
+
+func bowDbCheck(c *command) {
+	c.assertNArg(1)
+
+	dbPath := c.flags.Arg(0)
+	if len(flagCheckSalvage) > 0 {
+		util.AssertOverwritable(flagCheckSalvage, flagOverwrite)
+	}
+
+	ch := newBowDbChecker(dbPath)
+	dir := ch.check()
+	ch.report(dir)
+
+	if len(flagCheckSalvage) > 0 {
+		if ch.lib == nil {
+			util.Fatalf("Nothing can be salvaged without a fragment library.")
+		}
+		ch.salvage(flagCheckSalvage)
+	}
+	if len(ch.kinds) > 0 {
+		os.Exit(1)
+	}
+}
+
+func newBowDbChecker(dbPath string) *bowDbChecker {
+	return &bowDbChecker{
+		dbPath:   dbPath,
+		counts:   make(map[string]int),
+		problems: make(map[string][]string),
+	}
+}
+
+// check finds the problems of the database, and returns the name of its
+// directory.
+func (ch *bowDbChecker) check() string {
+	dir := ch.checkTar()
+	if ch.lib != nil {
+		ch.checkRecords()
+	}
+	return dir
+}
+
+func (ch *bowDbChecker) problem(kind, format string, v ...interface{}) {
+	if ch.counts[kind] == 0 {
+		ch.kinds = append(ch.kinds, kind)
+	}
+	ch.counts[kind]++
+	if len(ch.problems[kind]) < checkMaxListed {
+		ch.problems[kind] = append(ch.problems[kind], fmt.Sprintf(format, v...))
+	}
+}
+
+// checkTar reads every file in the archive, decodes the fragment library and
+// the metadata, and returns the name of the database's directory. Only the
+// files that are decoded are read into memory.
+func (ch *bowDbChecker) checkTar() string {
+	f, err := os.Open(ch.dbPath)
+	util.Assert(err)
+	defer f.Close()
+
+	dirs := make(map[string]bool)
+	files := make(map[string]bool)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			ch.problem("tar", "the archive cannot be read after %d files: %s",
+				len(files), err)
+			break
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		dir := strings.SplitN(name, "/", 2)[0]
+		dirs[dir] = true
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		base := path.Base(name)
+		files[base] = true
+
+		var data []byte
+		var n int64
+		switch base {
+		case "frag-lib.json", bowDbMetaFile, bowDbProvenanceFile:
+			data, err = ioutil.ReadAll(io.LimitReader(tr, hdr.Size))
+			n = int64(len(data))
+		default:
+			n, err = io.Copy(ioutil.Discard, tr)
+		}
+		switch {
+		case err != nil || n < hdr.Size:
+			ch.problem("tar", "'%s' is truncated (%d of %d bytes)",
+				name, n, hdr.Size)
+		case base == "frag-lib.json":
+			lib, err := fragbag.Open(bytes.NewReader(data))
+			if err != nil {
+				ch.problem("library", "'%s' cannot be decoded: %s", name, err)
+			} else {
+				ch.lib = lib
+			}
+		case base == bowDbMetaFile:
+			var meta bowDbMeta
+			if err := json.Unmarshal(data, &meta); err != nil {
+				ch.problem("metadata", "'%s' cannot be decoded: %s", name, err)
+			}
+		case base == bowDbProvenanceFile:
+			var prov bowDbProvenance
+			if err := json.Unmarshal(data, &prov); err != nil {
+				ch.problem("metadata", "'%s' cannot be decoded: %s", name, err)
+			}
+		}
+	}
+
+	var names []string
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+	if len(names) != 1 {
+		ch.problem("tar", "expected a single directory, but found %d (%s)",
+			len(names), strings.Join(names, ", "))
+	}
+	for _, name := range []string{"frag-lib.json", "bow.db"} {
+		if !files[name] {
+			ch.problem("tar", "there is no '%s'", name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// checkRecords decodes every record in 'bow.db'. Each record has a 32-bit
+// length followed by the identifier, a 32-bit length followed by arbitrary
+// data, and a 32-bit length followed by the non-zero frequencies of the BOW
+// as pairs of a 16-bit fragment index and a 32-bit float. All integers and
+// floats are big-endian.
+func (ch *bowDbChecker) checkRecords() {
+	f, err := os.Open(ch.dbPath)
+	util.Assert(err)
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return // already reported by checkTar
+		}
+		if path.Base(hdr.Name) == "bow.db" && path.Dir(hdr.Name) != "." {
+			if hdr.Size == 0 {
+				ch.problem("records", "'bow.db' is empty")
+				return
+			}
+			ch.decodeRecords(bufio.NewReader(io.LimitReader(tr, hdr.Size)))
+			return
+		}
+	}
+}
+
+func (ch *bowDbChecker) decodeRecords(r io.Reader) {
+	seen := make(map[string]int)
+	var offset int64
+	readLen := func(max uint32) (uint32, error) {
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return 0, err
+		}
+		offset += 4
+		if n > max {
+			return 0, fmt.Errorf("invalid length %d", n)
+		}
+		return n, nil
+	}
+	readBytes := func(n uint32) ([]byte, error) {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		offset += int64(n)
+		return buf, nil
+	}
+
+	for ; ; ch.records++ {
+		start := offset
+		idLen, err := readLen(checkMaxIdLen)
+		if err == io.EOF {
+			return
+		}
+		var id, data, freqs []byte
+		if err == nil {
+			id, err = readBytes(idLen)
+		}
+		var dataLen, bowLen uint32
+		if err == nil {
+			dataLen, err = readLen(checkMaxDataLen)
+		}
+		if err == nil {
+			data, err = readBytes(dataLen)
+		}
+		if err == nil {
+			bowLen, err = readLen(uint32(6 * ch.lib.Size()))
+		}
+		if err == nil {
+			freqs, err = readBytes(bowLen)
+		}
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("truncated")
+			}
+			ch.problem("records", "record %d at byte %d cannot be read "+
+				"(%s); the rest of 'bow.db' is ignored", ch.records+1, start, err)
+			return
+		}
+
+		b := bow.Bowed{
+			Id:   string(id),
+			Data: data,
+			Bow:  bow.Bow{Freqs: make([]float32, ch.lib.Size())},
+		}
+		if ch.checkFreqs(b, freqs) {
+			if first, ok := seen[b.Id]; ok {
+				ch.problem("duplicates", "'%s' is record %d and record %d",
+					b.Id, first, ch.records+1)
+				continue
+			}
+			seen[b.Id] = ch.records + 1
+			ch.entries = append(ch.entries, b)
+		}
+	}
+}
+
+// checkFreqs decodes the frequencies of a record into the BOW given, and
+// returns false if any of them are invalid.
+func (ch *bowDbChecker) checkFreqs(b bow.Bowed, freqs []byte) bool {
+	if len(freqs)%6 != 0 {
+		ch.problem("frequencies", "'%s' has %d bytes of frequencies, which "+
+			"is not a multiple of 6", b.Id, len(freqs))
+		return false
+	}
+	ok := true
+	for i := 0; i < len(freqs); i += 6 {
+		idx := int(binary.BigEndian.Uint16(freqs[i:]))
+		v := math.Float32frombits(binary.BigEndian.Uint32(freqs[i+2:]))
+		switch {
+		case idx >= len(b.Bow.Freqs):
+			ch.problem("frequencies", "'%s' has fragment %d, but the "+
+				"library has %d fragments", b.Id, idx, len(b.Bow.Freqs))
+			ok = false
+		case math.IsNaN(float64(v)) || math.IsInf(float64(v), 0):
+			ch.problem("frequencies", "'%s' has frequency %g for fragment %d",
+				b.Id, v, idx)
+			ok = false
+		case v < 0:
+			ch.problem("frequencies", "'%s' has negative frequency %g for "+
+				"fragment %d", b.Id, v, idx)
+			ok = false
+		default:
+			b.Bow.Freqs[idx] = v
+		}
+	}
+	return ok
+}
+
+func (ch *bowDbChecker) report(dir string) {
+	fmt.Printf("Database: %s\n", ch.dbPath)
+	if len(dir) > 0 {
+		fmt.Printf("Directory: %s\n", dir)
+	}
+	if ch.lib != nil {
+		fmt.Printf("Library: %s (%d fragments of size %d)\n",
+			ch.lib.Name(), ch.lib.Size(), ch.lib.FragmentSize())
+	}
+	fmt.Printf("Records: %d\n", ch.records)
+	fmt.Printf("Readable Entries: %d\n", len(ch.entries))
+
+	if len(ch.kinds) == 0 {
+		fmt.Printf("No problems found.\n")
+		return
+	}
+	total := 0
+	for _, kind := range ch.kinds {
+		total += ch.counts[kind]
+	}
+	fmt.Printf("Problems: %d\n", total)
+	for _, kind := range ch.kinds {
+		fmt.Printf("\n%s (%d):\n", kind, ch.counts[kind])
+		for _, p := range ch.problems[kind] {
+			fmt.Printf("\t%s\n", p)
+		}
+		if more := ch.counts[kind] - len(ch.problems[kind]); more > 0 {
+			fmt.Printf("\t... and %d more\n", more)
+		}
+	}
+}
+
+// salvage writes the readable entries to a new BOW database, along with the
+// metadata of the original. The provenance and sequences of the original are
+// only copied for the entries that were salvaged.
+func (ch *bowDbChecker) salvage(newPath string) {
+	db, err := bowdb.Create(ch.lib, newPath)
+	util.Assert(err)
+	salvaged := make(map[string]bool, len(ch.entries))
+	ids := make([]string, len(ch.entries))
+	for i, b := range ch.entries {
+		db.Add(b)
+		salvaged[b.Id] = true
+		ids[i] = b.Id
+	}
+	util.Assert(db.Close())
+
+	if data, err := readBowDbFile(ch.dbPath, bowDbMetaFile); err == nil &&
+		data != nil {
+		util.Assert(writeBowDbFile(newPath, bowDbMetaFile, data),
+			"Could not write '%s' to '%s'", bowDbMetaFile, newPath)
+	}
+	if prov, err := readBowDbProvenance(ch.dbPath); err == nil && prov != nil {
+		var entries []bowDbEntry
+		for _, e := range prov.Entries {
+			if salvaged[e.Id] {
+				entries = append(entries, e)
+				salvaged[e.Id] = false // only the first with each identifier
+			}
+		}
+		prov.Entries = entries
+		util.Assert(writeBowDbProvenance(newPath, prov),
+			"Could not write the provenance to '%s'", newPath)
+	}
+	if seqs, err := readBowDbSequences(ch.dbPath); err == nil && seqs != nil {
+		var seqIds []string
+		for _, id := range ids {
+			if _, ok := seqs[id]; ok {
+				seqIds = append(seqIds, id)
+			}
+		}
+		util.Assert(writeBowDbSequences(newPath, seqIds, seqs),
+			"Could not write the sequences to '%s'", newPath)
+	}
+	fmt.Printf("\nWrote %d entries to '%s'.\n", len(ch.entries), newPath)
+}
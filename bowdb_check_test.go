@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+// TestBowDbCheck checks that a database written by the bowdb package has no
+// problems, and that every entry is read as it was written.
+func TestBowDbCheck(t *testing.T) {
+	entries := testEntries(rand.New(rand.NewSource(5)), 50, 30)
+	dbPath := testBowDb(t, entries)
+	defer os.RemoveAll(path.Dir(dbPath))
+
+	ch := newBowDbChecker(dbPath)
+	ch.check()
+	for _, kind := range ch.kinds {
+		t.Errorf("%s (%d): %v", kind, ch.counts[kind], ch.problems[kind])
+	}
+
+	// Every fourth entry has the same BOW as the one before, but all of the
+	// identifiers are different.
+	if ch.records != len(entries) || len(ch.entries) != len(entries) {
+		t.Fatalf("Read %d records and %d entries, but wrote %d.",
+			ch.records, len(ch.entries), len(entries))
+	}
+	for i, e := range entries {
+		got := ch.entries[i]
+		if got.Id != e.Id {
+			t.Errorf("Entry %d is '%s', expected '%s'.", i, got.Id, e.Id)
+			continue
+		}
+		for j, f := range e.Bow.Freqs {
+			if got.Bow.Freqs[j] != f {
+				t.Errorf("Entry '%s' has frequency %g for fragment %d, "+
+					"expected %g.", e.Id, got.Bow.Freqs[j], j, f)
+				break
+			}
+		}
+	}
+}
+
+// TestBowDbCheckTruncated checks that a truncated record is reported, and
+// that the entries before it can still be salvaged along with only their
+// provenance and sequences.
+func TestBowDbCheckTruncated(t *testing.T) {
+	entries := testEntries(rand.New(rand.NewSource(6)), 10, 30)
+	dbPath := testBowDb(t, entries)
+	defer os.RemoveAll(path.Dir(dbPath))
+
+	prov := newBowDbProvenance()
+	ids := make([]string, len(entries))
+	seqs := make(map[string]string)
+	for i, e := range entries {
+		prov.Entries = append(prov.Entries, bowDbEntry{Id: e.Id})
+		ids[i] = e.Id
+		seqs[e.Id] = "MAGS"
+	}
+	if err := writeBowDbProvenance(dbPath, prov); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeBowDbSequences(dbPath, ids, seqs); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := readBowDbFile(dbPath, "bow.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := records[:len(records)-3]
+	if err := writeBowDbFile(dbPath, "bow.db", truncated); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := newBowDbChecker(dbPath)
+	ch.check()
+	if ch.counts["records"] != 1 || len(ch.kinds) != 1 {
+		t.Errorf("Expected a single problem with the records, but got %v.",
+			ch.problems)
+	}
+	if len(ch.entries) != len(entries)-1 {
+		t.Errorf("Salvaged %d entries, expected %d.",
+			len(ch.entries), len(entries)-1)
+	}
+
+	newPath := path.Join(path.Dir(dbPath), "salvaged.bowdb")
+	ch.salvage(newPath)
+	lost := entries[len(entries)-1].Id
+	newProv, err := readBowDbProvenance(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newProv == nil || len(newProv.Entries) != len(ch.entries) {
+		t.Fatalf("Expected the provenance of %d entries, but got %v.",
+			len(ch.entries), newProv)
+	}
+	for _, e := range newProv.Entries {
+		if e.Id == lost {
+			t.Errorf("The provenance of '%s' was copied.", lost)
+		}
+	}
+	newSeqs, err := readBowDbSequences(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := newSeqs[lost]; ok || len(newSeqs) != len(ch.entries) {
+		t.Errorf("Expected the sequences of %d entries without '%s', but "+
+			"got %v.", len(ch.entries), lost, newSeqs)
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/esfragbag/bowdb"
+	"github.com/ndaniels/flib/query"
+	"github.com/ndaniels/tools/util"
+)
+
+var (
+	flagClusterMethod     = "hierarchical"
+	flagClusterLinkage    = "average"
+	flagClusterMetric     = "cosine"
+	flagClusterK          = 0
+	flagClusterThreshold  = -1.0
+	flagClusterIterations = 100
+	flagClusterNewick     = ""
+)
+
+var cmdBowDbCluster = &command{
+	name:            "bowdb-cluster",
+	positionalUsage: "bowdb-path",
+	shortHelp:       "cluster the entries of a BOW database",
+	help: `
+The bowdb-cluster command groups the entries of the given BOW database into
+clusters by the distance between their BOWs. The BOWs stored in the database
+are used directly, so no bower files are read.
+
+The clustering method is given by '-method':
+
+	hierarchical   agglomerative clustering with the linkage given by
+	               '-linkage' ('single', 'average' or 'complete'). The tree
+	               is cut into '-k' clusters, or at the distance given by
+	               '-threshold'. The whole tree can be written in the Newick
+	               format with '-newick'. This needs memory for the distance
+	               between every pair of entries.
+	kmedoids       partitions the entries into '-k' clusters, each with a
+	               representative entry (its medoid) that minimizes the sum
+	               of distances to the other entries in the cluster.
+	components     connects every pair of entries at most '-threshold' apart
+	               and reports each connected component as a cluster.
+
+The cluster of each entry is written to stdout as tab-separated lines with
+the entry's identifier, the number of its cluster and the identifier of the
+medoid of its cluster. Clusters are numbered from 1 in the order of their
+first entry in the database.
+
+If the database has a columnar file (see bowdb-columns), it is used.
+`,
+	flags: flag.NewFlagSet("bowdb-cluster", flag.ExitOnError),
+	run:   bowDbCluster,
+	addFlags: func(c *command) {
+		c.flags.StringVar(&flagClusterMethod, "method", flagClusterMethod,
+			"The clustering method. Valid values are 'hierarchical',\n"+
+				"'kmedoids' and 'components'.")
+		c.flags.StringVar(&flagClusterLinkage, "linkage", flagClusterLinkage,
+			"The linkage of hierarchical clustering. Valid values are\n"+
+				"'single', 'average' and 'complete'.")
+		c.flags.StringVar(&flagClusterMetric, "metric", flagClusterMetric,
+			"The distance between BOWs.\n"+
+				"Valid values are 'cosine' and 'euclid'.")
+		c.flags.IntVar(&flagClusterK, "k", flagClusterK,
+			"The number of clusters.")
+		c.flags.Float64Var(&flagClusterThreshold, "threshold",
+			flagClusterThreshold,
+			"The largest distance between two entries in the same cluster\n"+
+				"(with 'components') or merged clusters (with\n"+
+				"'hierarchical').")
+		c.flags.IntVar(&flagClusterIterations, "iterations",
+			flagClusterIterations,
+			"The maximum number of iterations of k-medoids.")
+		c.flags.StringVar(&flagClusterNewick, "newick", flagClusterNewick,
+			"When set, the tree of hierarchical clustering is written to\n"+
+				"this file in the Newick format.")
+		c.setOverwriteFlag()
+	},
+}
+
+func bowDbCluster(c *command) {
+	c.assertNArg(1)
+
+	var sortBy bowdb.SortByType
+	switch flagClusterMetric {
+	case "cosine":
+		sortBy = bowdb.SortByCosine
+	case "euclid":
+		sortBy = bowdb.SortByEuclid
+	default:
+		util.Fatalf("Unknown metric '%s'.", flagClusterMetric)
+	}
+	switch flagClusterMethod {
+	case "hierarchical":
+		switch flagClusterLinkage {
+		case "single", "average", "complete":
+		default:
+			util.Fatalf("Unknown linkage '%s'.", flagClusterLinkage)
+		}
+		if (flagClusterK > 0) == (flagClusterThreshold >= 0) {
+			util.Fatalf("Exactly one of '-k' or '-threshold' must be set " +
+				"for hierarchical clustering.")
+		}
+	case "kmedoids":
+		if flagClusterK < 1 {
+			util.Fatalf("'-k' must be set for k-medoids.")
+		}
+	case "components":
+		if flagClusterThreshold < 0 {
+			util.Fatalf("'-threshold' must be set for connected components.")
+		}
+	default:
+		util.Fatalf("Unknown clustering method '%s'.", flagClusterMethod)
+	}
+	if len(flagClusterNewick) > 0 {
+		if flagClusterMethod != "hierarchical" {
+			util.Fatalf("'-newick' can only be used with hierarchical " +
+				"clustering.")
+		}
+		util.AssertOverwritable(flagClusterNewick, flagOverwrite)
+	}
+
+	dbPath := c.flags.Arg(0)
+	db := util.OpenBowDB(dbPath)
+	store := readBowStore(dbPath, db)
+	if cols, ok := store.(*colStore); ok {
+		defer cols.Close()
+	}
+	if store.Len() == 0 {
+		util.Fatalf("The BOW database '%s' is empty.", dbPath)
+	}
+	cd := clusterDists{query.NewSearcher(store), sortBy}
+
+	var clusters []int
+	var medoids []int
+	switch flagClusterMethod {
+	case "hierarchical":
+		dists := cd.matrix()
+		merges := linkage(dists, store.Len(), flagClusterLinkage)
+		if len(flagClusterNewick) > 0 {
+			f := util.CreateFile(flagClusterNewick)
+			w := bufio.NewWriter(f)
+			writeNewick(w, store, merges)
+			util.Assert(w.Flush())
+			util.Assert(f.Close())
+		}
+		clusters = cutTree(store.Len(), merges,
+			flagClusterK, flagClusterThreshold)
+		medoids = clusterMedoids(clusters, cd.dist)
+	case "kmedoids":
+		clusters, medoids = kMedoids(cd, flagClusterK, flagClusterIterations)
+	case "components":
+		clusters = components(cd, flagClusterThreshold)
+		medoids = clusterMedoids(clusters, cd.dist)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(w, "Id\tCluster\tMedoid\n")
+	for i, cluster := range clusters {
+		fmt.Fprintf(w, "%s\t%d\t%s\n",
+			store.Id(i), cluster+1, store.Id(medoids[cluster]))
+	}
+	util.Assert(w.Flush())
+	util.Assert(db.Close())
+}
+
+// clusterDists computes distances between the BOWs of a database from their
+// dot products and cached norms.
+type clusterDists struct {
+	qs     *query.Searcher
+	sortBy bowdb.SortByType
+}
+
+func (cd clusterDists) len() int {
+	return cd.qs.Store().Len()
+}
+
+func (cd clusterDists) dist(i, j int) float64 {
+	return cd.qs.Dist(cd.sortBy, i, j)
+}
+
+// matrix computes the distance between every pair of BOWs with flagCpu
+// goroutines.
+func (cd clusterDists) matrix() condensedDists {
+	n := cd.len()
+	dists := newCondensedDists(n)
+	rows := make(chan int)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < flagCpu; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rows {
+				for j := i + 1; j < n; j++ {
+					dists.set(i, j, float32(cd.dist(i, j)))
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		rows <- i
+	}
+	close(rows)
+	wg.Wait()
+	return dists
+}
+
+// condensedDists is the upper triangle of a symmetric distance matrix with
+// zeros on the diagonal.
+type condensedDists struct {
+	n     int
+	dists []float32
+}
+
+func newCondensedDists(n int) condensedDists {
+	return condensedDists{n, make([]float32, n*(n-1)/2)}
+}
+
+func (cd condensedDists) index(i, j int) int {
+	if i > j {
+		i, j = j, i
+	}
+	return i*cd.n - i*(i+1)/2 + (j - i - 1)
+}
+
+func (cd condensedDists) at(i, j int) float32 {
+	if i == j {
+		return 0
+	}
+	return cd.dists[cd.index(i, j)]
+}
+
+func (cd condensedDists) set(i, j int, d float32) {
+	cd.dists[cd.index(i, j)] = d
+}
+
+// clusterMerge joins the clusters containing entries a and b at the distance
+// given.
+type clusterMerge struct {
+	a, b   int
+	height float64
+}
+
+// linkage performs agglomerative clustering with the nearest neighbor chain
+// algorithm, and returns the n-1 merges sorted by height. The distances are
+// overwritten.
+func linkage(dists condensedDists, n int, method string) []clusterMerge {
+	active := make([]bool, n)
+	size := make([]int, n)
+	for i := range active {
+		active[i], size[i] = true, 1
+	}
+
+	merges := make([]clusterMerge, 0, n-1)
+	var chain []int
+	for len(merges) < n-1 {
+		if len(chain) == 0 {
+			for i := range active {
+				if active[i] {
+					chain = append(chain, i)
+					break
+				}
+			}
+		}
+
+		// Find the nearest neighbor of the cluster at the top of the chain,
+		// preferring the previous cluster in the chain on ties.
+		a := chain[len(chain)-1]
+		b, best := -1, float32(math.Inf(1))
+		if len(chain) > 1 {
+			b = chain[len(chain)-2]
+			best = dists.at(a, b)
+		}
+		for x := range active {
+			if active[x] && x != a && dists.at(a, x) < best {
+				b, best = x, dists.at(a, x)
+			}
+		}
+		if len(chain) < 2 || b != chain[len(chain)-2] {
+			chain = append(chain, b)
+			continue
+		}
+
+		// a and b are reciprocal nearest neighbors, so merge them into b.
+		chain = chain[:len(chain)-2]
+		merges = append(merges, clusterMerge{a, b, float64(best)})
+		for x := range active {
+			if !active[x] || x == a || x == b {
+				continue
+			}
+			da, db := dists.at(a, x), dists.at(b, x)
+			var d float32
+			switch method {
+			case "single":
+				d = float32(math.Min(float64(da), float64(db)))
+			case "complete":
+				d = float32(math.Max(float64(da), float64(db)))
+			case "average":
+				sa, sb := float32(size[a]), float32(size[b])
+				d = (sa*da + sb*db) / (sa + sb)
+			}
+			dists.set(b, x, d)
+		}
+		active[a] = false
+		size[b] += size[a]
+	}
+	sort.Stable(mergesByHeight(merges))
+	return merges
+}
+
+// cutTree returns the cluster of each entry after performing the first
+// n-k merges, or the merges at most threshold high when k is 0.
+func cutTree(n int, merges []clusterMerge, k int, threshold float64) []int {
+	set := newDisjointSet(n)
+	for i, m := range merges {
+		if k > 0 && i >= n-k {
+			break
+		}
+		if k <= 0 && m.height > threshold {
+			break
+		}
+		set.union(m.a, m.b)
+	}
+	return set.clusters()
+}
+
+// writeNewick writes the tree of merges in the Newick format. Leaves are
+// named by the identifiers of the entries, and the branch lengths are the
+// differences between the heights of the merges.
+func writeNewick(w io.Writer, store query.Store, merges []clusterMerge) {
+	n := store.Len()
+
+	// Node i < n is entry i, and node n+i is the result of merge i.
+	children := make([][2]int, len(merges))
+	heights := make([]float64, n+len(merges))
+	set := newDisjointSet(n)
+	top := make([]int, n) // the tree node of each set's root
+	for i := range top {
+		top[i] = i
+	}
+	for i, m := range merges {
+		ra, rb := set.find(m.a), set.find(m.b)
+		children[i] = [2]int{top[ra], top[rb]}
+		heights[n+i] = m.height
+		top[set.union(ra, rb)] = n + i
+	}
+
+	var write func(node int, parentHeight float64)
+	write = func(node int, parentHeight float64) {
+		if node < n {
+			fmt.Fprintf(w, "%s", newickName(store.Id(node)))
+		} else {
+			ch := children[node-n]
+			fmt.Fprintf(w, "(")
+			write(ch[0], heights[node])
+			fmt.Fprintf(w, ",")
+			write(ch[1], heights[node])
+			fmt.Fprintf(w, ")")
+		}
+		if parentHeight >= 0 {
+			fmt.Fprintf(w, ":%g", float32(parentHeight-heights[node]))
+		}
+	}
+	if len(merges) == 0 {
+		write(0, -1)
+	} else {
+		write(n+len(merges)-1, -1)
+	}
+	fmt.Fprintf(w, ";\n")
+}
+
+// newickName quotes a name if it contains characters with special meaning in
+// the Newick format.
+func newickName(name string) string {
+	if !strings.ContainsAny(name, " \t\n()[]':;,") {
+		return name
+	}
+	return "'" + strings.Replace(name, "'", "''", -1) + "'"
+}
+
+// kMedoids partitions the entries into k clusters by alternating between
+// assigning entries to their nearest medoid and choosing the best medoid of
+// each cluster. The initial medoids are chosen as in k-means++.
+func kMedoids(cd clusterDists, k, iterations int) ([]int, []int) {
+	n := cd.len()
+	if k > n {
+		k = n
+	}
+	rng := rand.New(rand.NewSource(1))
+
+	medoids := []int{rng.Intn(n)}
+	nearest := make([]float64, n)
+	for i := range nearest {
+		nearest[i] = cd.dist(i, medoids[0])
+	}
+	for len(medoids) < k {
+		total := 0.0
+		for _, d := range nearest {
+			total += d * d
+		}
+		next := rng.Intn(n)
+		if total > 0 {
+			r := rng.Float64() * total
+			for i, d := range nearest {
+				if r -= d * d; r <= 0 {
+					next = i
+					break
+				}
+			}
+		}
+		medoids = append(medoids, next)
+		for i := range nearest {
+			nearest[i] = math.Min(nearest[i], cd.dist(i, next))
+		}
+	}
+
+	assign := make([]int, n)
+	for iter := 0; iter < iterations; iter++ {
+		parallelRange(n, func(i int) {
+			best, bestDist := 0, math.Inf(1)
+			for m, medoid := range medoids {
+				if d := cd.dist(i, medoid); d < bestDist {
+					best, bestDist = m, d
+				}
+			}
+			assign[i] = best
+		})
+		next := clusterMedoids(assign, cd.dist)
+		changed := false
+		for m := range medoids {
+			if m < len(next) && next[m] >= 0 && next[m] != medoids[m] {
+				medoids[m], changed = next[m], true
+			}
+		}
+		if !changed {
+			util.Verbosef("k-medoids converged after %d iterations.", iter+1)
+			break
+		}
+	}
+
+	// Renumber the clusters by their first entry and drop empty clusters.
+	set := newDisjointSet(n)
+	for i, m := range assign {
+		set.union(i, medoids[m])
+	}
+	clusters := set.clusters()
+	return clusters, clusterMedoids(clusters, cd.dist)
+}
+
+// components returns the connected components of the graph connecting every
+// pair of entries at most threshold apart.
+func components(cd clusterDists, threshold float64) []int {
+	const blockSize = 32
+
+	n := cd.len()
+	opts := bowdb.SearchOptions{
+		Limit:  -1,
+		Min:    math.Inf(-1),
+		Max:    threshold,
+		SortBy: cd.sortBy,
+		Order:  bowdb.OrderAsc,
+	}
+	set := newDisjointSet(n)
+	var setLock sync.Mutex
+	starts := make(chan int)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < flagCpu; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range starts {
+				end := start + blockSize
+				if end > n {
+					end = n
+				}
+				queries := make([]bow.Bowed, end-start)
+				for i := range queries {
+					queries[i] = query.Bowed(cd.qs.Store(), start+i)
+				}
+				best, err := cd.qs.Nearest(context.Background(), opts,
+					queries)
+				util.Assert(err)
+				setLock.Lock()
+				for qi, neighbors := range best {
+					for _, nb := range neighbors {
+						set.union(start+qi, nb.Index)
+					}
+				}
+				setLock.Unlock()
+			}
+		}()
+	}
+	for start := 0; start < n; start += blockSize {
+		starts <- start
+	}
+	close(starts)
+	wg.Wait()
+	return set.clusters()
+}
+
+// clusterMedoids returns the medoid of each cluster: the entry with the
+// smallest sum of distances to the other entries in its cluster. The medoid
+// of an empty cluster is -1.
+func clusterMedoids(clusters []int, dist func(i, j int) float64) []int {
+	var members [][]int
+	for i, c := range clusters {
+		for c >= len(members) {
+			members = append(members, nil)
+		}
+		members[c] = append(members[c], i)
+	}
+	medoids := make([]int, len(members))
+	parallelRange(len(members), func(c int) {
+		best, bestSum := -1, math.Inf(1)
+		for _, i := range members[c] {
+			sum := 0.0
+			for _, j := range members[c] {
+				sum += dist(i, j)
+			}
+			if sum < bestSum {
+				best, bestSum = i, sum
+			}
+		}
+		medoids[c] = best
+	})
+	return medoids
+}
+
+// parallelRange calls f for every integer in [0, n) with flagCpu goroutines.
+func parallelRange(n int, f func(i int)) {
+	jobs := make(chan int)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < flagCpu; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// disjointSet is a union-find structure over the integers [0, n).
+type disjointSet []int
+
+func newDisjointSet(n int) disjointSet {
+	set := make(disjointSet, n)
+	for i := range set {
+		set[i] = i
+	}
+	return set
+}
+
+func (set disjointSet) find(i int) int {
+	for set[i] != i {
+		set[i] = set[set[i]]
+		i = set[i]
+	}
+	return i
+}
+
+// union joins the sets containing i and j and returns the root of the new
+// set.
+func (set disjointSet) union(i, j int) int {
+	ri, rj := set.find(i), set.find(j)
+	if ri < rj {
+		set[rj] = ri
+		return ri
+	}
+	set[ri] = rj
+	return rj
+}
+
+// clusters numbers the sets from 0 in the order of their smallest member,
+// and returns the number of the set of each integer.
+func (set disjointSet) clusters() []int {
+	numbers := make(map[int]int)
+	clusters := make([]int, len(set))
+	for i := range set {
+		root := set.find(i)
+		c, ok := numbers[root]
+		if !ok {
+			c = len(numbers)
+			numbers[root] = c
+		}
+		clusters[i] = c
+	}
+	return clusters
+}
+
+type mergesByHeight []clusterMerge
+
+func (ms mergesByHeight) Len() int           { return len(ms) }
+func (ms mergesByHeight) Less(i, j int) bool { return ms[i].height < ms[j].height }
+func (ms mergesByHeight) Swap(i, j int)      { ms[i], ms[j] = ms[j], ms[i] }
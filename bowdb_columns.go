@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/ndaniels/tools/util"
+)
+
+var flagColumnsSparse = false
+
+var cmdBowDbColumns = &command{
+	name:            "bowdb-columns",
+	positionalUsage: "bowdb-path",
+	shortHelp:       "convert a BOW database to a memory mapped columnar file",
+	help: `
+The bowdb-columns command converts the BOWs in the given database to a
+columnar file, which is written next to the database with a '.cols'
+extension. The file contains a table of identifiers and a contiguous matrix
+of BOW frequencies.
+
+When the columnar file exists, the search command maps it into memory instead
+of reading every entry in the database. This makes searches of large
+databases start almost immediately, and concurrent searches of the same
+database share memory.
+
+With '-sparse', only the non-zero frequencies of each BOW are stored. This is
+smaller when BOWs only contain a few of the fragments in the library, but
+each BOW must be expanded when it is compared with a query.
+
+If entries are added to the database after the conversion, then the columnar
+file is ignored until this command is run again.
+`,
+	flags: flag.NewFlagSet("bowdb-columns", flag.ExitOnError),
+	run:   bowDbColumns,
+	addFlags: func(c *command) {
+		c.flags.BoolVar(&flagColumnsSparse, "sparse", flagColumnsSparse,
+			"When set, BOWs are stored in a sparse format.")
+	},
+}
+
+func bowDbColumns(c *command) {
+	c.assertNArg(1)
+
+	dbPath := c.flags.Arg(0)
+	db := util.OpenBowDB(dbPath)
+	entries, err := db.ReadAll()
+	util.Assert(err, "Could not read BOW database entries")
+	util.Assert(db.Close())
+
+	util.Verbosef("Writing %d entries to '%s'...",
+		len(entries), colPath(dbPath))
+	err = writeColumns(colPath(dbPath), dbPath, db.Lib.Size(), entries,
+		flagColumnsSparse)
+	util.Assert(err, "Could not write '%s'", colPath(dbPath))
+}
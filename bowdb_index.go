@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/ndaniels/flib/query"
+	"github.com/ndaniels/tools/util"
+)
+
+var (
+	flagIndexMetric   = "cosine"
+	flagIndexLeafSize = 16
+)
+
+var cmdBowDbIndex = &command{
+	name:            "bowdb-index",
+	positionalUsage: "bowdb-path",
+	shortHelp:       "add a nearest neighbor index to a BOW database",
+	help: `
+The bowdb-index command builds a vantage point tree (VP-tree) over the BOWs in
+the given database and stores it inside the database. The search command uses
+the tree automatically when it is present, which avoids comparing each query
+with every entry in the database.
+
+The tree is built for a single distance metric, given by '-metric'. It is only
+used by searches that sort by that metric in ascending order with a positive
+'-limit' and no '-min'. Other searches scan the whole database as before.
+
+By default, searches with the tree are exact. The '-ef' flag of the search
+command trades recall for speed by limiting the number of BOWs each query is
+compared with.
+
+If the database changes after the tree is built (detected by the size and
+modification time of its entries), then the tree is ignored until this
+command is run again.
+`,
+	flags: flag.NewFlagSet("bowdb-index", flag.ExitOnError),
+	run:   bowDbIndex,
+	addFlags: func(c *command) {
+		c.flags.StringVar(&flagIndexMetric, "metric", flagIndexMetric,
+			"The distance metric to build the tree for.\n"+
+				"Valid values are 'cosine' and 'euclid'.")
+		c.flags.IntVar(&flagIndexLeafSize, "leaf-size", flagIndexLeafSize,
+			"The maximum number of BOWs in each leaf of the tree.")
+	},
+}
+
+func bowDbIndex(c *command) {
+	c.assertNArg(1)
+
+	if flagIndexMetric != "cosine" && flagIndexMetric != "euclid" {
+		util.Fatalf("Unknown metric '%s'.", flagIndexMetric)
+	}
+
+	dbPath := c.flags.Arg(0)
+	db := util.OpenBowDB(dbPath)
+	entries, err := db.ReadAll()
+	util.Assert(err, "Could not read BOW database entries")
+	util.Assert(db.Close())
+
+	util.Verbosef("Building %s index over %d entries...",
+		flagIndexMetric, len(entries))
+	tree := buildVPTree(flagIndexMetric, query.Entries(entries), flagIndexLeafSize)
+	util.Assert(writeVPTree(dbPath, tree),
+		"Could not write index to '%s'", dbPath)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/esfragbag/bowdb"
+	"github.com/ndaniels/flib/query"
+	"github.com/ndaniels/tools/util"
+)
+
+var (
+	flagKnnK         = 10
+	flagKnnMetric    = "cosine"
+	flagKnnMax       = math.Inf(1)
+	flagKnnSymmetric = "none"
+	flagKnnOutFmt    = "edges"
+)
+
+var cmdBowDbKnn = &command{
+	name:            "bowdb-knn",
+	positionalUsage: "bowdb-path",
+	shortHelp:       "find nearest neighbors within a BOW database",
+	help: `
+The bowdb-knn command finds the k nearest neighbors of every entry in the given
+BOW database and writes them to stdout as a similarity graph. The BOWs stored
+in the database are used directly, so no bower files are read. An entry is
+never its own neighbor.
+
+Each edge of the graph connects an entry with one of its neighbors. The
+'-symmetric' flag controls how the edges of two entries are combined:
+
+	none     one directed edge from each entry to each of its neighbors
+	union    an undirected edge if either entry is a neighbor of the other
+	mutual   an undirected edge if both entries are neighbors of each other
+
+The graph can be written in one of these formats:
+
+	edges    tab-separated lines with the identifiers of both entries and
+	         their cosine and euclidean distances
+	graphml  a GraphML document, where each node has the entry's identifier
+	         and each edge has both distances
+	mtx      a sparse matrix in the Matrix Market format, whose rows and
+	         columns are the positions of the entries in the database and
+	         whose values are the distances given by '-metric'. The
+	         identifiers of the entries are listed in comments.
+
+If the database has a columnar file (see bowdb-columns), it is used.
+`,
+	flags: flag.NewFlagSet("bowdb-knn", flag.ExitOnError),
+	run:   bowDbKnn,
+	addFlags: func(c *command) {
+		c.flags.IntVar(&flagKnnK, "k", flagKnnK,
+			"The number of neighbors of each entry.")
+		c.flags.StringVar(&flagKnnMetric, "metric", flagKnnMetric,
+			"The distance used to find neighbors.\n"+
+				"Valid values are 'cosine' and 'euclid'.")
+		c.flags.Float64Var(&flagKnnMax, "max", flagKnnMax,
+			"Neighbors are at most this distance from an entry.")
+		c.flags.StringVar(&flagKnnSymmetric, "symmetric", flagKnnSymmetric,
+			"How the neighbors of two entries are combined.\n"+
+				"Valid values are 'none', 'union' and 'mutual'.")
+		c.flags.StringVar(&flagKnnOutFmt, "outfmt", flagKnnOutFmt,
+			"The output format of the graph.\n"+
+				"Valid values are 'edges', 'graphml' and 'mtx'.")
+	},
+}
+
+// knnEdge is an edge between two entries of a database, given by their
+// positions.
+type knnEdge struct {
+	from, to       int
+	cosine, euclid float64
+}
+
+func bowDbKnn(c *command) {
+	c.assertNArg(1)
+
+	if flagKnnK < 1 {
+		util.Fatalf("The number of neighbors must be at least 1.")
+	}
+	opts := bowdb.SearchOptions{
+		Limit: flagKnnK + 1, // the entry itself may be among the results
+		Min:   math.Inf(-1),
+		Max:   flagKnnMax,
+		Order: bowdb.OrderAsc,
+	}
+	switch flagKnnMetric {
+	case "cosine":
+		opts.SortBy = bowdb.SortByCosine
+	case "euclid":
+		opts.SortBy = bowdb.SortByEuclid
+	default:
+		util.Fatalf("Unknown metric '%s'.", flagKnnMetric)
+	}
+	switch flagKnnSymmetric {
+	case "none", "union", "mutual":
+	default:
+		util.Fatalf("Unknown symmetrization '%s'.", flagKnnSymmetric)
+	}
+	switch flagKnnOutFmt {
+	case "edges", "graphml", "mtx":
+	default:
+		util.Fatalf("Invalid output format '%s'.", flagKnnOutFmt)
+	}
+
+	dbPath := c.flags.Arg(0)
+	db := util.OpenBowDB(dbPath)
+	store := readBowStore(dbPath, db)
+	if cols, ok := store.(*colStore); ok {
+		defer cols.Close()
+	}
+
+	edges := knnEdges(query.NewSearcher(store), opts, flagKnnK)
+	if flagKnnSymmetric != "none" {
+		edges = symmetricEdges(edges, flagKnnSymmetric == "mutual")
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	switch flagKnnOutFmt {
+	case "edges":
+		writeKnnEdges(w, store, edges)
+	case "graphml":
+		writeKnnGraphML(w, store, edges, flagKnnSymmetric == "none")
+	case "mtx":
+		writeKnnMatrix(w, store, edges, opts, flagKnnSymmetric == "none")
+	}
+	util.Assert(w.Flush())
+	util.Assert(db.Close())
+}
+
+// knnEdges returns the edges from every entry to its k nearest neighbors,
+// searching for the neighbors of a block of entries at a time with flagCpu
+// goroutines.
+func knnEdges(qs *query.Searcher, opts bowdb.SearchOptions, k int) []knnEdge {
+	const blockSize = 32
+
+	n := qs.Store().Len()
+	edges := make([][]knnEdge, n)
+	starts := make(chan int)
+	progress := util.NewProgress(n)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < flagCpu; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range starts {
+				end := start + blockSize
+				if end > n {
+					end = n
+				}
+				queries := make([]bow.Bowed, end-start)
+				for i := range queries {
+					queries[i] = query.Bowed(qs.Store(), start+i)
+				}
+				best, err := qs.Nearest(context.Background(), opts, queries)
+				util.Assert(err)
+				for qi, neighbors := range best {
+					edges[start+qi] = neighborEdges(qs.Store(), opts,
+						start+qi, queries[qi], neighbors, k)
+					progress.JobDone(nil)
+				}
+			}
+		}()
+	}
+	for start := 0; start < n; start += blockSize {
+		starts <- start
+	}
+	close(starts)
+	wg.Wait()
+	progress.Close()
+
+	var all []knnEdge
+	for _, es := range edges {
+		all = append(all, es...)
+	}
+	return all
+}
+
+// neighborEdges returns the edges from the entry at position from to its
+// closest k neighbors among those given, sorted by distance.
+func neighborEdges(
+	store query.Store,
+	opts bowdb.SearchOptions,
+	from int,
+	q bow.Bowed,
+	neighbors []query.Neighbor,
+	k int,
+) []knnEdge {
+	var edges []knnEdge
+	for _, nb := range neighbors {
+		if nb.Index == from {
+			continue
+		}
+		b := query.Bowed(store, nb.Index)
+		e := knnEdge{
+			from:   from,
+			to:     nb.Index,
+			cosine: q.Bow.Cosine(b.Bow),
+			euclid: q.Bow.Euclid(b.Bow),
+		}
+		if e.dist(opts) <= opts.Max {
+			edges = append(edges, e)
+		}
+	}
+	sort.Sort(edgesByDist{opts, edges})
+	if len(edges) > k {
+		edges = edges[:k]
+	}
+	return edges
+}
+
+func (e knnEdge) dist(opts bowdb.SearchOptions) float64 {
+	if opts.SortBy == bowdb.SortByEuclid {
+		return e.euclid
+	}
+	return e.cosine
+}
+
+// symmetricEdges returns undirected edges from the directed edges given, with
+// the smaller position first. If mutual is true, only pairs of entries with
+// edges in both directions are kept.
+func symmetricEdges(edges []knnEdge, mutual bool) []knnEdge {
+	type pair struct{ a, b int }
+
+	seen := make(map[pair]int)
+	var undirected []knnEdge
+	for _, e := range edges {
+		if e.from > e.to {
+			e.from, e.to = e.to, e.from
+		}
+		p := pair{e.from, e.to}
+		if _, ok := seen[p]; !ok {
+			undirected = append(undirected, e)
+		}
+		seen[p]++
+	}
+	if !mutual {
+		return undirected
+	}
+
+	var both []knnEdge
+	for _, e := range undirected {
+		if seen[pair{e.from, e.to}] > 1 {
+			both = append(both, e)
+		}
+	}
+	return both
+}
+
+func writeKnnEdges(w io.Writer, store query.Store, edges []knnEdge) {
+	fmt.Fprintf(w, "Source\tTarget\tCosine\tEuclid\n")
+	for _, e := range edges {
+		fmt.Fprintf(w, "%s\t%s\t%0.4f\t%0.4f\n",
+			store.Id(e.from), store.Id(e.to), e.cosine, e.euclid)
+	}
+}
+
+func writeKnnGraphML(
+	w io.Writer,
+	store query.Store,
+	edges []knnEdge,
+	directed bool,
+) {
+	edgeDefault := "undirected"
+	if directed {
+		edgeDefault = "directed"
+	}
+	fmt.Fprintf(w, "%s", xml.Header)
+	fmt.Fprintf(w, "<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n")
+	fmt.Fprintf(w, "  <key id=\"name\" for=\"node\" attr.name=\"name\" "+
+		"attr.type=\"string\"/>\n")
+	fmt.Fprintf(w, "  <key id=\"cosine\" for=\"edge\" attr.name=\"cosine\" "+
+		"attr.type=\"double\"/>\n")
+	fmt.Fprintf(w, "  <key id=\"euclid\" for=\"edge\" attr.name=\"euclid\" "+
+		"attr.type=\"double\"/>\n")
+	fmt.Fprintf(w, "  <graph id=\"knn\" edgedefault=\"%s\">\n", edgeDefault)
+	for i := 0; i < store.Len(); i++ {
+		fmt.Fprintf(w, "    <node id=\"n%d\"><data key=\"name\">", i)
+		xml.EscapeText(w, []byte(store.Id(i)))
+		fmt.Fprintf(w, "</data></node>\n")
+	}
+	for _, e := range edges {
+		fmt.Fprintf(w, "    <edge source=\"n%d\" target=\"n%d\">"+
+			"<data key=\"cosine\">%0.4f</data>"+
+			"<data key=\"euclid\">%0.4f</data></edge>\n",
+			e.from, e.to, e.cosine, e.euclid)
+	}
+	fmt.Fprintf(w, "  </graph>\n")
+	fmt.Fprintf(w, "</graphml>\n")
+}
+
+// writeKnnMatrix writes the edges as a Matrix Market coordinate matrix.
+// Undirected edges are written once, in the lower triangle of a symmetric
+// matrix.
+func writeKnnMatrix(
+	w io.Writer,
+	store query.Store,
+	edges []knnEdge,
+	opts bowdb.SearchOptions,
+	directed bool,
+) {
+	kind := "symmetric"
+	if directed {
+		kind = "general"
+	}
+	fmt.Fprintf(w, "%%%%MatrixMarket matrix coordinate real %s\n", kind)
+	for i := 0; i < store.Len(); i++ {
+		fmt.Fprintf(w, "%% %d %s\n", i+1, store.Id(i))
+	}
+	fmt.Fprintf(w, "%d %d %d\n", store.Len(), store.Len(), len(edges))
+	for _, e := range edges {
+		row, col := e.from, e.to
+		if !directed {
+			row, col = e.to, e.from
+		}
+		fmt.Fprintf(w, "%d %d %g\n", row+1, col+1, e.dist(opts))
+	}
+}
+
+type edgesByDist struct {
+	opts  bowdb.SearchOptions
+	edges []knnEdge
+}
+
+func (ed edgesByDist) Len() int { return len(ed.edges) }
+func (ed edgesByDist) Less(i, j int) bool {
+	return ed.edges[i].dist(ed.opts) < ed.edges[j].dist(ed.opts)
+}
+func (ed edgesByDist) Swap(i, j int) {
+	ed.edges[i], ed.edges[j] = ed.edges[j], ed.edges[i]
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ndaniels/flib/build"
+)
+
+// A BOW database is a tar archive with a single directory containing the
+// fragment library ('frag-lib.json') and the BOWs ('bow.db'). The bowdb
+// package ignores any other files in that directory, so we store extra
+// information about the database next to them.
+
+const bowDbMetaFile = "meta.json"
+
+// bowDbMeta is information about a BOW database that the bowdb package does
+// not keep track of.
+type bowDbMeta struct {
+	// The options used to compute every BOW in the database.
+	BowOpts build.Options
+}
+
+// readBowDbMeta reads the metadata of the BOW database at the path given.
+// If the database has no metadata (e.g., it was created by an older version
+// of flib), then nil is returned with no error.
+func readBowDbMeta(dbPath string) (*bowDbMeta, error) {
+	data, err := readBowDbFile(dbPath, bowDbMetaFile)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	meta := new(bowDbMeta)
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("Could not decode metadata in '%s': %s",
+			dbPath, err)
+	}
+	return meta, nil
+}
+
+// writeBowDbMeta adds the metadata given to the BOW database at the path
+// given, replacing any metadata already there.
+func writeBowDbMeta(dbPath string, meta *bowDbMeta) error {
+	data, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeBowDbFile(dbPath, bowDbMetaFile, data)
+}
+
+// readBowDbFile returns the contents of the file with the given name in the
+// BOW database's directory. If no such file exists, nil is returned with no
+// error.
+func readBowDbFile(dbPath, name string) ([]byte, error) {
+	f, err := os.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read '%s': %s", dbPath, err)
+		}
+		if path.Base(hdr.Name) == name && path.Dir(hdr.Name) != "." {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// statBowDbFile returns the tar header of the file with the given name in
+// the BOW database's directory. If no such file exists, nil is returned with
+// no error.
+func statBowDbFile(dbPath, name string) (*tar.Header, error) {
+	f, err := os.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read '%s': %s", dbPath, err)
+		}
+		if path.Base(hdr.Name) == name && path.Dir(hdr.Name) != "." {
+			return hdr, nil
+		}
+	}
+}
+
+// writeBowDbFile adds a file with the given name and contents to the BOW
+// database's directory, replacing a file with the same name if it exists.
+//
+// Since files cannot be replaced inside a tar archive, the entire archive is
+// copied to a temporary file that is then moved over the original.
+func writeBowDbFile(dbPath, name string, data []byte) error {
+	src, err := os.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := ioutil.TempFile(path.Dir(dbPath), path.Base(dbPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	if info, err := src.Stat(); err == nil {
+		tmp.Chmod(info.Mode())
+	}
+
+	dir := ""
+	tr, tw := tar.NewReader(src), tar.NewWriter(tmp)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			tmp.Close()
+			return fmt.Errorf("Could not read '%s': %s", dbPath, err)
+		}
+		if len(dir) == 0 {
+			dir = strings.SplitN(strings.TrimPrefix(hdr.Name, "./"), "/", 2)[0]
+		}
+		if path.Base(hdr.Name) == name && path.Dir(hdr.Name) != "." {
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if len(dir) == 0 {
+		tmp.Close()
+		return fmt.Errorf("'%s' is not a BOW database", dbPath)
+	}
+
+	hdr := &tar.Header{
+		Name:    path.Join(dir, name),
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := io.Copy(tw, bytes.NewReader(data)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dbPath)
+}
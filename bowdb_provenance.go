@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/ndaniels/esfragbag"
+)
+
+// The provenance of a BOW database is stored separately from its metadata,
+// since it has a record for every entry and is only needed occasionally.
+const bowDbProvenanceFile = "provenance.json"
+
+// flibVersion is the version of flib recorded in the BOW databases that it
+// creates. It can be set when building with
+// '-ldflags "-X main.flibVersion=..."'.
+var flibVersion = "devel"
+
+// bowDbProvenance describes how a BOW database was created.
+type bowDbProvenance struct {
+	Created     time.Time
+	Version     string
+	GoVersion   string
+	CommandLine []string
+
+	// The files that BOWs were computed from, in the order given.
+	Inputs []bowDbInput
+
+	// A record for every entry, in the order they were added.
+	Entries []bowDbEntry
+}
+
+// bowDbInput is a file that BOWs were computed from.
+type bowDbInput struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// bowDbEntry records where the BOW of a single entry came from.
+type bowDbEntry struct {
+	Id string
+
+	// The bower file argument the entry was read from, with an absolute
+	// path.
+	Source string
+
+	// The chain of the entry (empty for FASTA sequences).
+	Chain string
+
+	// The number of residues of the entry (with alpha-carbon atoms, for
+	// structures) and the number of its windows counted in its BOW.
+	Residues int
+	Windows  int
+}
+
+// newBowDbProvenance returns the provenance of a BOW database created now by
+// this process.
+func newBowDbProvenance() *bowDbProvenance {
+	return &bowDbProvenance{
+		Created:     time.Now().UTC(),
+		Version:     flibVersion,
+		GoVersion:   runtime.Version(),
+		CommandLine: os.Args,
+	}
+}
+
+// newBowDbEntry returns the record of the entry computed from the bower
+// given with the library given.
+func newBowDbEntry(sb sourcedBow, lib fragbag.Library) bowDbEntry {
+	spec := sb.spec
+	spec.path = absInputPath(spec.path)
+	residues := len(sb.bower.AllAtoms())
+	if residues == 0 {
+		residues = len(sb.bower.Residues())
+	}
+	return bowDbEntry{
+		Id:       sb.Id,
+		Source:   spec.String(),
+		Chain:    sb.bower.Chain,
+		Residues: residues,
+		Windows:  sb.bower.Windows(lib),
+	}
+}
+
+// bowDbInputs are the files that BOWs were computed from, by absolute path.
+// Each file's checksum is computed when its first bower file argument has
+// been processed, so that files that can't be read are skipped like any
+// other unusable input.
+type bowDbInputs map[string]bowDbInput
+
+// checksum returns the record of the file of the bower file argument given,
+// computing its checksum if it hasn't been already.
+func (inputs bowDbInputs) checksum(spec bowerSpec) (bowDbInput, error) {
+	if input, ok := inputs[absInputPath(spec.path)]; ok {
+		return input, nil
+	}
+	input, err := checksumInput(spec.path)
+	if err != nil {
+		return input, err
+	}
+	inputs[input.Path] = input
+	return input, nil
+}
+
+// ordered returns the files recorded, in the order of the bower file
+// arguments given. Each file is only returned once.
+func (inputs bowDbInputs) ordered(specs []bowerSpec) []bowDbInput {
+	var ordered []bowDbInput
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		fpath := absInputPath(spec.path)
+		if input, ok := inputs[fpath]; ok && !seen[fpath] {
+			seen[fpath] = true
+			ordered = append(ordered, input)
+		}
+	}
+	return ordered
+}
+
+func absInputPath(fpath string) string {
+	if abs, err := filepath.Abs(fpath); err == nil {
+		return abs
+	}
+	return fpath
+}
+
+func checksumInput(fpath string) (bowDbInput, error) {
+	input := bowDbInput{Path: absInputPath(fpath)}
+
+	f, err := os.Open(fpath)
+	if err != nil {
+		return input, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if input.Size, err = io.Copy(h, f); err != nil {
+		return input, fmt.Errorf("Could not read '%s': %s", fpath, err)
+	}
+	input.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return input, nil
+}
+
+// entries returns the records of the entries by identifier.
+func (p *bowDbProvenance) entries() map[string]*bowDbEntry {
+	byId := make(map[string]*bowDbEntry, len(p.Entries))
+	for i := range p.Entries {
+		byId[p.Entries[i].Id] = &p.Entries[i]
+	}
+	return byId
+}
+
+// column returns the value of the column with the name given (see 'search
+// -columns'). Missing values are written as '-'.
+func (e *bowDbEntry) column(name string) string {
+	if e == nil {
+		return "-"
+	}
+	switch name {
+	case "source":
+		return e.Source
+	case "chain":
+		if len(e.Chain) == 0 {
+			return "-"
+		}
+		return e.Chain
+	case "residues":
+		return fmt.Sprintf("%d", e.Residues)
+	case "windows":
+		return fmt.Sprintf("%d", e.Windows)
+	}
+	return "-"
+}
+
+// readBowDbProvenance reads the provenance of the BOW database at the path
+// given. If the database has none (e.g., it was created by an older version
+// of flib), then nil is returned with no error.
+func readBowDbProvenance(dbPath string) (*bowDbProvenance, error) {
+	data, err := readBowDbFile(dbPath, bowDbProvenanceFile)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	p := new(bowDbProvenance)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("Could not decode provenance in '%s': %s",
+			dbPath, err)
+	}
+	return p, nil
+}
+
+// writeBowDbProvenance adds the provenance given to the BOW database at the
+// path given, replacing any provenance already there.
+func writeBowDbProvenance(dbPath string, p *bowDbProvenance) error {
+	data, err := json.MarshalIndent(p, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeBowDbFile(dbPath, bowDbProvenanceFile, data)
+}
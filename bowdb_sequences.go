@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/TuftsBCB/io/fasta"
+)
+
+// The residue sequences of the entries of a BOW database may be stored in a
+// FASTA file next to the BOWs (see 'mk-bowdb -sequences').
+const bowDbSeqFile = "sequences.fasta"
+
+// writeBowDbSequences adds the sequences given to the BOW database at the
+// path given, in the order of the identifiers given.
+func writeBowDbSequences(dbPath string, ids []string, seqs map[string]string) error {
+	var buf bytes.Buffer
+	for _, id := range ids {
+		fmt.Fprintf(&buf, ">%s\n", id)
+		s := seqs[id]
+		for len(s) > 60 {
+			fmt.Fprintf(&buf, "%s\n", s[:60])
+			s = s[60:]
+		}
+		fmt.Fprintf(&buf, "%s\n", s)
+	}
+	return writeBowDbFile(dbPath, bowDbSeqFile, buf.Bytes())
+}
+
+// readBowDbSequences returns the sequences stored in the BOW database at the
+// path given, by identifier. If the database has no sequences, nil is
+// returned with no error.
+func readBowDbSequences(dbPath string) (map[string]string, error) {
+	data, err := readBowDbFile(dbPath, bowDbSeqFile)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	entries, err := fasta.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read sequences in '%s': %s",
+			dbPath, err)
+	}
+	seqs := make(map[string]string, len(entries))
+	for _, s := range entries {
+		residues := make([]byte, len(s.Residues))
+		for i, r := range s.Residues {
+			residues[i] = byte(r)
+		}
+		seqs[fastaId(s)] = string(residues)
+	}
+	return seqs, nil
+}
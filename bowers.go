@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/TuftsBCB/io/fasta"
+	"github.com/TuftsBCB/seq"
+	"github.com/TuftsBCB/structure"
+	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/flib/build"
+	"github.com/ndaniels/tools/util"
+)
+
+// sourcedBow is the BOW of a bower along with the bower itself and the
+// bower file argument that it was read from.
+type sourcedBow struct {
+	bow.Bowed
+	spec  bowerSpec
+	bower build.Bower
+}
+
+// processBowers reads each bower file argument given and sends a BOW for
+// every bower in each file on the channel returned. The channel is closed
+// once all files have been processed. Files are processed in parallel with
+// flagCpu workers.
+//
+// When models is true, every model of every PDB chain is a bower. Otherwise,
+// only the first model of each chain is used.
+//
+// When the context is cancelled, no more files are read and the channel is
+// closed once the files being read have been processed.
+func processBowers(
+	ctx context.Context,
+	specs []bowerSpec,
+	lib fragbag.Library,
+	models bool,
+	opts build.Options,
+	hideProgress bool,
+) <-chan bow.Bowed {
+	sourced := processSourcedBowers(ctx, specs, lib, models, opts,
+		hideProgress)
+	bows := make(chan bow.Bowed, flagCpu*2)
+	go func() {
+		for sb := range sourced {
+			bows <- sb.Bowed
+		}
+		close(bows)
+	}()
+	return bows
+}
+
+// processSourcedBowers is like processBowers, but also sends the bower of
+// each BOW and the bower file argument that it was read from.
+func processSourcedBowers(
+	ctx context.Context,
+	specs []bowerSpec,
+	lib fragbag.Library,
+	models bool,
+	opts build.Options,
+	hideProgress bool,
+) <-chan sourcedBow {
+	processed := processSpecBowers(ctx, specs, lib, models, opts,
+		hideProgress)
+	bows := make(chan sourcedBow, flagCpu*2)
+	go func() {
+		for sb := range processed {
+			for _, b := range sb.bows {
+				bows <- b
+			}
+		}
+		close(bows)
+	}()
+	return bows
+}
+
+// specBows is the BOWs of every bower selected by a single bower file
+// argument. If the file could not be read, err is set and there are no BOWs.
+type specBows struct {
+	spec  bowerSpec
+	index int // the position of the argument in the list given
+	bows  []sourcedBow
+	err   error
+}
+
+// processSpecBowers is like processSourcedBowers, but sends the BOWs of each
+// bower file argument together, so that callers know when an argument has
+// been completely processed (see checkpoint).
+func processSpecBowers(
+	ctx context.Context,
+	specs []bowerSpec,
+	lib fragbag.Library,
+	models bool,
+	opts build.Options,
+	hideProgress bool,
+) <-chan specBows {
+	util.Assert(opts.Check(lib))
+
+	processed := make(chan specBows, flagCpu*2)
+	specChan := make(chan int)
+	go func() {
+		defer close(specChan)
+		for i := range specs {
+			select {
+			case specChan <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var progress *util.Progress
+	if !hideProgress {
+		progress = util.NewProgress(len(specs))
+	}
+	wg := new(sync.WaitGroup)
+	for i := 0; i < flagCpu; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range specChan {
+				spec := specs[index]
+				bowers, err := readBowers(spec, lib, models)
+				if progress != nil {
+					progress.JobDone(err)
+				} else if err != nil {
+					log.Printf("Could not read '%s': %s", spec, err)
+				}
+				if err != nil {
+					skipped.input(spec, err)
+				}
+				sb := specBows{spec: spec, index: index, err: err}
+				for i, b := range bowers {
+					skipped.bower(spec, &bowers[i], lib)
+					freqs, err := build.ComputeBOW(lib, b, opts)
+					util.Assert(err)
+					sb.bows = append(sb.bows, sourcedBow{
+						Bowed: bow.Bowed{Id: b.Id, Bow: freqs},
+						spec:  spec,
+						bower: b,
+					})
+				}
+				processed <- sb
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		if progress != nil {
+			progress.Close()
+		}
+		close(processed)
+	}()
+	return processed
+}
+
+// readBowers returns all bowers selected by the bower file argument given.
+// The file may be a FASTA, PDB or mmCIF file (optionally compressed with
+// gzip). FASTA files may only be used with sequence fragment libraries.
+func readBowers(
+	spec bowerSpec,
+	lib fragbag.Library,
+	models bool,
+) ([]build.Bower, error) {
+	bowers, err := readSpecBowers(spec, lib, models)
+	if err != nil {
+		return nil, err
+	}
+	if len(spec.id) > 0 {
+		if len(bowers) != 1 {
+			return nil, fmt.Errorf("Identifier '%s' given for '%s', but it "+
+				"has %d bowers", spec.id, spec, len(bowers))
+		}
+		bowers[0].Id = spec.id
+	}
+	return bowers, nil
+}
+
+func readSpecBowers(
+	spec bowerSpec,
+	lib fragbag.Library,
+	models bool,
+) ([]build.Bower, error) {
+	if isFasta(spec.path) {
+		if fragbag.IsStructure(lib) {
+			return nil, fmt.Errorf("FASTA file cannot be used with "+
+				"structure fragment library '%s'", lib.Name())
+		}
+		if spec.selected() {
+			return nil, fmt.Errorf("Chains, residues and models cannot be "+
+				"selected in FASTA file '%s'", spec.path)
+		}
+		f, err := openInput(spec.path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		seqs, err := fasta.NewReader(f).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		bowers := make([]build.Bower, len(seqs))
+		for i, s := range seqs {
+			bowers[i] = build.Bower{
+				Id:        fastaId(s),
+				Sequences: []seq.Sequence{s},
+			}
+		}
+		return bowers, nil
+	}
+
+	sfs, err := spec.open()
+	if err != nil {
+		return nil, err
+	}
+
+	// Each entry contains a single range of residues of the same chain.
+	if len(spec.ranges) > 0 {
+		b := build.Bower{
+			Id: fmt.Sprintf("%s:%s",
+				sfs[0].chainId(sfs[0].chains[0]), spec.rangesString()),
+			Chain: sfs[0].chainName(sfs[0].chains[0]),
+		}
+		for _, sf := range sfs {
+			chain := sf.chains[0]
+			b.Atoms = append(b.Atoms, chain.CaAtoms())
+			b.Sequences = append(b.Sequences, chain.AsSequence())
+		}
+		return []build.Bower{b}, nil
+	}
+
+	sf := sfs[0]
+	var bowers []build.Bower
+	for _, chain := range sf.chains {
+		if !chain.IsProtein() {
+			continue
+		}
+		id := sf.chainId(chain)
+		sequence := []seq.Sequence{chain.AsSequence()}
+		if !models || spec.model > 0 || len(chain.Models) <= 1 {
+			bowers = append(bowers, build.Bower{
+				Id:        id,
+				Chain:     sf.chainName(chain),
+				Atoms:     [][]structure.Coords{chain.CaAtoms()},
+				Sequences: sequence,
+			})
+			continue
+		}
+		for _, model := range chain.Models {
+			bowers = append(bowers, build.Bower{
+				Id:        fmt.Sprintf("%s:%d", id, model.Num),
+				Chain:     sf.chainName(chain),
+				Atoms:     [][]structure.Coords{model.CaAtoms()},
+				Sequences: sequence,
+			})
+		}
+	}
+	return bowers, nil
+}
+
+func isFasta(fpath string) bool {
+	fpath = strings.TrimSuffix(strings.ToLower(fpath), ".gz")
+	switch path.Ext(fpath) {
+	case ".fasta", ".fas", ".fa", ".faa":
+		return true
+	}
+	return false
+}
+
+// fastaId returns the first word of a FASTA sequence header.
+func fastaId(s seq.Sequence) string {
+	if fields := strings.Fields(s.Name); len(fields) > 0 {
+		return fields[0]
+	}
+	return s.Name
+}
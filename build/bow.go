@@ -0,0 +1,234 @@
+// Package build computes the bags-of-words (BOWs) of proteins and builds
+// fragment libraries from training data. It is the library behind the flib
+// commands that create BOW databases and fragment libraries, so that other
+// programs can do the same without running flib.
+//
+// Functions in this package return errors instead of exiting. Functions that
+// may run for a long time accept a context, and stop early with the context's
+// error when it is cancelled.
+package build
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/TuftsBCB/seq"
+	"github.com/TuftsBCB/structure"
+	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/esfragbag/bow"
+)
+
+// Options controls how each window of a structure is counted when computing
+// a BOW with a structure fragment library. The zero value is not useful; use
+// DefaultOptions instead.
+//
+// These options are stored in the metadata of a BOW database so that queries
+// against it are computed in the same way as its entries.
+type Options struct {
+	// The number of nearest fragments counted for each window. When greater
+	// than 1, each window contributes a total weight of 1, distributed among
+	// the nearest fragments according to AssignSigma.
+	AssignK int
+
+	// The width (in angstroms of RMSD) of the Gaussian kernel used to weight
+	// the nearest fragments of a window relative to the best one.
+	AssignSigma float64
+
+	// When positive, windows whose best fragment has an RMSD greater than
+	// this are not counted.
+	MaxRMSD float64
+}
+
+// DefaultOptions counts each window of a structure as its best fragment.
+var DefaultOptions = Options{
+	AssignK:     1,
+	AssignSigma: 0.5,
+	MaxRMSD:     0,
+}
+
+// Tolerant returns true if the options require computing the RMSD between
+// each window and every fragment (as opposed to just the best fragment).
+func (opts Options) Tolerant() bool {
+	return opts.AssignK > 1 || opts.MaxRMSD > 0
+}
+
+func (opts Options) String() string {
+	return fmt.Sprintf("assign-k=%d, assign-sigma=%g, max-rmsd=%g",
+		opts.AssignK, opts.AssignSigma, opts.MaxRMSD)
+}
+
+// Check returns an error if the options can't be used with the library
+// given.
+func (opts Options) Check(lib fragbag.Library) error {
+	if opts.Tolerant() && !fragbag.IsStructure(lib) {
+		return fmt.Errorf("The BOW options '%s' require a structure fragment "+
+			"library, but '%s' is not one.", opts, lib.Name())
+	}
+	if opts.AssignK > 1 && opts.AssignSigma <= 0 {
+		return fmt.Errorf("The assignment kernel width must be positive, "+
+			"but got %g.", opts.AssignSigma)
+	}
+	return nil
+}
+
+// Bower is a single protein (a PDB chain, one model of a PDB chain, part of
+// a PDB chain or a FASTA sequence) from which a BOW can be computed.
+//
+// A bower is made up of one or more segments, which are counted separately
+// so that no window spans two segments.
+type Bower struct {
+	Id        string
+	Chain     string               // empty for FASTA sequences
+	Atoms     [][]structure.Coords // nil for FASTA sequences
+	Sequences []seq.Sequence
+}
+
+// AllAtoms returns the alpha-carbon atoms of every segment of the bower.
+func (b *Bower) AllAtoms() []structure.Coords {
+	if len(b.Atoms) == 1 {
+		return b.Atoms[0]
+	}
+	var atoms []structure.Coords
+	for _, segment := range b.Atoms {
+		atoms = append(atoms, segment...)
+	}
+	return atoms
+}
+
+// Windows returns the number of windows of the bower that are counted in its
+// BOW with the library given.
+func (b *Bower) Windows(lib fragbag.Library) int {
+	fragSize := lib.FragmentSize()
+	count := func(n int) int {
+		if n < fragSize {
+			return 0
+		}
+		return n - fragSize + 1
+	}
+
+	windows := 0
+	if fragbag.IsStructure(lib) {
+		for _, atoms := range b.Atoms {
+			windows += count(len(atoms))
+		}
+	} else {
+		for _, s := range b.Sequences {
+			windows += count(s.Len())
+		}
+	}
+	return windows
+}
+
+// Residues returns the residues of every segment of the bower as a string of
+// one letter codes.
+func (b *Bower) Residues() string {
+	var buf []byte
+	for _, s := range b.Sequences {
+		for _, r := range s.Residues {
+			buf = append(buf, byte(r))
+		}
+	}
+	return string(buf)
+}
+
+// ComputeBOW returns the BOW of a single bower. If the library is weighted,
+// its weights are applied to the result.
+func ComputeBOW(lib fragbag.Library, b Bower, opts Options) (bow.Bow, error) {
+	freqs := make([]float32, lib.Size())
+	fragSize := lib.FragmentSize()
+
+	// Weighted libraries wrap the library that fragments are assigned with.
+	assign := lib
+	wlib, weighted := lib.(fragbag.WeightedLibrary)
+	if weighted && wlib.SubLibrary() != nil {
+		assign = wlib.SubLibrary()
+	}
+	switch assign := assign.(type) {
+	case fragbag.StructureLibrary:
+		for _, atoms := range b.Atoms {
+			for i := 0; i+fragSize <= len(atoms); i++ {
+				countWindow(assign, freqs, atoms[i:i+fragSize], opts)
+			}
+		}
+	case fragbag.SequenceLibrary:
+		for _, sequence := range b.Sequences {
+			for i := 0; i+fragSize <= sequence.Len(); i++ {
+				s := sequence.Slice(i, i+fragSize)
+				freqs[assign.BestSequenceFragment(s)]++
+			}
+		}
+	default:
+		return bow.Bow{}, fmt.Errorf("Unrecognized fragment library: %s",
+			lib.Tag())
+	}
+	if weighted {
+		freqs = wlib.AddWeights(freqs)
+	}
+	return bow.Bow{Freqs: freqs}, nil
+}
+
+// countWindow adds a single window of alpha-carbon atoms to the frequencies
+// given according to the BOW options.
+func countWindow(
+	lib fragbag.StructureLibrary,
+	freqs []float32,
+	window []structure.Coords,
+	opts Options,
+) {
+	if !opts.Tolerant() {
+		freqs[lib.BestStructureFragment(window)]++
+		return
+	}
+
+	nearest := nearestFragments(lib, window, opts.AssignK)
+	if opts.MaxRMSD > 0 && nearest[0].rmsd > opts.MaxRMSD {
+		return
+	}
+	weights := make([]float64, len(nearest))
+	total := 0.0
+	for i, near := range nearest {
+		d := (near.rmsd - nearest[0].rmsd) / opts.AssignSigma
+		weights[i] = math.Exp(-d * d)
+		total += weights[i]
+	}
+	for i, near := range nearest {
+		freqs[near.frag] += float32(weights[i] / total)
+	}
+}
+
+type fragDist struct {
+	frag int
+	rmsd float64
+}
+
+// nearestFragments returns the k fragments with the smallest RMSD to the
+// window given, sorted by increasing RMSD.
+func nearestFragments(
+	lib fragbag.StructureLibrary,
+	window []structure.Coords,
+	k int,
+) []fragDist {
+	if k < 1 {
+		k = 1
+	}
+	nearest := make([]fragDist, 0, k+1)
+	for i := 0; i < lib.Size(); i++ {
+		d := fragDist{i, structure.RMSD(window, lib.Atoms(i))}
+		if len(nearest) == k && d.rmsd >= nearest[k-1].rmsd {
+			continue
+		}
+
+		// Insert the new fragment in order, dropping the farthest if
+		// there are now too many.
+		j := len(nearest)
+		nearest = append(nearest, d)
+		for ; j > 0 && nearest[j-1].rmsd > d.rmsd; j-- {
+			nearest[j] = nearest[j-1]
+		}
+		nearest[j] = d
+		if len(nearest) > k {
+			nearest = nearest[:k]
+		}
+	}
+	return nearest
+}
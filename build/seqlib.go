@@ -0,0 +1,334 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+
+	"github.com/TuftsBCB/apps/hhsuite"
+	"github.com/TuftsBCB/io/msa"
+	"github.com/TuftsBCB/io/pdb"
+	"github.com/TuftsBCB/seq"
+	"github.com/TuftsBCB/structure"
+	"github.com/ndaniels/esfragbag"
+)
+
+// The reasons that a chain contributes nothing to a sequence fragment
+// library.
+var (
+	ErrTooShort  = errors.New("too short")
+	ErrNoCaAtoms = errors.New("no CA atoms")
+	ErrAllGapped = errors.New("all windows gapped")
+)
+
+// ChainWindows uses structural fragments to categorize every window of
+// alpha-carbon atoms in the chain given, and calls f with the best fragment
+// of each window and the window's residues. Windows with a missing atom are
+// skipped.
+//
+// If f is never called, then one of ErrTooShort, ErrNoCaAtoms or
+// ErrAllGapped is returned.
+func ChainWindows(
+	lib fragbag.StructureLibrary,
+	chain *pdb.Chain,
+	f func(frag int, s seq.Sequence),
+) error {
+	sequence := chain.AsSequence()
+	fragSize := lib.FragmentSize()
+
+	// If the chain is shorter than the fragment size, we can do nothing
+	// with it.
+	if sequence.Len() < fragSize {
+		return ErrTooShort
+	}
+
+	// This bit of trickery here is all about getting the call to
+	// SequenceCaAtoms outside of the loop. In particular, it's a very
+	// expensive call since it has to reconcile inconsistencies between
+	// SEQRES and ATOM records in PDB files.
+	limit := sequence.Len() - fragSize
+	atoms := chain.SequenceCaAtoms()
+	atomSlice := make([]structure.Coords, fragSize)
+	noGaps := func(atoms []*structure.Coords) []structure.Coords {
+		for i, atom := range atoms {
+			if atom == nil {
+				return nil
+			}
+			atomSlice[i] = *atom
+		}
+		return atomSlice
+	}
+	found := 0
+	for start := 0; start <= limit; start++ {
+		end := start + fragSize
+		cas := noGaps(atoms[start:end])
+		if cas == nil {
+			// Nothing contiguous was found (a "disordered" residue perhaps).
+			// So skip this part of the chain.
+			continue
+		}
+		f(lib.BestStructureFragment(atomSlice), sequence.Slice(start, end))
+		found++
+	}
+	if found == 0 {
+		return GappedError(atoms)
+	}
+	return nil
+}
+
+// GappedError returns the reason that a chain with the alpha-carbon atoms
+// given has no windows without a missing atom, even though it is long
+// enough: ErrNoCaAtoms if every atom is missing, and ErrAllGapped otherwise.
+func GappedError(atoms []*structure.Coords) error {
+	for _, atom := range atoms {
+		if atom != nil {
+			return ErrAllGapped
+		}
+	}
+	return ErrNoCaAtoms
+}
+
+// ProfileCounts is the training data of a sequence fragment library of
+// frequency profiles: a frequency profile for each structure fragment and a
+// null model of amino acid composition.
+type ProfileCounts struct {
+	Freqs []*seq.FrequencyProfile
+	Null  *seq.FrequencyProfile
+}
+
+// ProfileBuilder builds a sequence fragment library of frequency profiles
+// from the windows of PDB chains, using a structure fragment library to
+// assign each window to a fragment. The null model is built from the amino
+// acid composition of every chain added.
+//
+// A ProfileBuilder is safe for concurrent use.
+type ProfileBuilder struct {
+	lib      fragbag.StructureLibrary
+	counts   ProfileCounts
+	locks    []sync.Mutex
+	nullLock sync.Mutex
+}
+
+// NewProfileBuilder returns a builder with an empty frequency profile for
+// each fragment in the structure fragment library given.
+func NewProfileBuilder(lib fragbag.StructureLibrary) *ProfileBuilder {
+	pb := &ProfileBuilder{
+		lib:   lib,
+		locks: make([]sync.Mutex, lib.Size()),
+	}
+	pb.counts.Null = seq.NewNullProfile()
+	for i := 0; i < lib.Size(); i++ {
+		fp := seq.NewFrequencyProfile(lib.FragmentSize())
+		pb.counts.Freqs = append(pb.counts.Freqs, fp)
+	}
+	return pb
+}
+
+// AddChain adds every window of the chain given to the profile of its best
+// fragment, and the whole chain to the null model. The errors returned are
+// the same as ChainWindows.
+func (pb *ProfileBuilder) AddChain(chain *pdb.Chain) error {
+	sequence := chain.AsSequence()
+	if sequence.Len() < pb.lib.FragmentSize() {
+		return ErrTooShort
+	}
+
+	pb.nullLock.Lock()
+	for i := 0; i < sequence.Len(); i++ {
+		pb.counts.Null.Add(sequence.Slice(i, i+1))
+	}
+	pb.nullLock.Unlock()
+
+	return ChainWindows(pb.lib, chain, func(frag int, s seq.Sequence) {
+		pb.locks[frag].Lock()
+		pb.counts.Freqs[frag].Add(s)
+		pb.locks[frag].Unlock()
+	})
+}
+
+// Counts returns the training data added so far. It must not be called
+// while chains are being added, and the counts returned must not be
+// modified while the builder is in use.
+func (pb *ProfileBuilder) Counts() *ProfileCounts {
+	return &pb.counts
+}
+
+// Restore replaces the training data of the builder with counts returned by
+// Counts (e.g., saved by an earlier run).
+func (pb *ProfileBuilder) Restore(counts *ProfileCounts) error {
+	if len(counts.Freqs) != pb.lib.Size() || counts.Null == nil {
+		return fmt.Errorf("The profile counts have %d fragments, but the "+
+			"library '%s' has %d.", len(counts.Freqs), pb.lib.Name(),
+			pb.lib.Size())
+	}
+	pb.counts = *counts
+	return nil
+}
+
+// Library returns the sequence fragment library of the profiles, in terms of
+// negative log-odds scores against the null model. It has the same name,
+// number of fragments and fragment size as the structure fragment library.
+func (pb *ProfileBuilder) Library() (fragbag.Library, error) {
+	profs := make([]*seq.Profile, len(pb.counts.Freqs))
+	for i, fp := range pb.counts.Freqs {
+		profs[i] = fp.Profile(pb.counts.Null)
+	}
+	return fragbag.NewSequenceProfile(pb.lib.Name(), profs)
+}
+
+// MSABuilder builds the multiple sequence alignment of every fragment of a
+// structure fragment library from the windows of PDB chains, for a sequence
+// fragment library of profile HMMs.
+//
+// An MSABuilder is safe for concurrent use.
+type MSABuilder struct {
+	lib   fragbag.StructureLibrary
+	msas  []seq.MSA
+	locks []sync.Mutex
+}
+
+// NewMSABuilder returns a builder with an empty MSA for each fragment in the
+// structure fragment library given.
+func NewMSABuilder(lib fragbag.StructureLibrary) *MSABuilder {
+	mb := &MSABuilder{
+		lib:   lib,
+		msas:  make([]seq.MSA, lib.Size()),
+		locks: make([]sync.Mutex, lib.Size()),
+	}
+	for i := range mb.msas {
+		mb.msas[i] = seq.NewMSA()
+		mb.msas[i].SetLen(lib.FragmentSize())
+	}
+	return mb
+}
+
+// AddChain adds every window of the chain given to the MSA of its best
+// fragment. The errors returned are the same as ChainWindows.
+func (mb *MSABuilder) AddChain(chain *pdb.Chain) error {
+	return ChainWindows(mb.lib, chain, func(frag int, s seq.Sequence) {
+		// We don't use Add or AddFasta since both are
+		// O(#sequences * #frag-length), which gets to be quite slow
+		// in the presence of a lot of sequences.
+		//
+		// The key here is that we know that every sequence has the same
+		// length and is in the same format, so we can add entries in a
+		// straight forward manner.
+		mb.locks[frag].Lock()
+		mb.msas[frag].Entries = append(mb.msas[frag].Entries, s)
+		mb.locks[frag].Unlock()
+	})
+}
+
+// Entries returns the sequences of the MSA of each fragment added so far. It
+// must not be called while chains are being added.
+func (mb *MSABuilder) Entries() [][]seq.Sequence {
+	entries := make([][]seq.Sequence, len(mb.msas))
+	for i := range mb.msas {
+		entries[i] = mb.msas[i].Entries
+	}
+	return entries
+}
+
+// Restore replaces the sequences of every MSA with sequences returned by
+// Entries (e.g., saved by an earlier run).
+func (mb *MSABuilder) Restore(entries [][]seq.Sequence) error {
+	if len(entries) != len(mb.msas) {
+		return fmt.Errorf("There are MSAs for %d fragments, but the "+
+			"library '%s' has %d.", len(entries), mb.lib.Name(),
+			len(mb.msas))
+	}
+	for i := range mb.msas {
+		mb.msas[i].Entries = entries[i]
+	}
+	return nil
+}
+
+// Library builds a profile HMM from each fragment's MSA and returns them as
+// a sequence fragment library (see SequenceHMM).
+func (mb *MSABuilder) Library(ctx context.Context) (fragbag.Library, error) {
+	return SequenceHMM(ctx, mb.lib.Name(), mb.msas)
+}
+
+// SequenceHMM builds a profile HMM from each MSA given with hhsuite's
+// 'hhmake' command (with pseudocount correction), and returns them as a
+// sequence fragment library with the name given. The HMMs are built in
+// parallel.
+func SequenceHMM(
+	ctx context.Context,
+	name string,
+	msas []seq.MSA,
+) (fragbag.Library, error) {
+	// Stores intermediate files produced by hhmake.
+	tempDir, err := ioutil.TempDir("", "mk-seqlib-hmm")
+	if err != nil {
+		return nil, fmt.Errorf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	hmms := make([]*seq.HMM, len(msas))
+	hhmake := func(i int) error {
+		fname := path.Join(tempDir, fmt.Sprintf("%d.fasta", i))
+		f, err := os.Create(fname)
+		if err != nil {
+			return err
+		}
+		err = msa.WriteFasta(f, msas[i])
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+
+		hhm, err := hhsuite.HHMakePseudo.Run(fname)
+		if err != nil {
+			return err
+		}
+		hmms[i] = hhm.HMM
+		return nil
+	}
+
+	jobs := make(chan int)
+	errs := make(chan error, len(msas))
+	wg := new(sync.WaitGroup)
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := hhmake(i); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+feed:
+	for i := range msas {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+	return fragbag.NewSequenceHMM(name, hmms)
+}
@@ -0,0 +1,51 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/TuftsBCB/io/pdb"
+	"github.com/TuftsBCB/structure"
+	"github.com/ndaniels/esfragbag"
+)
+
+// StructureLibrary returns a structure fragment library with the name given
+// from the contents of a brk file produced by Rachel Kolodny's fragment
+// library software. Each fragment is a set of PDB ATOM records terminated by
+// a TER record.
+func StructureLibrary(
+	name string,
+	brk []byte,
+) (fragbag.StructureLibrary, error) {
+	var fragments [][]structure.Coords
+	for i, pdbFrag := range bytes.Split(brk, []byte("TER")) {
+		pdbFrag = bytes.TrimSpace(pdbFrag)
+		if len(pdbFrag) == 0 {
+			continue
+		}
+		atoms, err := fragmentAtoms(i, pdbFrag)
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, atoms)
+	}
+	return fragbag.NewStructureAtoms(name, fragments)
+}
+
+// fragmentAtoms returns the alpha-carbon atoms of the ATOM records of a
+// single fragment.
+func fragmentAtoms(num int, atomRecords []byte) ([]structure.Coords, error) {
+	r := bytes.NewReader(atomRecords)
+	name := fmt.Sprintf("fragment %d", num)
+
+	entry, err := pdb.Read(r, name)
+	if err != nil {
+		return nil, fmt.Errorf("Fragment %d could not be read in PDB "+
+			"format: %s", num, err)
+	}
+	atoms := entry.OneChain().CaAtoms()
+	if len(atoms) == 0 {
+		return nil, fmt.Errorf("Fragment %d has no ATOM coordinates.", num)
+	}
+	return atoms, nil
+}
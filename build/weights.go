@@ -0,0 +1,94 @@
+package build
+
+import (
+	"context"
+	"math"
+
+	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/esfragbag/bow"
+)
+
+// DocFreqs counts the number of BOWs (documents) that each fragment of a
+// library occurs in, for computing the inverse document frequency (IDF) of
+// each fragment. The counts include a pseudocount.
+type DocFreqs struct {
+	Counts []float32
+	Total  float32
+}
+
+// NewDocFreqs returns the document frequencies of a library with the number
+// of fragments given, before any BOWs are added.
+func NewDocFreqs(size int) *DocFreqs {
+	df := &DocFreqs{
+		Counts: make([]float32, size),
+		Total:  1, // for pseudocount correction
+	}
+	for i := range df.Counts {
+		df.Counts[i] = 1 // pseudocount
+	}
+	return df
+}
+
+// Add counts the fragments that occur in the BOW given.
+func (df *DocFreqs) Add(b bow.Bow) {
+	df.Total += 1
+	for fragi := range df.Counts {
+		if b.Freqs[fragi] > 0 {
+			df.Counts[fragi]++
+		}
+	}
+}
+
+// IDFs returns the inverse document frequency of each fragment.
+func (df *DocFreqs) IDFs() []float32 {
+	idfs := make([]float32, len(df.Counts))
+	for i := range idfs {
+		idfs[i] = float32(math.Log(float64(df.Total / df.Counts[i])))
+	}
+	return idfs
+}
+
+// Weighted wraps the library given as a weighted library with the tf-idf
+// weights of the document frequencies. The library must have the same number
+// of fragments as the BOWs counted.
+func (df *DocFreqs) Weighted(lib fragbag.Library) (fragbag.WeightedLibrary, error) {
+	return fragbag.NewWeightedTfIdf(lib, df.IDFs())
+}
+
+// Docs are BOWs (documents) of the space being searched, such as those of
+// one bower file, to count with TfIdf. Counted, if not nil, is called once
+// the BOWs have been added to the document frequencies, e.g., to save a
+// checkpoint.
+type Docs struct {
+	Bows    []bow.Bow
+	Counted func()
+}
+
+// TfIdf adds the BOWs received to the document frequencies given and returns
+// the library given weighted by their tf-idf weights. BOWs are read until the
+// channel is closed or the context is cancelled, in which case the context's
+// error is returned. The library must have the same number of fragments as
+// the document frequencies.
+func TfIdf(
+	ctx context.Context,
+	lib fragbag.Library,
+	df *DocFreqs,
+	docs <-chan Docs,
+) (fragbag.WeightedLibrary, error) {
+	for {
+		select {
+		case d, ok := <-docs:
+			if !ok {
+				return df.Weighted(lib)
+			}
+			for _, b := range d.Bows {
+				df.Add(b)
+			}
+			if d.Counted != nil {
+				d.Counted()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ndaniels/tools/util"
+)
+
+var (
+	flagCheckpoint         = ""
+	flagCheckpointInterval = 5 * time.Minute
+	flagResume             = false
+)
+
+const checkpointHelp = `
+Since this command may run for hours on large inputs, its progress can be
+saved in a checkpoint directory given with '-checkpoint'. The bower file
+arguments that have been processed are saved along with the results so far,
+at least every '-checkpoint-interval', and when the command is interrupted
+or reaches its '-timeout'. Running it again with the same arguments and flags
+and '-resume' continues from the last save, skipping the bower file arguments
+already processed. A checkpoint can't be resumed with different arguments or
+flags, except for flags that don't change the results (like '-cpu'). Bower
+file arguments that could not be read are tried again when resuming. The
+output file may be overwritten when resuming. The checkpoint is removed once
+the command finishes.
+`
+
+// The files in a checkpoint directory. The information about the command is
+// used to check that a checkpoint is resumed by the same command. Commands
+// either save snapshots of their state or log the results of each bower file
+// argument as it is processed.
+const (
+	checkpointInfoFile  = "checkpoint.json"
+	checkpointStateFile = "state.gob"
+	checkpointLogFile   = "inputs.log"
+)
+
+func (c *command) setCheckpointFlags() {
+	c.flags.StringVar(&flagCheckpoint, "checkpoint", flagCheckpoint,
+		"When set, progress is saved periodically in the directory given,\n"+
+			"so that an interrupted run can be continued with '-resume'.")
+	c.flags.DurationVar(&flagCheckpointInterval, "checkpoint-interval",
+		flagCheckpointInterval,
+		"The most time between saves of the checkpoint.")
+	c.flags.BoolVar(&flagResume, "resume", flagResume,
+		"When set, the run saved in the '-checkpoint' directory is\n"+
+			"continued. Bower file arguments already processed are skipped.")
+}
+
+// checkpointInfo identifies the command that a checkpoint belongs to.
+type checkpointInfo struct {
+	Command string
+	Args    []string
+	Flags   map[string]string
+	Inputs  []string
+	Created time.Time
+}
+
+// checkpointIgnoredFlags are the flags that don't change the results of a
+// command, so they may differ when resuming. (The bower files given with
+// '-list' and '-domains' are compared as inputs instead.)
+var checkpointIgnoredFlags = map[string]bool{
+	"checkpoint": true, "checkpoint-interval": true, "resume": true,
+	"overwrite": true, "cpu": true, "cpu-prof": true, "quiet": true,
+	"timeout": true, "errors": true, "list": true, "domains": true,
+}
+
+// checkpoint saves the progress of a command in a directory. A nil
+// checkpoint is valid and saves nothing, so that commands don't need to
+// check whether '-checkpoint' was given.
+type checkpoint struct {
+	dir      string
+	interval time.Duration
+
+	lock     sync.Mutex
+	done     map[string]bool
+	doneList []string
+	lastSave time.Time
+
+	// The log of results, for commands that log the results of each bower
+	// file argument rather than saving snapshots.
+	log    *os.File
+	logBuf *bufio.Writer
+}
+
+// checkpoint returns the checkpoint for the command given by the
+// '-checkpoint' and '-resume' flags, or nil if there is none. The positional
+// arguments before the one given (e.g., fragment libraries and the output
+// path), the values of the flags and the bower file arguments given must be
+// the same when resuming.
+//
+// When not resuming, an existing checkpoint in the directory is only
+// replaced if '-overwrite' is set.
+func (c *command) checkpoint(first int, specs []bowerSpec) *checkpoint {
+	if len(flagCheckpoint) == 0 {
+		if flagResume {
+			util.Fatalf("The '-resume' flag requires '-checkpoint'.")
+		}
+		return nil
+	}
+	if flagCheckpointInterval <= 0 {
+		util.Fatalf("The checkpoint interval must be positive.")
+	}
+	cp := &checkpoint{
+		dir:      flagCheckpoint,
+		interval: flagCheckpointInterval,
+		done:     make(map[string]bool),
+		lastSave: time.Now(),
+	}
+	info := checkpointInfo{
+		Command: c.name,
+		Args:    c.flags.Args()[:first],
+		Flags:   make(map[string]string),
+		Created: time.Now().UTC(),
+	}
+	c.flags.VisitAll(func(fl *flag.Flag) {
+		if !checkpointIgnoredFlags[fl.Name] {
+			info.Flags[fl.Name] = fl.Value.String()
+		}
+	})
+	for _, spec := range specs {
+		info.Inputs = append(info.Inputs, spec.key())
+	}
+	infoPath := path.Join(cp.dir, checkpointInfoFile)
+
+	if flagResume {
+		data, err := ioutil.ReadFile(infoPath)
+		util.Assert(err, "Could not read checkpoint in '%s'", cp.dir)
+		var saved checkpointInfo
+		util.Assert(json.Unmarshal(data, &saved),
+			"Could not decode checkpoint in '%s'", cp.dir)
+		if saved.Command != info.Command ||
+			strings.Join(saved.Args, "\x00") != strings.Join(info.Args, "\x00") {
+			util.Fatalf("The checkpoint in '%s' was saved by 'flib %s %s', "+
+				"which differs from 'flib %s %s'.", cp.dir,
+				saved.Command, strings.Join(saved.Args, " "),
+				info.Command, strings.Join(info.Args, " "))
+		}
+		saved.checkFlags(cp.dir, info.Flags)
+		saved.checkInputs(cp.dir, info.Inputs)
+		return cp
+	}
+
+	if _, err := os.Stat(infoPath); err == nil && !flagOverwrite {
+		util.Fatalf("'%s' already has a checkpoint. Use '-resume' to "+
+			"continue it or '-overwrite' to start over.", cp.dir)
+	}
+	util.Assert(os.MkdirAll(cp.dir, 0777),
+		"Could not create checkpoint directory '%s'", cp.dir)
+	cp.remove()
+	data, err := json.MarshalIndent(info, "", "\t")
+	util.Assert(err)
+	util.Assert(writeFileAtomic(infoPath, data),
+		"Could not write checkpoint in '%s'", cp.dir)
+	return cp
+}
+
+// checkFlags exits if the flags given differ from the flags that the
+// checkpoint was saved with.
+func (saved *checkpointInfo) checkFlags(dir string, flags map[string]string) {
+	var names []string
+	for name := range flags {
+		names = append(names, name)
+	}
+	for name := range saved.Flags {
+		if _, ok := flags[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := flags[name]
+		savedValue, savedOk := saved.Flags[name]
+		switch {
+		case !ok || !savedOk:
+			util.Fatalf("The checkpoint in '%s' was saved by a version of "+
+				"flib with different flags (e.g., '-%s').", dir, name)
+		case value != savedValue:
+			util.Fatalf("The checkpoint in '%s' was saved with '-%s %s', "+
+				"but it is '%s' now.", dir, name, savedValue, value)
+		}
+	}
+}
+
+// checkInputs exits if the bower file arguments given (by their keys) differ
+// from the ones that the checkpoint was saved with.
+func (saved *checkpointInfo) checkInputs(dir string, inputs []string) {
+	for i := range inputs {
+		if i >= len(saved.Inputs) || saved.Inputs[i] != inputs[i] {
+			util.Fatalf("The checkpoint in '%s' was saved with different "+
+				"bower file arguments: argument %d is '%s' now.",
+				dir, i+1, inputs[i])
+		}
+	}
+	if len(saved.Inputs) > len(inputs) {
+		util.Fatalf("The checkpoint in '%s' was saved with %d bower file "+
+			"arguments, but %d are given now.",
+			dir, len(saved.Inputs), len(inputs))
+	}
+}
+
+// key identifies a bower file argument in a checkpoint.
+func (spec bowerSpec) key() string {
+	if len(spec.id) == 0 {
+		return spec.String()
+	}
+	return spec.String() + "\t" + spec.id
+}
+
+// remaining returns the bower file arguments given that haven't been
+// processed yet.
+func (cp *checkpoint) remaining(specs []bowerSpec) []bowerSpec {
+	if cp == nil {
+		return specs
+	}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	var left []bowerSpec
+	for _, spec := range specs {
+		if !cp.done[spec.key()] {
+			left = append(left, spec)
+		}
+	}
+	if len(left) < len(specs) {
+		util.Verbosef("Resuming with %d of %d bower file arguments already "+
+			"processed.", len(specs)-len(left), len(specs))
+	}
+	return left
+}
+
+// inputDone records that the bower file argument given has been processed
+// and that its results are in the state of the command. It returns true if
+// the state should be saved now, in which case the caller must save it with
+// save.
+func (cp *checkpoint) inputDone(spec bowerSpec) bool {
+	if cp == nil {
+		return false
+	}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	cp.markDone(spec.key())
+	if time.Since(cp.lastSave) < cp.interval {
+		return false
+	}
+	cp.lastSave = time.Now()
+	return true
+}
+
+func (cp *checkpoint) markDone(key string) {
+	if !cp.done[key] {
+		cp.done[key] = true
+		cp.doneList = append(cp.doneList, key)
+	}
+}
+
+// save saves a snapshot of the state given along with the bower file
+// arguments processed so far. The state must be encodable with gob and must
+// include the results of every bower file argument recorded with inputDone.
+func (cp *checkpoint) save(state interface{}) {
+	if cp == nil {
+		return
+	}
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	util.Assert(enc.Encode(cp.doneList), "Could not encode checkpoint")
+	util.Assert(enc.Encode(state), "Could not encode checkpoint")
+	util.Assert(writeFileAtomic(path.Join(cp.dir, checkpointStateFile),
+		buf.Bytes()), "Could not write checkpoint in '%s'", cp.dir)
+	cp.lastSave = time.Now()
+	util.Verbosef("Saved checkpoint with %d bower file arguments processed.",
+		len(cp.doneList))
+}
+
+// load reads the last snapshot saved into the state given, which must be
+// the same type given to save. If there is no snapshot (e.g., the command
+// was interrupted before its first save), then false is returned and the
+// state is left alone.
+func (cp *checkpoint) load(state interface{}) bool {
+	if cp == nil || !flagResume {
+		return false
+	}
+	f, err := os.Open(path.Join(cp.dir, checkpointStateFile))
+	if os.IsNotExist(err) {
+		return false
+	}
+	util.Assert(err, "Could not read checkpoint in '%s'", cp.dir)
+	defer f.Close()
+
+	var done []string
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	util.Assert(dec.Decode(&done), "Could not decode checkpoint in '%s'", cp.dir)
+	util.Assert(dec.Decode(state), "Could not decode checkpoint in '%s'", cp.dir)
+
+	cp.lock.Lock()
+	for _, key := range done {
+		cp.markDone(key)
+	}
+	cp.lock.Unlock()
+	return true
+}
+
+// checkpointRecord is a line of the log of a checkpoint: the results of a
+// single bower file argument.
+type checkpointRecord struct {
+	Input   string
+	Results json.RawMessage
+}
+
+// replay calls f with the results of every bower file argument in the log,
+// in the order they were recorded, and opens the log for new records. A
+// record cut short by an interruption is discarded.
+func (cp *checkpoint) replay(f func(results []byte) error) {
+	if cp == nil {
+		return
+	}
+	logPath := path.Join(cp.dir, checkpointLogFile)
+	logFile, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0666)
+	util.Assert(err, "Could not open checkpoint log '%s'", logPath)
+
+	var good int64
+	if flagResume {
+		r := bufio.NewReader(logFile)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF {
+				break
+			}
+			util.Assert(err, "Could not read checkpoint log '%s'", logPath)
+
+			var rec checkpointRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				break
+			}
+			util.Assert(f(rec.Results),
+				"Could not decode checkpoint log '%s'", logPath)
+			cp.markDone(rec.Input)
+			good += int64(len(line))
+		}
+	}
+	util.Assert(logFile.Truncate(good), "Could not truncate '%s'", logPath)
+	_, err = logFile.Seek(good, os.SEEK_SET)
+	util.Assert(err)
+
+	cp.log = logFile
+	cp.logBuf = bufio.NewWriter(logFile)
+}
+
+// record adds the results of the bower file argument given to the log. The
+// results must be encodable as JSON. The log is written to disk at least
+// every checkpoint interval.
+func (cp *checkpoint) record(spec bowerSpec, results interface{}) {
+	if cp == nil {
+		return
+	}
+	data, err := json.Marshal(results)
+	util.Assert(err, "Could not encode checkpoint")
+	line, err := json.Marshal(checkpointRecord{spec.key(), data})
+	util.Assert(err, "Could not encode checkpoint")
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	_, err = cp.logBuf.Write(append(line, '\n'))
+	util.Assert(err, "Could not write checkpoint log in '%s'", cp.dir)
+	cp.markDone(spec.key())
+	if time.Since(cp.lastSave) >= cp.interval {
+		cp.syncLog()
+	}
+}
+
+func (cp *checkpoint) syncLog() {
+	util.Assert(cp.logBuf.Flush(), "Could not write checkpoint log in '%s'",
+		cp.dir)
+	util.Assert(cp.log.Sync(), "Could not write checkpoint log in '%s'", cp.dir)
+	cp.lastSave = time.Now()
+}
+
+// interrupt saves the progress of a command that was cancelled. For commands
+// that save snapshots, the state given is saved; otherwise, the log is
+// written to disk and the state should be nil.
+func (cp *checkpoint) interrupt(state interface{}) {
+	if cp == nil {
+		return
+	}
+	if state != nil {
+		cp.save(state)
+	}
+	if cp.log != nil {
+		cp.lock.Lock()
+		cp.syncLog()
+		cp.lock.Unlock()
+		cp.log.Close()
+	}
+	log.Printf("Progress was saved in '%s'. Use '-resume' to continue.",
+		cp.dir)
+}
+
+// finish removes the checkpoint. It should be called once the output of the
+// command has been written.
+func (cp *checkpoint) finish() {
+	if cp == nil {
+		return
+	}
+	if cp.log != nil {
+		cp.log.Close()
+	}
+	cp.remove()
+}
+
+// remove deletes the files of the checkpoint, but not its directory or any
+// other files in it.
+func (cp *checkpoint) remove() {
+	for _, name := range []string{
+		checkpointInfoFile, checkpointStateFile, checkpointLogFile,
+	} {
+		err := os.Remove(path.Join(cp.dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			util.Assert(err, "Could not remove checkpoint in '%s'", cp.dir)
+		}
+	}
+}
+
+// writeFileAtomic writes the data given to a temporary file and renames it
+// to the path given, so that an interruption never leaves a partial file.
+func writeFileAtomic(fpath string, data []byte) error {
+	tmp := fmt.Sprintf("%s.tmp", fpath)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fpath)
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"unsafe"
+
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/flib/query"
+)
+
+// The BOWs of a database can be converted to a columnar file (see the
+// bowdb-columns command) that is stored next to the database with a '.cols'
+// extension. The search command maps the file into memory instead of
+// decoding every entry of the database, so it starts almost immediately and
+// concurrent searches share the same pages.
+//
+// All values are little-endian and every section starts at a multiple of 8
+// bytes. The file starts with a header of colHeaderSize bytes:
+//
+//	magic     [8]byte   "FLIBCOL1"
+//	flags     uint32    colSparse when the BOWs are stored as CSR
+//	dim       uint32    the size of the fragment library
+//	n         uint64    the number of BOWs
+//	nnz       uint64    the number of non-zero values (sparse only)
+//	dbSize    int64     size of 'bow.db' in the database when converted
+//	dbModTime int64     modification time of 'bow.db' (Unix nanoseconds)
+//	idOffs    uint64    offset of uint64[n+1] offsets into the id bytes
+//	idBytes   uint64    offset of the concatenated ids
+//	norms     uint64    offset of float32[n] Euclidean norms
+//	rows      uint64    offset of uint64[n+1] row pointers (sparse only)
+//	cols      uint64    offset of uint32[nnz] column indices (sparse only)
+//	vals      uint64    offset of float32[n*dim] (dense) or float32[nnz]
+//
+// A dense file is a contiguous row-major matrix of frequencies. A sparse file
+// only stores non-zero frequencies, which is smaller when most fragments do
+// not occur in a BOW.
+
+const (
+	colExt        = ".cols"
+	colMagic      = "FLIBCOL1"
+	colHeaderSize = 96
+	colSparse     = 1 << 0
+)
+
+type colHeader struct {
+	Magic     [8]byte
+	Flags     uint32
+	Dim       uint32
+	N         uint64
+	NNZ       uint64
+	DbSize    int64
+	DbModTime int64
+	IdOffs    uint64
+	IdBytes   uint64
+	Norms     uint64
+	Rows      uint64
+	Cols      uint64
+	Vals      uint64
+}
+
+// colPath returns the path of the columnar file for the BOW database given.
+func colPath(dbPath string) string {
+	return dbPath + colExt
+}
+
+// colAlign rounds an offset up to the next multiple of 8.
+func colAlign(off uint64) uint64 {
+	return (off + 7) &^ 7
+}
+
+// colLayout fills in the section offsets of the header and returns the size
+// of the file.
+func colLayout(hdr *colHeader, idLen uint64) uint64 {
+	off := uint64(colHeaderSize)
+	section := func(size uint64) uint64 {
+		start := colAlign(off)
+		off = start + size
+		return start
+	}
+	hdr.IdOffs = section(8 * (hdr.N + 1))
+	hdr.IdBytes = section(idLen)
+	hdr.Norms = section(4 * hdr.N)
+	if hdr.Flags&colSparse != 0 {
+		hdr.Rows = section(8 * (hdr.N + 1))
+		hdr.Cols = section(4 * hdr.NNZ)
+		hdr.Vals = section(4 * hdr.NNZ)
+	} else {
+		hdr.Vals = section(4 * hdr.N * uint64(hdr.Dim))
+	}
+	return off
+}
+
+// writeColumns writes the BOWs given to a columnar file at the path given.
+// The tar header of 'bow.db' is used to detect when the database changes
+// after the conversion.
+func writeColumns(
+	fpath string,
+	dbPath string,
+	dim int,
+	entries []bow.Bowed,
+	sparse bool,
+) error {
+	dbHdr, err := statBowDbFile(dbPath, "bow.db")
+	if err != nil {
+		return err
+	}
+	if dbHdr == nil {
+		return fmt.Errorf("'%s' is not a BOW database", dbPath)
+	}
+
+	hdr := &colHeader{
+		Dim:       uint32(dim),
+		N:         uint64(len(entries)),
+		DbSize:    dbHdr.Size,
+		DbModTime: dbHdr.ModTime.UnixNano(),
+	}
+	copy(hdr.Magic[:], colMagic)
+	idLen := uint64(0)
+	for _, e := range entries {
+		if len(e.Bow.Freqs) != dim {
+			return fmt.Errorf("BOW '%s' has %d fragments, but the library "+
+				"has %d.", e.Id, len(e.Bow.Freqs), dim)
+		}
+		idLen += uint64(len(e.Id))
+		if sparse {
+			for _, f := range e.Bow.Freqs {
+				if f != 0 {
+					hdr.NNZ++
+				}
+			}
+		}
+	}
+	if sparse {
+		hdr.Flags |= colSparse
+	}
+	colLayout(hdr, idLen)
+
+	f, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	cw := &colWriter{w: bufio.NewWriter(f)}
+	cw.write(hdr)
+
+	cw.seek(hdr.IdOffs)
+	idOff := uint64(0)
+	cw.write(idOff)
+	for _, e := range entries {
+		idOff += uint64(len(e.Id))
+		cw.write(idOff)
+	}
+	cw.seek(hdr.IdBytes)
+	for _, e := range entries {
+		cw.write([]byte(e.Id))
+	}
+	cw.seek(hdr.Norms)
+	for _, e := range entries {
+		cw.write(query.Norm(e.Bow.Freqs))
+	}
+	if sparse {
+		cw.seek(hdr.Rows)
+		row := uint64(0)
+		cw.write(row)
+		for _, e := range entries {
+			for _, f := range e.Bow.Freqs {
+				if f != 0 {
+					row++
+				}
+			}
+			cw.write(row)
+		}
+		cw.seek(hdr.Cols)
+		for _, e := range entries {
+			for j, f := range e.Bow.Freqs {
+				if f != 0 {
+					cw.write(uint32(j))
+				}
+			}
+		}
+		cw.seek(hdr.Vals)
+		for _, e := range entries {
+			for _, f := range e.Bow.Freqs {
+				if f != 0 {
+					cw.write(f)
+				}
+			}
+		}
+	} else {
+		cw.seek(hdr.Vals)
+		for _, e := range entries {
+			cw.write(e.Bow.Freqs)
+		}
+	}
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	if err := f.Close(); cw.err == nil {
+		cw.err = err
+	}
+	if cw.err != nil {
+		os.Remove(fpath)
+	}
+	return cw.err
+}
+
+// colWriter writes little-endian values sequentially and remembers the first
+// error.
+type colWriter struct {
+	w   *bufio.Writer
+	off uint64
+	err error
+}
+
+func (cw *colWriter) write(v interface{}) {
+	if cw.err != nil {
+		return
+	}
+	cw.err = binary.Write(cw.w, binary.LittleEndian, v)
+	cw.off += uint64(binary.Size(v))
+}
+
+// seek pads the output with zeros up to the offset given.
+func (cw *colWriter) seek(off uint64) {
+	if cw.err != nil {
+		return
+	}
+	if off < cw.off {
+		cw.err = fmt.Errorf("BUG: seek backwards from %d to %d", cw.off, off)
+		return
+	}
+	_, cw.err = cw.w.Write(make([]byte, off-cw.off))
+	cw.off = off
+}
+
+// colStore is a query.Store backed by a columnar file mapped into memory.
+type colStore struct {
+	data []byte
+	hdr  colHeader
+
+	idOffs []uint64
+	norms  []float32
+	rows   []uint64
+	cols   []uint32
+	vals   []float32
+}
+
+// openColumns maps the columnar file at the path given into memory. If the
+// file does not exist, nil is returned with no error.
+func openColumns(fpath string) (*colStore, error) {
+	f, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < colHeaderSize {
+		return nil, fmt.Errorf("'%s' is not a columnar BOW file", fpath)
+	}
+	data, err := mmapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("Could not map '%s': %s", fpath, err)
+	}
+	cs, err := newColStore(data)
+	if err != nil {
+		munmapFile(data)
+		return nil, fmt.Errorf("Could not read '%s': %s", fpath, err)
+	}
+	return cs, nil
+}
+
+func newColStore(data []byte) (*colStore, error) {
+	cs := &colStore{data: data}
+	hdr := &cs.hdr
+	r := bytes.NewReader(data[:colHeaderSize])
+	if err := binary.Read(r, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr.Magic[:]) != colMagic {
+		return nil, fmt.Errorf("not a columnar BOW file")
+	}
+
+	// The counts must fit in the file before the layout is computed from
+	// them, since a corrupt count could overflow the size of a section.
+	size := uint64(len(data))
+	if hdr.N >= size/8 || hdr.NNZ > size/4 ||
+		(hdr.Dim > 0 && hdr.N > size/4/uint64(hdr.Dim)) {
+		return nil, fmt.Errorf("corrupt header")
+	}
+
+	// Recompute the layout to validate the offsets in the header before
+	// slicing the data.
+	want := *hdr
+	idOffs, err := colUint64s(data, hdr.IdOffs, hdr.N+1)
+	if err != nil {
+		return nil, err
+	}
+	if idOffs[hdr.N] > size {
+		return nil, fmt.Errorf("corrupt id table")
+	}
+	end := colLayout(&want, idOffs[hdr.N])
+	if want != *hdr || end > size {
+		return nil, fmt.Errorf("corrupt header")
+	}
+
+	cs.idOffs = idOffs
+	if cs.norms, err = colFloat32s(data, hdr.Norms, hdr.N); err != nil {
+		return nil, err
+	}
+	if hdr.Flags&colSparse != 0 {
+		if cs.rows, err = colUint64s(data, hdr.Rows, hdr.N+1); err != nil {
+			return nil, err
+		}
+		if cs.cols, err = colUint32s(data, hdr.Cols, hdr.NNZ); err != nil {
+			return nil, err
+		}
+		if cs.vals, err = colFloat32s(data, hdr.Vals, hdr.NNZ); err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < hdr.N; i++ {
+			if cs.rows[i] > cs.rows[i+1] || cs.rows[i+1] > hdr.NNZ {
+				return nil, fmt.Errorf("corrupt row pointers")
+			}
+		}
+		for _, j := range cs.cols {
+			if j >= hdr.Dim {
+				return nil, fmt.Errorf("corrupt column indices")
+			}
+		}
+	} else {
+		cs.vals, err = colFloat32s(data, hdr.Vals, hdr.N*uint64(hdr.Dim))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := uint64(0); i < hdr.N; i++ {
+		if idOffs[i] > idOffs[i+1] {
+			return nil, fmt.Errorf("corrupt id table")
+		}
+	}
+	return cs, nil
+}
+
+// Close unmaps the file. No BOWs returned by the store may be used after.
+func (cs *colStore) Close() error {
+	return munmapFile(cs.data)
+}
+
+// fresh returns true if the columnar file was converted from the BOW database
+// given as it is now.
+func (cs *colStore) fresh(dbPath string) (bool, error) {
+	dbHdr, err := statBowDbFile(dbPath, "bow.db")
+	if err != nil || dbHdr == nil {
+		return false, err
+	}
+	return dbHdr.Size == cs.hdr.DbSize &&
+		dbHdr.ModTime.UnixNano() == cs.hdr.DbModTime, nil
+}
+
+func (cs *colStore) Dim() int     { return int(cs.hdr.Dim) }
+func (cs *colStore) Sparse() bool { return cs.hdr.Flags&colSparse != 0 }
+func (cs *colStore) Len() int     { return int(cs.hdr.N) }
+
+func (cs *colStore) Id(i int) string {
+	ids := cs.data[cs.hdr.IdBytes:]
+	return string(ids[cs.idOffs[i]:cs.idOffs[i+1]])
+}
+
+// Norm returns the Euclidean norm of the BOW at position i.
+func (cs *colStore) Norm(i int) float32 {
+	return cs.norms[i]
+}
+
+// Freqs returns the frequencies of the BOW at position i. For dense files,
+// this is a view into the mapped file. For sparse files, a new vector is
+// allocated.
+func (cs *colStore) Freqs(i int) []float32 {
+	dim := int(cs.hdr.Dim)
+	if !cs.Sparse() {
+		return cs.vals[i*dim : (i+1)*dim : (i+1)*dim]
+	}
+	freqs := make([]float32, dim)
+	for k := cs.rows[i]; k < cs.rows[i+1]; k++ {
+		freqs[cs.cols[k]] = cs.vals[k]
+	}
+	return freqs
+}
+
+// colUint64s, colUint32s and colFloat32s return a section of the mapped file
+// as a slice of values. On little-endian hosts, the slice refers to the
+// mapped memory directly. Otherwise, the values are decoded into a new
+// slice.
+
+func colUint64s(data []byte, off, n uint64) ([]uint64, error) {
+	b, err := colSection(data, off, n, 8)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if littleEndian {
+		return unsafe.Slice((*uint64)(unsafe.Pointer(&b[0])), n), nil
+	}
+	vs := make([]uint64, n)
+	for i := range vs {
+		vs[i] = binary.LittleEndian.Uint64(b[8*i:])
+	}
+	return vs, nil
+}
+
+func colUint32s(data []byte, off, n uint64) ([]uint32, error) {
+	b, err := colSection(data, off, n, 4)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if littleEndian {
+		return unsafe.Slice((*uint32)(unsafe.Pointer(&b[0])), n), nil
+	}
+	vs := make([]uint32, n)
+	for i := range vs {
+		vs[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return vs, nil
+}
+
+func colFloat32s(data []byte, off, n uint64) ([]float32, error) {
+	b, err := colSection(data, off, n, 4)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if littleEndian {
+		return unsafe.Slice((*float32)(unsafe.Pointer(&b[0])), n), nil
+	}
+	vs := make([]float32, n)
+	for i := range vs {
+		vs[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return vs, nil
+}
+
+// colSection returns the n values of the size given at the offset given.
+// The number of values is checked before it is multiplied by their size, so
+// that a corrupt count can't overflow.
+func colSection(data []byte, off, n, size uint64) ([]byte, error) {
+	if off%8 != 0 || off > uint64(len(data)) ||
+		n > (uint64(len(data))-off)/size {
+		return nil, fmt.Errorf("section at %d with %d values of %d bytes "+
+			"is out of bounds", off, n, size)
+	}
+	return data[off : off+n*size], nil
+}
+
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
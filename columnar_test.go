@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// TestColStoreCorruptCounts checks that a header whose counts would overflow
+// the size of a section is rejected instead of being sliced.
+func TestColStoreCorruptCounts(t *testing.T) {
+	tests := map[string]colHeader{
+		"rows":    {N: 1 << 61},
+		"nonzero": {Flags: colSparse, N: 1, NNZ: 1 << 62},
+		"dense":   {Dim: 1 << 31, N: 1 << 33},
+		"max":     {Dim: 1, N: ^uint64(0)},
+	}
+	for name, hdr := range tests {
+		copy(hdr.Magic[:], colMagic)
+		buf := new(bytes.Buffer)
+		if err := binary.Write(buf, binary.LittleEndian, &hdr); err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(make([]byte, 4096))
+		if _, err := newColStore(buf.Bytes()); err == nil {
+			t.Errorf("%s: expected an error for %+v.", name, hdr)
+		}
+	}
+}
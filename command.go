@@ -3,11 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path"
 	"runtime"
 	"strings"
 
+	"github.com/ndaniels/flib/build"
 	"github.com/ndaniels/tools/util"
 )
 
@@ -15,6 +18,10 @@ var (
 	flagCpuProfile = ""
 	flagCpu        = runtime.NumCPU()
 	flagOverwrite  = false
+	flagBowOpts    = build.DefaultOptions
+	flagModels     = false
+	flagBowerList  = ""
+	flagDomains    = ""
 )
 
 func init() {
@@ -29,6 +36,9 @@ type command struct {
 	flags           *flag.FlagSet
 	addFlags        func(*command)
 	run             func(*command)
+
+	// The source of each flag default changed by setDefaults.
+	defaultSrc map[string]string
 }
 
 func (c *command) showUsage() {
@@ -49,7 +59,9 @@ func (c *command) showHelp() {
 func (c *command) showFlags() {
 	c.flags.VisitAll(func(fl *flag.Flag) {
 		var def string
-		if len(fl.DefValue) > 0 {
+		if src, ok := c.defaultSrc[fl.Name]; ok {
+			def = fmt.Sprintf(" (default: %s, from %s)", fl.DefValue, src)
+		} else if len(fl.DefValue) > 0 {
 			def = fmt.Sprintf(" (default: %s)", fl.DefValue)
 		}
 		usage := strings.Replace(fl.Usage, "\n", "\n    ", -1)
@@ -66,6 +78,10 @@ func (c *command) setCommonFlags() {
 	c.flags.BoolVar(&util.FlagQuiet, "quiet", util.FlagQuiet,
 		"When set, progress information and other status messages will\n"+
 			"not be printed to stderr.")
+	c.flags.DurationVar(&flagTimeout, "timeout", flagTimeout,
+		"When positive, the command is stopped once it has run for the\n"+
+			"duration given (e.g., '90s' or '2h'), in the same way as when\n"+
+			"it is interrupted.")
 }
 
 func (c *command) setOverwriteFlag() {
@@ -73,6 +89,107 @@ func (c *command) setOverwriteFlag() {
 		"When set, the output file will be overwritten if it already exists.")
 }
 
+func (c *command) setModelsFlag() {
+	c.flags.BoolVar(&flagModels, "models", flagModels,
+		"When set, the models for each bower file given (if a PDB file)\n"+
+			"will be used. Otherwise, the first the model from each\n"+
+			"chain specified will be used. A single model may be selected\n"+
+			"for a bower file with 'file@model=N'.")
+}
+
+func (c *command) setBowerListFlag() {
+	c.flags.StringVar(&flagBowerList, "list", flagBowerList,
+		"When set, bower file arguments are read from the file given, one\n"+
+			"per line, with an optional identifier in a second column.")
+}
+
+func (c *command) setDomainsFlag() {
+	c.flags.StringVar(&flagDomains, "domains", flagDomains,
+		"When set, a BOW is computed for every domain in the domain\n"+
+			"boundary file given. Each line has the tab-separated domain\n"+
+			"identifier, PDB file, chain and residue ranges (e.g.,\n"+
+			"'d1abca1\\t1abc.pdb\\tA\\t10-50,80-150').")
+}
+
+// bowerSpecs returns the bower file arguments starting at the positional
+// argument given, along with those read from the '-list' file and the
+// domains in the '-domains' file. An argument of '-' reads a list of bower
+// file arguments from stdin. If required is true and there are no bower
+// files, the usage is shown.
+func (c *command) bowerSpecs(first int, required bool) []bowerSpec {
+	var specs []bowerSpec
+	addList := func(r io.Reader, name string) {
+		list, err := readBowerList(r)
+		util.Assert(err, "Could not read bower file list '%s'", name)
+		specs = append(specs, list...)
+	}
+	if len(flagBowerList) > 0 {
+		f := util.OpenFile(flagBowerList)
+		addList(f, flagBowerList)
+		f.Close()
+	}
+	if len(flagDomains) > 0 {
+		f := util.OpenFile(flagDomains)
+		domains, err := readDomains(f, path.Dir(flagDomains))
+		util.Assert(err, "Could not read domains file '%s'", flagDomains)
+		specs = append(specs, domains...)
+		f.Close()
+	}
+	readStdin := false
+	for _, arg := range c.flags.Args()[first:] {
+		if arg == "-" {
+			if !readStdin {
+				addList(os.Stdin, "stdin")
+				readStdin = true
+			}
+			continue
+		}
+		spec, err := parseBowerSpec(arg)
+		util.Assert(err)
+		specs = append(specs, spec)
+	}
+	if required && len(specs) == 0 {
+		c.showUsage()
+	}
+	return specs
+}
+
+func (c *command) setBowFlags() {
+	c.flags.IntVar(&flagBowOpts.AssignK, "assign-k", flagBowOpts.AssignK,
+		"The number of nearest structure fragments counted for each window\n"+
+			"of a structure. When greater than 1, each window contributes a\n"+
+			"total weight of 1, divided among its nearest fragments.")
+	c.flags.Float64Var(&flagBowOpts.AssignSigma, "assign-sigma",
+		flagBowOpts.AssignSigma,
+		"The width (in angstroms of RMSD) of the kernel used to weight the\n"+
+			"nearest fragments of a window relative to the best one.\n"+
+			"Only used when 'assign-k' is greater than 1.")
+	c.flags.Float64Var(&flagBowOpts.MaxRMSD, "max-rmsd", flagBowOpts.MaxRMSD,
+		"When positive, windows of a structure whose best fragment has an\n"+
+			"RMSD greater than this are not counted.")
+}
+
+// bowOptsFor returns the BOW options to use for queries against a BOW
+// database with the metadata given. Options stored in the database are used
+// so that queries are computed consistently with its entries. It is an error
+// to explicitly set conflicting options on the command line.
+func (c *command) bowOptsFor(meta *bowDbMeta) build.Options {
+	if meta == nil {
+		return flagBowOpts
+	}
+	c.flags.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "assign-k", "assign-sigma", "max-rmsd":
+			if flagBowOpts != meta.BowOpts {
+				util.Fatalf("The BOW options given (%s) conflict with the "+
+					"options of the database (%s).",
+					flagBowOpts, meta.BowOpts)
+			}
+		}
+	})
+	return meta.BowOpts
+}
+
 func (c *command) assertNArg(n int) {
 	if c.flags.NArg() != n {
 		c.showUsage()
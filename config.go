@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ndaniels/tools/util"
+)
+
+const configHelp = `
+The default value of any flag can be changed in a configuration file or with
+environment variables, so that the same flags don't need to be repeated on
+every invocation. Flags given on the command line always take precedence.
+The defaults in effect are shown by 'flib help {command}'.
+
+The configuration file is read from the path in FLIB_CONFIG if it is set, and
+otherwise from 'flib.toml' in the current directory or '.flib.toml' in the
+home directory (whichever is found first). It is a simple subset of TOML: each
+line is a 'key = value' pair, a '[section]' header or a '#' comment. Values
+are quoted strings, numbers or booleans. For example:
+
+	cpu = 8
+
+	[search]
+	limit = 50
+	outfmt = "csv"
+
+	[libraries]
+	struct400 = "/data/flibs/structure-400-11.json"
+
+Keys before the first section set flags for every command that has them, and
+must be flags of at least one command. Keys in a section named after a
+command set flags for that command only, and must be flags of that command.
+
+Keys in the [libraries] section name library aliases: any argument (or flag
+value) of the form '@name' is replaced with the path of the alias. Relative
+paths are relative to the directory of the configuration file.
+
+Environment variables take precedence over the configuration file. The flag
+'-name' of every command is set with FLIB_NAME and the flag of a single
+command with FLIB_COMMAND_NAME, where names are in upper case with dashes
+replaced by underscores. For example, FLIB_SEARCH_OUTFMT=csv or FLIB_CPU=4.
+`
+
+// configLibraries is the section of the configuration file with library
+// aliases.
+const configLibraries = "libraries"
+
+// config is the configuration file of flib. The zero value is an empty
+// configuration.
+type config struct {
+	path string
+
+	// The values of keys outside of any section, and the values of keys in
+	// each section, by section name.
+	global   map[string]configValue
+	sections map[string]map[string]configValue
+}
+
+// configValue is the value of a key in the configuration file, along with
+// the line it was found on.
+type configValue struct {
+	value string
+	line  int
+}
+
+// loadConfig reads the configuration file given by FLIB_CONFIG, or found in
+// the current or home directory. If there is no configuration file, an
+// empty configuration is returned.
+func loadConfig() *config {
+	candidates := []string{os.Getenv("FLIB_CONFIG")}
+	explicit := len(candidates[0]) > 0
+	if !explicit {
+		candidates = []string{"flib.toml"}
+		if home := os.Getenv("HOME"); len(home) > 0 {
+			candidates = append(candidates, path.Join(home, ".flib.toml"))
+		}
+	}
+	for _, p := range candidates {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) && !explicit {
+			continue
+		}
+		util.Assert(err, "Could not open configuration file")
+		conf, err := readConfig(f, p)
+		f.Close()
+		util.Assert(err)
+		return conf
+	}
+	return &config{}
+}
+
+// readConfig parses a configuration file read from r. The path is used in
+// errors and to resolve relative library paths.
+func readConfig(r io.Reader, fpath string) (*config, error) {
+	conf := &config{
+		path:     fpath,
+		global:   make(map[string]configValue),
+		sections: make(map[string]map[string]configValue),
+	}
+	keys := conf.global
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if len(line) == 0 {
+			continue
+		}
+		bad := func(format string, v ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s",
+				fpath, lineNum, fmt.Sprintf(format, v...))
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, bad("Expected a section header, but got '%s'.",
+					line)
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if !isConfigKey(name) {
+				return nil, bad("Invalid section name '%s'.", name)
+			}
+			if _, ok := conf.sections[name]; ok {
+				return nil, bad("Section '%s' is repeated.", name)
+			}
+			keys = make(map[string]configValue)
+			conf.sections[name] = keys
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, bad("Expected 'key = value', but got '%s'.", line)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if !isConfigKey(key) {
+			return nil, bad("Invalid key '%s'.", key)
+		}
+		if _, ok := keys[key]; ok {
+			return nil, bad("Key '%s' is repeated.", key)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, bad("Invalid value for '%s': %s", key, err)
+		}
+		keys[key] = configValue{value, lineNum}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read '%s': %s", fpath, err)
+	}
+	return conf, nil
+}
+
+// stripConfigComment removes a '#' comment that isn't in a quoted string
+// from a line of the configuration file.
+func stripConfigComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// isConfigKey returns true if the string given is a bare TOML key.
+func isConfigKey(key string) bool {
+	if len(key) == 0 {
+		return false
+	}
+	for _, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseConfigValue returns a value of the configuration file as it would be
+// given on the command line. Basic strings ("...") may have escapes, literal
+// strings ('...') may not, and anything else must be a number or boolean.
+func parseConfigValue(s string) (string, error) {
+	switch {
+	case len(s) == 0:
+		return "", fmt.Errorf("missing value")
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' ||
+			strings.Contains(s[1:len(s)-1], "'") {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s == "true" || s == "false":
+		return s, nil
+	}
+	num := strings.Replace(s, "_", "", -1)
+	if _, err := strconv.ParseFloat(num, 64); err != nil {
+		return "", fmt.Errorf("expected a string, number or boolean, "+
+			"but got '%s'", s)
+	}
+	return num, nil
+}
+
+// checkKeys exits if a section of the configuration file isn't named after
+// one of the commands given (or the library aliases), or if a key outside of
+// any section isn't a flag of any of the commands.
+//
+// The flags of each command are set up on a new flag set to find their
+// names, so this must be called before any flags are parsed.
+func (conf *config) checkKeys(commands []*command) {
+	names := map[string]bool{configLibraries: true}
+	flags := make(map[string]bool)
+	for _, c := range commands {
+		names[c.name] = true
+
+		scratch := *c
+		scratch.flags = flag.NewFlagSet(c.name, flag.ContinueOnError)
+		scratch.setCommonFlags()
+		if scratch.addFlags != nil {
+			scratch.addFlags(&scratch)
+		}
+		scratch.flags.VisitAll(func(fl *flag.Flag) {
+			flags[fl.Name] = true
+		})
+	}
+	for name := range conf.sections {
+		if !names[name] {
+			util.Fatalf("%s: There is no command '%s' for the section [%s].",
+				conf.path, name, name)
+		}
+	}
+
+	var unknown []string
+	for key := range conf.global {
+		if !flags[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		util.Fatalf("%s:%d: No command has a flag '%s'.",
+			conf.path, conf.global[unknown[0]].line, unknown[0])
+	}
+}
+
+// configEnv returns the name of the environment variable for a flag. If the
+// command is empty, the variable applies to every command.
+func configEnv(cmd, name string) string {
+	if len(cmd) > 0 {
+		name = cmd + "_" + name
+	}
+	return "FLIB_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// setDefaults changes the default value of every flag of the command that is
+// set in the configuration file or the environment. It must be called before
+// the flags are parsed, so that flags given on the command line take
+// precedence. The source of each default is recorded for showFlags.
+//
+// Defaults are set on the flag values directly, so that the flags are still
+// considered unset (see bowOptsFor).
+func (c *command) setDefaults(conf *config) {
+	section := conf.sections[c.name]
+	var unknown []string
+	for key := range section {
+		if c.flags.Lookup(key) == nil {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		util.Fatalf("%s:%d: The '%s' command has no flag '%s'.",
+			conf.path, section[unknown[0]].line, c.name, unknown[0])
+	}
+
+	c.defaultSrc = make(map[string]string)
+	c.flags.VisitAll(func(fl *flag.Flag) {
+		var value, src string
+		if v, ok := os.LookupEnv(configEnv(c.name, fl.Name)); ok {
+			value, src = v, configEnv(c.name, fl.Name)
+		} else if v, ok := os.LookupEnv(configEnv("", fl.Name)); ok {
+			value, src = v, configEnv("", fl.Name)
+		} else if v, ok := section[fl.Name]; ok {
+			value, src = v.value, fmt.Sprintf("%s:%d", conf.path, v.line)
+		} else if v, ok := conf.global[fl.Name]; ok {
+			value, src = v.value, fmt.Sprintf("%s:%d", conf.path, v.line)
+		} else {
+			return
+		}
+
+		value = conf.expandAlias(value)
+		if err := fl.Value.Set(value); err != nil {
+			util.Fatalf("Invalid default '%s' for '-%s' from %s: %s",
+				value, fl.Name, src, err)
+		}
+		fl.DefValue = fl.Value.String()
+		c.defaultSrc[fl.Name] = src
+	})
+}
+
+// expandAliases replaces every argument that is a library alias ('@name')
+// with the path of the library, including the values of flags given as
+// '-flag=@name'.
+func (conf *config) expandAliases(args []string) []string {
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		eq := strings.Index(arg, "=@")
+		if eq > 0 && strings.HasPrefix(arg, "-") {
+			arg = arg[:eq+1] + conf.expandAlias(arg[eq+1:])
+		}
+		expanded[i] = conf.expandAlias(arg)
+	}
+	return expanded
+}
+
+// expandAlias returns the path of the library alias given. Strings that don't
+// start with '@' are returned unchanged, as are strings naming a file that
+// exists. It is an error to use an alias that isn't defined.
+func (conf *config) expandAlias(s string) string {
+	if !strings.HasPrefix(s, "@") || !isConfigKey(s[1:]) {
+		return s
+	}
+	if _, err := os.Stat(s); err == nil {
+		return s
+	}
+	lib, ok := conf.sections[configLibraries][s[1:]]
+	if !ok {
+		util.Fatalf("There is no library alias '%s'. Library aliases are "+
+			"defined in the [%s] section of the configuration file "+
+			"(see 'flib help config').", s, configLibraries)
+	}
+	if path.IsAbs(lib.value) || len(conf.path) == 0 {
+		return lib.value
+	}
+	return path.Join(path.Dir(conf.path), lib.value)
+}
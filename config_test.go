@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripConfigComment(t *testing.T) {
+	tests := []struct {
+		line, expected string
+	}{
+		{"limit = 5", "limit = 5"},
+		{"limit = 5 # the default is 25", "limit = 5 "},
+		{"# a comment", ""},
+		{`outfmt = "a # b" # c`, `outfmt = "a # b" `},
+		{`outfmt = 'a # b' # c`, `outfmt = 'a # b' `},
+		{`outfmt = "a \" # b" # c`, `outfmt = "a \" # b" `},
+		{`outfmt = 'a \' # b`, `outfmt = 'a \' `},
+	}
+	for _, test := range tests {
+		if got := stripConfigComment(test.line); got != test.expected {
+			t.Errorf("Stripping '%s': got '%s', expected '%s'.",
+				test.line, got, test.expected)
+		}
+	}
+}
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		value, expected string
+	}{
+		{`"csv"`, "csv"},
+		{`"a\tb"`, "a\tb"},
+		{`'C:\flibs'`, `C:\flibs`},
+		{`''`, ""},
+		{"25", "25"},
+		{"-1", "-1"},
+		{"0.25", "0.25"},
+		{"1_000", "1000"},
+		{"true", "true"},
+		{"false", "false"},
+	}
+	for _, test := range tests {
+		got, err := parseConfigValue(test.value)
+		if err != nil {
+			t.Errorf("Parsing %s: %s", test.value, err)
+		} else if got != test.expected {
+			t.Errorf("Parsing %s: got '%s', expected '%s'.",
+				test.value, got, test.expected)
+		}
+	}
+
+	for _, bad := range []string{"", "csv", `"csv`, `'csv`, `'a'b'`, "True"} {
+		if got, err := parseConfigValue(bad); err == nil {
+			t.Errorf("Parsing %s: expected an error, but got '%s'.", bad, got)
+		}
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	const text = `
+# Defaults for every command.
+cpu = 8
+
+[search]
+limit = 50   # more than the default
+outfmt = "csv"
+
+[libraries]
+struct400 = "/data/flibs/structure-400-11.json"
+`
+	conf, err := readConfig(strings.NewReader(text), "flib.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		section, key, value string
+		line                int
+	}{
+		{"", "cpu", "8", 3},
+		{"search", "limit", "50", 6},
+		{"search", "outfmt", "csv", 7},
+		{configLibraries, "struct400", "/data/flibs/structure-400-11.json", 10},
+	}
+	for _, test := range tests {
+		keys := conf.global
+		if len(test.section) > 0 {
+			keys = conf.sections[test.section]
+		}
+		got, ok := keys[test.key]
+		if !ok {
+			t.Errorf("[%s] %s is missing.", test.section, test.key)
+		} else if got.value != test.value || got.line != test.line {
+			t.Errorf("[%s] %s is '%s' on line %d, expected '%s' on line %d.",
+				test.section, test.key, got.value, got.line,
+				test.value, test.line)
+		}
+	}
+	if len(conf.global) != 1 || len(conf.sections) != 2 {
+		t.Errorf("Expected 1 global key and 2 sections, but got %v and %v.",
+			conf.global, conf.sections)
+	}
+
+	bad := map[string]string{
+		"no value":         "limit =",
+		"no equals":        "limit 5",
+		"invalid key":      "the limit = 5",
+		"repeated key":     "limit = 5\nlimit = 6",
+		"unclosed section": "[search",
+		"invalid section":  "[a b]",
+		"repeated section": "[search]\n[search]",
+	}
+	for name, text := range bad {
+		_, err := readConfig(strings.NewReader(text), "flib.toml")
+		if err == nil {
+			t.Errorf("Expected an error for %s: '%s'", name, text)
+		} else if !strings.HasPrefix(err.Error(), "flib.toml:") {
+			t.Errorf("Error for %s doesn't have the line: %s", name, err)
+		}
+	}
+}
+
+func TestExpandAlias(t *testing.T) {
+	const text = `
+[libraries]
+abs = "/data/flibs/structure-400-11.json"
+rel = "flibs/sequence-400-11.json"
+`
+	conf, err := readConfig(strings.NewReader(text), "/home/me/flib.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		arg, expected string
+	}{
+		{"@abs", "/data/flibs/structure-400-11.json"},
+		{"@rel", "/home/me/flibs/sequence-400-11.json"},
+		{"lib.json", "lib.json"},
+		{"@", "@"},
+		{"@a/b.json", "@a/b.json"},
+	}
+	for _, test := range tests {
+		if got := conf.expandAlias(test.arg); got != test.expected {
+			t.Errorf("Expanding '%s': got '%s', expected '%s'.",
+				test.arg, got, test.expected)
+		}
+	}
+
+	args := []string{"-lib=@abs", "-limit", "5", "@rel", "1abc.pdb"}
+	expected := []string{
+		"-lib=/data/flibs/structure-400-11.json", "-limit", "5",
+		"/home/me/flibs/sequence-400-11.json", "1abc.pdb",
+	}
+	got := conf.expandAliases(args)
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expanding %v: got %v, expected %v.", args, got, expected)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ndaniels/tools/util"
+)
+
+var flagTimeout = time.Duration(0)
+
+// The context of the command being run, which is cancelled when the command
+// is interrupted or times out.
+var (
+	runCtx      context.Context
+	runGraceful int32
+	runSignal   os.Signal
+)
+
+// startContext creates the context of the command being run. It is cancelled
+// when the process receives SIGINT or SIGTERM, or when the '-timeout'
+// elapses. Commands that don't use the context (see commandContext) exit
+// immediately instead, as does every command on a second signal.
+//
+// The function returned must be called once the command finishes.
+func startContext() func() {
+	var cancel context.CancelFunc
+	if flagTimeout > 0 {
+		runCtx, cancel = context.WithTimeout(context.Background(), flagTimeout)
+	} else {
+		runCtx, cancel = context.WithCancel(context.Background())
+	}
+
+	sigs := make(chan os.Signal, 1)
+	quit := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			runSignal = sig
+			cancel()
+		case <-runCtx.Done():
+		case <-quit:
+			return
+		}
+		if atomic.LoadInt32(&runGraceful) == 0 {
+			util.Fatalf("%s", stopReason())
+		}
+		log.Printf("%s Stopping... (interrupt again to exit immediately)",
+			stopReason())
+		select {
+		case <-sigs:
+			util.Fatalf("Exiting without cleaning up.")
+		case <-quit:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(quit)
+		cancel()
+	}
+}
+
+// commandContext returns the context of the command being run. Commands
+// that call it must stop their work when it's cancelled, clean up their
+// output and then call exitIfCancelled.
+func commandContext() context.Context {
+	atomic.StoreInt32(&runGraceful, 1)
+	return runCtx
+}
+
+// stopReason describes why the context of the command was cancelled.
+func stopReason() string {
+	if runCtx.Err() == context.DeadlineExceeded {
+		return fmt.Sprintf("Timed out after %s.", flagTimeout)
+	}
+	if runSignal == syscall.SIGTERM {
+		return "Terminated."
+	}
+	return "Interrupted."
+}
+
+// exitIfCancelled exits if the context of the command was cancelled, after
+// calling cleanup (if not nil) to save progress or remove partial output.
+func exitIfCancelled(cleanup func()) {
+	if runCtx.Err() == nil {
+		return
+	}
+	if cleanup != nil {
+		cleanup()
+	}
+	skipped.close()
+	util.Fatalf("%s", stopReason())
+}
+
+// removeOutput closes and removes an output file that could not be
+// completely written.
+func removeOutput(f *os.File) {
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not remove partial output '%s': %s", f.Name(), err)
+	}
+}
@@ -13,6 +13,11 @@ import (
 )
 
 var commands = []*command{
+	cmdBowDbCheck,
+	cmdBowDbCluster,
+	cmdBowDbColumns,
+	cmdBowDbIndex,
+	cmdBowDbKnn,
 	cmdMkBowDb,
 	cmdMkPaired,
 	cmdMkSeqHMM,
@@ -21,14 +26,17 @@ var commands = []*command{
 	cmdMkWeighted,
 	cmdPairdist,
 	cmdSearch,
+	cmdSearchBench,
 	cmdVectors,
+	cmdViewBowDb,
 	cmdViewLib,
 }
 
 func usage() {
 	log.Println("flib is a tool for creating and using fragment libraries.\n")
 	log.Println("Usage:\n\n    flib {command} [flags] [arguments]\n")
-	log.Println("Use 'flib help {command}' for more details on {command}.\n")
+	log.Println("Use 'flib help {command}' for more details on {command}.")
+	log.Println("Use 'flib help config' to set defaults for flags.\n")
 	log.Println("A list of all available commands:\n")
 
 	tabw := tabwriter.NewWriter(os.Stderr, 0, 0, 4, ' ', 0)
@@ -48,6 +56,9 @@ func main() {
 	} else if strings.TrimLeft(os.Args[1], "-") == "help" {
 		if len(os.Args) < 3 {
 			usage()
+		} else if os.Args[2] == "config" {
+			log.Println(strings.TrimSpace(configHelp))
+			os.Exit(1)
 		} else {
 			cmd = os.Args[2]
 			help = true
@@ -56,17 +67,20 @@ func main() {
 		cmd = os.Args[1]
 	}
 
+	conf := loadConfig()
+	conf.checkKeys(commands)
 	for _, c := range commands {
 		if c.name == cmd {
 			c.setCommonFlags()
 			if c.addFlags != nil {
 				c.addFlags(c)
 			}
+			c.setDefaults(conf)
 			if help {
 				c.showHelp()
 			} else {
 				c.flags.Usage = c.showUsage
-				c.flags.Parse(os.Args[2:])
+				c.flags.Parse(conf.expandAliases(os.Args[2:]))
 
 				if flagCpu < 1 {
 					flagCpu = 1
@@ -80,7 +94,11 @@ func main() {
 					defer pprof.StopCPUProfile()
 				}
 
+				stop := startContext()
+				skipped.open(flagErrors)
 				c.run(c)
+				stop()
+				skipped.close()
 				return
 			}
 		}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"log"
+	"os"
+
+	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/esfragbag/bow"
 	"github.com/ndaniels/esfragbag/bowdb"
 	"github.com/ndaniels/tools/util"
 )
 
+var flagMkBowDbSeqs = false
+
 var cmdMkBowDb = &command{
 	name:            "mk-bowdb",
 	positionalUsage: "bowdb-path frag-lib bower-file [ bower-file ... ]",
@@ -16,31 +24,161 @@ as a bag-of-words in terms of the fragment library given.
 
 The fragment library may be any kind; but the bower files provided must be able
 to provide the type of BOW expected by the fragment library. For example, a
-FASTA file can only be used with sequence fragment libraries, while a PDB file 
-can be used with either structure or sequence fragment libraries.
-`,
+FASTA file can only be used with sequence fragment libraries, while a PDB or
+mmCIF file can be used with either structure or sequence fragment libraries.
+Files ending with '.gz' are decompressed automatically.
+
+When a structure fragment library is used, the '-assign-k' and '-max-rmsd'
+flags make BOWs less sensitive to windows that are close to more than one
+fragment. These options are stored in the database, and the search command
+uses them to compute the BOWs of queries in the same way.
+
+The provenance of the database is stored in it too: the time it was created,
+the version of flib and the command line used, the path, size and SHA-256
+checksum of every bower file, and the bower file argument, chain, number of
+residues and number of windows of every entry. Use view-bowdb to see it.
+Since the paths of the bower files are stored, 'search -rerank' can read the
+structures of hits. If the files are moved, the '-pdb-dir' flag of the
+search command can be used instead. With the '-sequences' flag, the residue
+sequence of each entry is stored too, so that 'search -rerank sequence'
+doesn't need the bower files.
+` + domainsHelp + bowerFilesHelp + checkpointHelp,
 	flags: flag.NewFlagSet("mk-bowdb", flag.ExitOnError),
 	run:   mkBowDb,
 	addFlags: func(c *command) {
 		c.setOverwriteFlag()
+		c.flags.BoolVar(&flagMkBowDbSeqs, "sequences", flagMkBowDbSeqs,
+			"When set, the residue sequence of each entry is stored in the\n"+
+				"database (for 'search -rerank sequence').")
+		c.setBowerListFlag()
+		c.setErrorsFlag()
+		c.setDomainsFlag()
+		c.setBowFlags()
+		c.setCheckpointFlags()
 	},
 }
 
 func mkBowDb(c *command) {
-	c.assertLeastNArg(3)
+	c.assertLeastNArg(2)
 
 	dbPath := c.flags.Arg(0)
 	flib := util.Library(c.flags.Arg(1))
-	bowPaths := c.flags.Args()[2:]
+	bowSpecs := c.bowerSpecs(2, true)
 
-	util.AssertOverwritable(dbPath, flagOverwrite)
+	cp := c.checkpoint(2, bowSpecs)
+	if !flagResume {
+		util.AssertOverwritable(dbPath, flagOverwrite)
+	}
 
 	db, err := bowdb.Create(flib, dbPath)
 	util.Assert(err)
 
-	bows := util.ProcessBowers(bowPaths, flib, false, flagCpu, util.FlagQuiet)
-	for b := range bows {
-		db.Add(b)
+	prov := newBowDbProvenance()
+	inputs := make(bowDbInputs)
+	var ids []string
+	seqs := make(map[string]string)
+	add := func(e mkBowDbEntry) {
+		db.Add(bow.Bowed{Id: e.Entry.Id, Bow: e.bow(flib.Size())})
+		if flagMkBowDbSeqs {
+			ids = append(ids, e.Entry.Id)
+			seqs[e.Entry.Id] = e.Sequence
+		}
+		prov.Entries = append(prov.Entries, e.Entry)
 	}
+
+	// Entries saved in the checkpoint are added first, in the order they
+	// were computed.
+	cp.replay(func(results []byte) error {
+		var rec mkBowDbRecord
+		if err := json.Unmarshal(results, &rec); err != nil {
+			return err
+		}
+		inputs[rec.Input.Path] = rec.Input
+		for _, e := range rec.Entries {
+			add(e)
+		}
+		return nil
+	})
+	ctx := commandContext()
+	processed := processSpecBowers(ctx, cp.remaining(bowSpecs), flib, false,
+		flagBowOpts, util.FlagQuiet)
+	for sb := range processed {
+		if sb.err != nil {
+			// The argument is not recorded, so it is tried again when
+			// resuming.
+			continue
+		}
+		input, err := inputs.checksum(sb.spec)
+		if err != nil {
+			skipped.input(sb.spec, err)
+			continue
+		}
+		rec := mkBowDbRecord{Input: input}
+		for _, b := range sb.bows {
+			e := newMkBowDbEntry(b, flib)
+			rec.Entries = append(rec.Entries, e)
+			add(e)
+		}
+		cp.record(sb.spec, rec)
+	}
+
+	// A database without every entry is never left behind. The entries
+	// computed so far are kept in the checkpoint, if there is one.
+	exitIfCancelled(func() {
+		db.Close()
+		if err := os.RemoveAll(dbPath); err != nil {
+			log.Printf("Could not remove partial database '%s': %s", dbPath, err)
+		}
+		cp.interrupt(nil)
+	})
 	util.Assert(db.Close())
+	prov.Inputs = inputs.ordered(bowSpecs)
+	util.Assert(writeBowDbMeta(dbPath, &bowDbMeta{BowOpts: flagBowOpts}),
+		"Could not write metadata to '%s'", dbPath)
+	util.Assert(writeBowDbProvenance(dbPath, prov),
+		"Could not write provenance to '%s'", dbPath)
+	if flagMkBowDbSeqs {
+		util.Assert(writeBowDbSequences(dbPath, ids, seqs),
+			"Could not write sequences to '%s'", dbPath)
+	}
+	cp.finish()
+}
+
+// mkBowDbRecord is the result of a bower file argument as it is saved in a
+// checkpoint: the record of its file and its entries.
+type mkBowDbRecord struct {
+	Input   bowDbInput
+	Entries []mkBowDbEntry
+}
+
+// mkBowDbEntry is an entry of a BOW database as it is saved in a checkpoint.
+// Only the non-zero frequencies of its BOW are saved.
+type mkBowDbEntry struct {
+	Entry    bowDbEntry
+	Frags    []int
+	Freqs    []float32
+	Sequence string `json:",omitempty"`
+}
+
+func newMkBowDbEntry(sb sourcedBow, lib fragbag.Library) mkBowDbEntry {
+	e := mkBowDbEntry{Entry: newBowDbEntry(sb, lib)}
+	for i, f := range sb.Bow.Freqs {
+		if f != 0 {
+			e.Frags = append(e.Frags, i)
+			e.Freqs = append(e.Freqs, f)
+		}
+	}
+	if flagMkBowDbSeqs {
+		e.Sequence = sb.bower.Residues()
+	}
+	return e
+}
+
+// bow returns the BOW of the entry for a library with the size given.
+func (e mkBowDbEntry) bow(size int) bow.Bow {
+	freqs := make([]float32, size)
+	for i, frag := range e.Frags {
+		freqs[frag] = e.Freqs[i]
+	}
+	return bow.Bow{Freqs: freqs}
 }
@@ -3,26 +3,58 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math"
+	"sort"
 	"strings"
+	"sync"
 
-	"github.com/ndaniels/esfragbag"
+	"github.com/TuftsBCB/io/pdb"
 	"github.com/TuftsBCB/seq"
 	"github.com/TuftsBCB/structure"
+	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/flib/build"
 	"github.com/ndaniels/tools/util"
 )
 
+var (
+	flagPairedGap         = 0
+	flagPairedContacts    = false
+	flagPairedContactDist = 10.0
+	flagPairedTop         = 0
+)
+
 var cmdMkPaired = &command{
 	name:            "mk-paired",
-	positionalUsage: "in-frag-lib out-frag-lib",
-	shortHelp:       "concatenates all fragment pairs",
+	positionalUsage: "in-frag-lib out-frag-lib [ pdb-chain-file ... ]",
+	shortHelp:       "concatenates fragment pairs",
 	help: `
 The mk-paired command generates a new fragment library from the one given
-by concatenating all pairs of fragments and using each concatenation as
+by concatenating pairs of fragments and using each concatenation as
 a fragment in the new library.
 
-This command will produce a fragment library with N * (N-1) fragments each of
-M*2 size, where N is the number of fragments in the input library and M is
-the fragment size of the input library.
+When no PDB chain files are given, this command will produce a fragment
+library with N * (N-1) fragments each of M*2 size, where N is the number of
+fragments in the input library and M is the fragment size of the input
+library.
+
+When PDB chain files are given, they are used as a training set. Every
+window in every chain is assigned its best matching fragment, and pairs of
+windows are counted as described below. Only pairs that were observed at
+least once are included in the new library, ordered from most to least
+frequent. (In this mode, a fragment may be paired with itself.)
+
+By default, a pair of windows is counted when the second window starts
+immediately after the first one ends. With the '-gap' flag, the pair is
+counted when the two windows are separated by exactly that many residues.
+With the '-contacts' flag, sequence separation is ignored: any two
+non-overlapping windows whose alpha-carbon centroids are within
+'-contact-dist' angstroms of each other are counted. Note that the paired
+fragments are always the concatenation of their two halves; the gap or
+contact criterion only determines which pairs are selected, and it is
+recorded in the name of the new library.
+
+The '-top' flag keeps only the most frequently observed pairs, which keeps
+the size of the new library manageable for large input libraries.
 
 The 'in-frag-lib' is the source library with which to generate fragment
 pairs. The file given is not modified. It must NOT be a weighted fragment
@@ -30,61 +62,289 @@ library. (Weights may be added to the paired fragment library with the
 mk-weighted command.)
 
 The 'out-frag-lib' is the path to write the new library with fragment pairs.
-`,
+` + bowerFilesHelp,
 	flags: flag.NewFlagSet("mk-paired", flag.ExitOnError),
 	run:   mkPaired,
 	addFlags: func(c *command) {
 		c.setOverwriteFlag()
+		c.setBowerListFlag()
+		c.setErrorsFlag()
+		c.flags.IntVar(&flagPairedGap, "gap", flagPairedGap,
+			"The number of residues separating the two windows of a pair.\n"+
+				"Requires training PDB chain files.")
+		c.flags.BoolVar(&flagPairedContacts, "contacts", flagPairedContacts,
+			"When set, pairs of windows that are in contact in 3D are\n"+
+				"counted instead of pairs separated in sequence.\n"+
+				"Requires training PDB chain files.")
+		c.flags.Float64Var(&flagPairedContactDist, "contact-dist",
+			flagPairedContactDist,
+			"The maximum distance (in angstroms) between the alpha-carbon\n"+
+				"centroids of two windows for them to be in contact.")
+		c.flags.IntVar(&flagPairedTop, "top", flagPairedTop,
+			"When positive, only the most frequent pairs observed in the\n"+
+				"training PDB chain files are kept. Requires training PDB\n"+
+				"chain files.")
 	},
 }
 
 func mkPaired(c *command) {
-	c.assertNArg(2)
+	c.assertLeastNArg(2)
 
 	in := util.Library(c.flags.Arg(0))
 	outPath := c.flags.Arg(1)
+	trainSpecs := c.bowerSpecs(2, false)
 	util.AssertOverwritable(outPath, flagOverwrite)
 
 	if _, ok := in.(fragbag.WeightedLibrary); ok {
 		util.Fatalf("%s is a weighted library (not allowed)", in.Name())
 	}
+	if flagPairedGap < 0 {
+		util.Fatalf("The gap must be non-negative, but got %d.", flagPairedGap)
+	}
+	if flagPairedContacts && flagPairedGap > 0 {
+		util.Fatalf("The '-gap' and '-contacts' flags cannot be used together.")
+	}
+	isHMM := strings.Contains(in.Tag(), "hmm")
+	if !fragbag.IsStructure(in) && !isHMM {
+		if strings.Contains(in.Tag(), "profile") {
+			util.Fatalf("Sequence profiles not implemented.")
+		}
+		util.Fatalf("Unrecognized fragment library: %s", in.Tag())
+	}
+	if len(trainSpecs) == 0 {
+		if flagPairedGap > 0 || flagPairedContacts || flagPairedTop > 0 {
+			util.Fatalf("The '-gap', '-contacts' and '-top' flags require " +
+				"training PDB chain files.")
+		}
+	}
 
 	name := fmt.Sprintf("paired-%s", in.Name())
+	if flagPairedContacts {
+		name = fmt.Sprintf("paired-contacts%g-%s",
+			flagPairedContactDist, in.Name())
+	} else if flagPairedGap > 0 {
+		name = fmt.Sprintf("paired-gap%d-%s", flagPairedGap, in.Name())
+	}
+
+	var pairs []fragPair
+	if len(trainSpecs) == 0 {
+		pairs = allPairs(in.Size())
+	} else {
+		pairs = countPairs(in, trainSpecs)
+		if flagPairedTop > 0 && flagPairedTop < len(pairs) {
+			pairs = pairs[:flagPairedTop]
+		}
+		util.Verbosef("Keeping %d fragment pairs.", len(pairs))
+	}
+
 	if fragbag.IsStructure(in) {
-		var pairs [][]structure.Coords
+		var frags [][]structure.Coords
 		lib := in.(fragbag.StructureLibrary)
-		nfrags := lib.Size()
-		for i := 0; i < nfrags; i++ {
-			for j := 0; j < nfrags; j++ {
-				if i == j {
-					continue
-				}
-				f1, f2 := lib.Atoms(i), lib.Atoms(j)
-				pairs = append(pairs, append(f1, f2...))
-			}
+		for _, p := range pairs {
+			f1, f2 := lib.Atoms(p.first), lib.Atoms(p.second)
+			frags = append(frags, append(append([]structure.Coords{}, f1...),
+				f2...))
 		}
-		pairLib, err := fragbag.NewStructureAtoms(name, pairs)
+		pairLib, err := fragbag.NewStructureAtoms(name, frags)
 		util.Assert(err)
 		fragbag.Save(util.CreateFile(outPath), pairLib)
-	} else if strings.Contains(in.Tag(), "hmm") {
-		var pairs []*seq.HMM
+	} else if isHMM {
+		var frags []*seq.HMM
 		lib := in.(fragbag.SequenceLibrary)
-		nfrags := lib.Size()
-		for i := 0; i < nfrags; i++ {
-			for j := 0; j < nfrags; j++ {
-				if i == j {
+		for _, p := range pairs {
+			f1 := lib.Fragment(p.first).(*seq.HMM)
+			f2 := lib.Fragment(p.second).(*seq.HMM)
+			frags = append(frags, seq.HMMCat(f1, f2))
+		}
+		pairLib, err := fragbag.NewSequenceHMM(name, frags)
+		util.Assert(err)
+		fragbag.Save(util.CreateFile(outPath), pairLib)
+	}
+}
+
+// fragPair is an ordered pair of fragment indices along with the number of
+// times it was observed in a training set.
+type fragPair struct {
+	first, second int
+	count         int
+}
+
+// allPairs returns every ordered pair of distinct fragments.
+func allPairs(nfrags int) []fragPair {
+	var pairs []fragPair
+	for i := 0; i < nfrags; i++ {
+		for j := 0; j < nfrags; j++ {
+			if i == j {
+				continue
+			}
+			pairs = append(pairs, fragPair{i, j, 0})
+		}
+	}
+	return pairs
+}
+
+// countPairs tallies the fragment pairs observed in the PDB chain files given
+// and returns them sorted from most to least frequent.
+func countPairs(lib fragbag.Library, trainSpecs []bowerSpec) []fragPair {
+	counts := make(map[[2]int]int)
+	countsLock := new(sync.Mutex)
+
+	entryChan := make(chan bowerSpec)
+	go func() {
+		for _, fp := range trainSpecs {
+			entryChan <- fp
+		}
+		close(entryChan)
+	}()
+
+	wg := new(sync.WaitGroup)
+	progress := util.NewProgress(len(trainSpecs))
+	for i := 0; i < flagCpu; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range entryChan {
+				chains, err := openChains(entry)
+				progress.JobDone(err)
+				if err != nil {
+					skipped.input(entry, err)
 					continue
 				}
-				f1, f2 := lib.Fragment(i).(*seq.HMM), lib.Fragment(j).(*seq.HMM)
-				pairs = append(pairs, seq.HMMCat(f1, f2))
+
+				for _, chain := range chains {
+					found, err := chainPairs(lib, chain)
+					skipped.chain(entry, chain, err)
+					countsLock.Lock()
+					for _, p := range found {
+						counts[p]++
+					}
+					countsLock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	progress.Close()
+
+	pairs := make([]fragPair, 0, len(counts))
+	for p, count := range counts {
+		pairs = append(pairs, fragPair{p[0], p[1], count})
+	}
+	sort.Sort(pairsByCount(pairs))
+	return pairs
+}
+
+// chainPairs returns every pair of fragments observed in a single chain,
+// according to the gap or contact criterion. If the chain has no windows, an
+// error is returned (see assignWindows).
+func chainPairs(lib fragbag.Library, chain *pdb.Chain) ([][2]int, error) {
+	best, centroids, err := assignWindows(lib, chain)
+	if err != nil {
+		return nil, err
+	}
+	fragSize := lib.FragmentSize()
+
+	var pairs [][2]int
+	if !flagPairedContacts {
+		offset := fragSize + flagPairedGap
+		for i := 0; i+offset < len(best); i++ {
+			if best[i] >= 0 && best[i+offset] >= 0 {
+				pairs = append(pairs, [2]int{best[i], best[i+offset]})
 			}
 		}
-		pairLib, err := fragbag.NewSequenceHMM(name, pairs)
-		util.Assert(err)
-		fragbag.Save(util.CreateFile(outPath), pairLib)
-	} else if strings.Contains(in.Tag(), "profile") {
-		util.Fatalf("Sequence profiles not implemented.")
-	} else {
-		util.Fatalf("Unrecognized fragment library: %s", in.Tag())
+		return pairs, nil
+	}
+	for i := 0; i < len(best); i++ {
+		if best[i] < 0 {
+			continue
+		}
+		for j := i + fragSize; j < len(best); j++ {
+			if best[j] < 0 {
+				continue
+			}
+			if coordsDist(centroids[i], centroids[j]) <= flagPairedContactDist {
+				pairs = append(pairs, [2]int{best[i], best[j]})
+			}
+		}
+	}
+	return pairs, nil
+}
+
+// assignWindows finds the best fragment for every window in the chain given,
+// along with the centroid of the alpha-carbon atoms in that window. Windows
+// with missing alpha-carbon atoms are assigned the fragment -1. If no window
+// can be assigned, the error is the same as build.ChainWindows.
+func assignWindows(
+	lib fragbag.Library,
+	chain *pdb.Chain,
+) ([]int, []structure.Coords, error) {
+	sequence := chain.AsSequence()
+	fragSize := lib.FragmentSize()
+	if sequence.Len() < fragSize {
+		return nil, nil, build.ErrTooShort
+	}
+
+	atoms := chain.SequenceCaAtoms()
+	best := make([]int, sequence.Len()-fragSize+1)
+	centroids := make([]structure.Coords, len(best))
+	atomSlice := make([]structure.Coords, fragSize)
+	assigned := 0
+	for start := range best {
+		best[start] = -1
+		gapped := false
+		for i, atom := range atoms[start : start+fragSize] {
+			if atom == nil {
+				gapped = true
+				break
+			}
+			atomSlice[i] = *atom
+		}
+		if gapped {
+			continue
+		}
+		centroids[start] = centroid(atomSlice)
+		switch lib := lib.(type) {
+		case fragbag.StructureLibrary:
+			best[start] = lib.BestStructureFragment(atomSlice)
+		case fragbag.SequenceLibrary:
+			best[start] = lib.BestSequenceFragment(
+				sequence.Slice(start, start+fragSize))
+		}
+		assigned++
+	}
+	if assigned == 0 {
+		return nil, nil, build.GappedError(atoms)
+	}
+	return best, centroids, nil
+}
+
+func centroid(atoms []structure.Coords) structure.Coords {
+	var c structure.Coords
+	for _, atom := range atoms {
+		c.X += atom.X
+		c.Y += atom.Y
+		c.Z += atom.Z
+	}
+	n := float64(len(atoms))
+	c.X, c.Y, c.Z = c.X/n, c.Y/n, c.Z/n
+	return c
+}
+
+func coordsDist(a, b structure.Coords) float64 {
+	dx, dy, dz := a.X-b.X, a.Y-b.Y, a.Z-b.Z
+	return math.Sqrt(dx*dx + dy*dy + dz*dz)
+}
+
+type pairsByCount []fragPair
+
+func (ps pairsByCount) Len() int      { return len(ps) }
+func (ps pairsByCount) Swap(i, j int) { ps[i], ps[j] = ps[j], ps[i] }
+func (ps pairsByCount) Less(i, j int) bool {
+	if ps[i].count != ps[j].count {
+		return ps[i].count > ps[j].count
+	}
+	if ps[i].first != ps[j].first {
+		return ps[i].first < ps[j].first
 	}
+	return ps[i].second < ps[j].second
 }
@@ -4,16 +4,10 @@ package main
 
 import (
 	"flag"
-	"fmt"
-	"io/ioutil"
-	"os"
-	"path"
 
-	"github.com/BurntSushi/ty/fun"
-	"github.com/TuftsBCB/apps/hhsuite"
-	"github.com/ndaniels/esfragbag"
-	"github.com/TuftsBCB/io/msa"
 	"github.com/TuftsBCB/seq"
+	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/flib/build"
 	"github.com/ndaniels/tools/util"
 )
 
@@ -44,115 +38,65 @@ The algorithm for building a sequence fragment library is as follows:
 This process directly implies that the sequence fragment library produced will
 have the same number of fragments and the same fragment size as the structure
 fragment library given.
-`,
-	flags:    flag.NewFlagSet("mk-seq-hmm", flag.ExitOnError),
-	run:      mkSeqHMM,
-	addFlags: func(c *command) { c.setOverwriteFlag() },
+
+PDB chain files may be PDB or mmCIF files. Files ending with '.gz' are
+decompressed automatically.
+` + bowerFilesHelp + checkpointHelp,
+	flags: flag.NewFlagSet("mk-seq-hmm", flag.ExitOnError),
+	run:   mkSeqHMM,
+	addFlags: func(c *command) {
+		c.setOverwriteFlag()
+		c.setBowerListFlag()
+		c.setErrorsFlag()
+		c.setCheckpointFlags()
+	},
 }
 
 func mkSeqHMM(c *command) {
-	c.assertLeastNArg(3)
+	c.assertLeastNArg(2)
 
 	structLib := util.StructureLibrary(c.flags.Arg(0))
 	outPath := c.flags.Arg(1)
-	entries := c.flags.Args()[2:]
+	entries := c.bowerSpecs(2, true)
 
-	util.AssertOverwritable(outPath, flagOverwrite)
+	cp := c.checkpoint(2, entries)
+	if !flagResume {
+		util.AssertOverwritable(outPath, flagOverwrite)
+	}
 	saveto := util.CreateFile(outPath)
 
-	// Stores intermediate files produced by hhmake.
-	tempDir, err := ioutil.TempDir("", "mk-seqlib-hmm")
-	util.Assert(err, "Could not create temporary directory.")
-	defer os.RemoveAll(tempDir)
-
-	// Initialize a MSA for each structural fragment.
-	var msas []seq.MSA
-	var msaChans []chan seq.Sequence
-	for i := 0; i < structLib.Size(); i++ {
-		msa := seq.NewMSA()
-		msa.SetLen(structLib.FragmentSize())
-		msas = append(msas, msa)
-		msaChans = append(msaChans, make(chan seq.Sequence))
+	// Initialize a MSA for each structural fragment, with the sequences
+	// saved in a checkpoint if there are any.
+	mb := build.NewMSABuilder(structLib)
+	var saved [][]seq.Sequence
+	if cp.load(&saved) {
+		util.Assert(mb.Restore(saved))
 	}
-
-	// Now spin up a goroutine for each fragment that is responsible for
-	// adding a sequence slice to itself.
-	for i := 0; i < structLib.Size(); i++ {
-		addToMSA(msaChans[i], &msas[i])
+	save := func() {
+		entries := mb.Entries()
+		cp.save(&entries)
 	}
+	ctx := commandContext()
+	addChains(ctx, cp.remaining(entries), mb.AddChain, cp, save)
 
-	// Create a channel that sends the PDB entries given.
-	entryChan := make(chan string)
-	go func() {
-		for _, fp := range entries {
-			entryChan <- fp
-		}
-		close(entryChan)
-	}()
-
-	progress := util.NewProgress(len(entries))
-	for i := 0; i < flagCpu; i++ {
-		wgPDBChains.Add(1)
-		go func() {
-			for entryPath := range entryChan {
-				_, chains, err := util.PDBOpen(entryPath)
-				progress.JobDone(err)
-				if err != nil {
-					continue
-				}
-
-				for _, chain := range chains {
-					structureToSequence(structLib, chain, nil, msaChans)
-				}
-			}
-			wgPDBChains.Done()
-		}()
+	// Building the profile HMMs may take a while too, so save every MSA
+	// before starting. The MSAs are also saved if the command was stopped.
+	if cp != nil {
+		save()
 	}
-	wgPDBChains.Wait()
-	progress.Close()
-
-	// We've finishing reading all the PDB inputs. Now close the channels
-	// and let the sequence fragments finish.
-	for i := 0; i < structLib.Size(); i++ {
-		close(msaChans[i])
+	stop := func() {
+		removeOutput(saveto)
+		cp.interrupt(nil)
 	}
-	wgSeqFragments.Wait()
+	exitIfCancelled(stop)
 
 	util.Verbosef("Building profile HMMs from MSAs...")
 
 	// Finally, add the sequence fragments to a new sequence fragment
 	// library and save.
-	hmms := make([]*seq.HMM, structLib.Size())
-	hhmake := func(i int) struct{} {
-		fname := path.Join(tempDir, fmt.Sprintf("%d.fasta", i))
-		f := util.CreateFile(fname)
-		util.Assert(msa.WriteFasta(f, msas[i]))
-
-		hhm, err := hhsuite.HHMakePseudo.Run(fname)
-		util.Assert(err)
-		hmms[i] = hhm.HMM
-		return struct{}{} // my unifier sucks, i guess
-	}
-	fun.ParMap(hhmake, fun.Range(0, structLib.Size()))
-
-	lib, err := fragbag.NewSequenceHMM(structLib.Name(), hmms)
+	lib, err := mb.Library(ctx)
+	exitIfCancelled(stop)
 	util.Assert(err)
 	util.Assert(fragbag.Save(saveto, lib))
-}
-
-func addToMSA(sequences chan seq.Sequence, msa *seq.MSA) {
-	wgSeqFragments.Add(1)
-	go func() {
-		for s := range sequences {
-			// We don't use Add or AddFasta since both are
-			// O(#sequences * #frag-length), which gets to be quite slow
-			// in the presence of a lot of sequences.
-			//
-			// The key here is that we know that every sequence has the same
-			// length and is in the same format, so we can add entries in a
-			// straight forward manner.
-			msa.Entries = append(msa.Entries, s)
-		}
-		wgSeqFragments.Done()
-	}()
+	cp.finish()
 }
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"sync"
 
-	"github.com/ndaniels/esfragbag"
 	"github.com/TuftsBCB/io/pdb"
-	"github.com/TuftsBCB/seq"
-	"github.com/TuftsBCB/structure"
+	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/flib/build"
 	"github.com/ndaniels/tools/util"
 )
 
@@ -39,175 +39,113 @@ The algorithm for building a sequence fragment library is as follows:
 This process directly implies that the sequence fragment library produced will
 have the same number of fragments and the same fragment size as the structure
 fragment library given.
-`,
-	flags:    flag.NewFlagSet("mk-seq-profile", flag.ExitOnError),
-	run:      mkSeqProfile,
-	addFlags: func(c *command) { c.setOverwriteFlag() },
-}
 
-var (
-	// There are two concurrent aspects going on here:
-	// 1) processing entire PDB chains
-	// 2) adding each part of each chain to a sequence fragment.
-	// So we use two waitgroups: one for synchronizing on finishing
-	// (1) and the other for synchronizing on finishing (2).
-	wgPDBChains    = new(sync.WaitGroup)
-	wgSeqFragments = new(sync.WaitGroup)
-)
+PDB chain files may be PDB or mmCIF files. Files ending with '.gz' are
+decompressed automatically.
+` + bowerFilesHelp + checkpointHelp,
+	flags: flag.NewFlagSet("mk-seq-profile", flag.ExitOnError),
+	run:   mkSeqProfile,
+	addFlags: func(c *command) {
+		c.setOverwriteFlag()
+		c.setBowerListFlag()
+		c.setErrorsFlag()
+		c.setCheckpointFlags()
+	},
+}
 
 func mkSeqProfile(c *command) {
-	c.assertLeastNArg(3)
+	c.assertLeastNArg(2)
 
 	structLib := util.StructureLibrary(c.flags.Arg(0))
 	outPath := c.flags.Arg(1)
-	entries := c.flags.Args()[2:]
-
-	util.AssertOverwritable(outPath, flagOverwrite)
-	saveto := util.CreateFile(outPath)
+	entries := c.bowerSpecs(2, true)
 
-	// Initialize a frequency and null profile for each structural fragment.
-	var freqProfiles []*seq.FrequencyProfile
-	var fpChans []chan seq.Sequence
-	for i := 0; i < structLib.Size(); i++ {
-		fp := seq.NewFrequencyProfile(structLib.FragmentSize())
-		freqProfiles = append(freqProfiles, fp)
-		fpChans = append(fpChans, make(chan seq.Sequence))
+	cp := c.checkpoint(2, entries)
+	if !flagResume {
+		util.AssertOverwritable(outPath, flagOverwrite)
 	}
+	saveto := util.CreateFile(outPath)
 
-	// Now spin up a goroutine for each fragment that is responsible for
-	// adding a sequence slice to itself.
-	nullChan, nullProfile := addToNull()
-	for i := 0; i < structLib.Size(); i++ {
-		addToProfile(fpChans[i], freqProfiles[i])
+	// Initialize a frequency and null profile for each structural fragment,
+	// unless they were saved in a checkpoint.
+	pb := build.NewProfileBuilder(structLib)
+	counts := new(build.ProfileCounts)
+	if cp.load(counts) {
+		util.Assert(pb.Restore(counts))
 	}
+	addChains(commandContext(), cp.remaining(entries), pb.AddChain, cp,
+		func() { cp.save(pb.Counts()) })
+	exitIfCancelled(func() {
+		removeOutput(saveto)
+		cp.interrupt(pb.Counts())
+	})
+
+	// Finally, turn the frequency profiles into a new sequence fragment
+	// library and save.
+	lib, err := pb.Library()
+	util.Assert(err)
+	util.Assert(fragbag.Save(saveto, lib))
+	cp.finish()
+}
 
+// addChains calls addChain with every chain of the PDB chain files given,
+// processing files in parallel with flagCpu workers. Files and chains that
+// can't be used are reported to skipped.
+//
+// When the checkpoint is due, save is called while no chains are being
+// added. When the context is cancelled, no more files are opened and
+// addChains returns once the files being processed are done.
+func addChains(
+	ctx context.Context,
+	entries []bowerSpec,
+	addChain func(*pdb.Chain) error,
+	cp *checkpoint,
+	save func(),
+) {
 	// Create a channel that sends the PDB entries given.
-	entryChan := make(chan string)
+	entryChan := make(chan bowerSpec)
 	go func() {
+		defer close(entryChan)
 		for _, fp := range entries {
-			entryChan <- fp
+			select {
+			case entryChan <- fp:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(entryChan)
 	}()
 
+	// Checkpoints are saved while no chains are being processed.
+	pause := new(sync.RWMutex)
+	wg := new(sync.WaitGroup)
 	progress := util.NewProgress(len(entries))
 	for i := 0; i < flagCpu; i++ {
-		wgPDBChains.Add(1)
+		wg.Add(1)
 		go func() {
-			for entryPath := range entryChan {
-				_, chains, err := util.PDBOpen(entryPath)
+			defer wg.Done()
+			for entry := range entryChan {
+				pause.RLock()
+				chains, err := openChains(entry)
 				progress.JobDone(err)
 				if err != nil {
-					continue
+					skipped.input(entry, err)
 				}
-
 				for _, chain := range chains {
-					structureToSequence(structLib, chain, nullChan, fpChans)
+					skipped.chain(entry, chain, addChain(chain))
+				}
+				// Entries that could not be read are tried again when
+				// resuming.
+				due := err == nil && cp.inputDone(entry)
+				pause.RUnlock()
+
+				if due {
+					pause.Lock()
+					save()
+					pause.Unlock()
 				}
 			}
-			wgPDBChains.Done()
 		}()
 	}
-	wgPDBChains.Wait()
+	wg.Wait()
 	progress.Close()
-
-	// We've finishing reading all the PDB inputs. Now close the channels
-	// and let the sequence fragments finish.
-	close(nullChan)
-	for i := 0; i < structLib.Size(); i++ {
-		close(fpChans[i])
-	}
-	wgSeqFragments.Wait()
-
-	// Finally, add the sequence fragments to a new sequence fragment
-	// library and save.
-	profs := make([]*seq.Profile, structLib.Size())
-	for i := 0; i < structLib.Size(); i++ {
-		profs[i] = freqProfiles[i].Profile(nullProfile)
-	}
-	lib, err := fragbag.NewSequenceProfile(structLib.Name(), profs)
-	util.Assert(err)
-	util.Assert(fragbag.Save(saveto, lib))
-}
-
-// structureToSequence uses structural fragments to categorize a segment
-// of alpha-carbon atoms, and adds the corresponding residues to a
-// corresponding sequence fragment.
-func structureToSequence(
-	lib fragbag.StructureLibrary,
-	chain *pdb.Chain,
-	nullChan chan seq.Sequence,
-	seqChans []chan seq.Sequence,
-) {
-	sequence := chain.AsSequence()
-	fragSize := lib.FragmentSize()
-
-	// If the chain is shorter than the fragment size, we can do nothing
-	// with it.
-	if sequence.Len() < fragSize {
-		util.Verbosef("Sequence '%s' is too short (length: %d)",
-			sequence.Name, sequence.Len())
-		return
-	}
-
-	// If we're accumulating a null model, add this sequence to it.
-	if nullChan != nil {
-		nullChan <- sequence
-	}
-
-	// This bit of trickery here is all about getting the call to
-	// SequenceCaAtoms outside of the loop. In particular, it's a very
-	// expensive call since it has to reconcile inconsistencies between
-	// SEQRES and ATOM records in PDB files.
-	limit := sequence.Len() - fragSize
-	atoms := chain.SequenceCaAtoms()
-	atomSlice := make([]structure.Coords, fragSize)
-	noGaps := func(atoms []*structure.Coords) []structure.Coords {
-		for i, atom := range atoms {
-			if atom == nil {
-				return nil
-			}
-			atomSlice[i] = *atom
-		}
-		return atomSlice
-	}
-	for start := 0; start <= limit; start++ {
-		end := start + fragSize
-		cas := noGaps(atoms[start:end])
-		if cas == nil {
-			// Nothing contiguous was found (a "disordered" residue perhaps).
-			// So skip this part of the chain.
-			continue
-		}
-		bestFrag := lib.BestStructureFragment(atomSlice)
-
-		sliced := sequence.Slice(start, end)
-		seqChans[bestFrag] <- sliced
-	}
-}
-
-func addToProfile(sequences chan seq.Sequence, fp *seq.FrequencyProfile) {
-	wgSeqFragments.Add(1)
-	go func() {
-		for s := range sequences {
-			fp.Add(s)
-		}
-		wgSeqFragments.Done()
-	}()
-}
-
-func addToNull() (chan seq.Sequence, *seq.FrequencyProfile) {
-	nullChan := make(chan seq.Sequence, 100)
-	nullProfile := seq.NewNullProfile()
-
-	wgSeqFragments.Add(1)
-	go func() {
-		for s := range nullChan {
-			for i := 0; i < s.Len(); i++ {
-				nullProfile.Add(s.Slice(i, i+1))
-			}
-		}
-		wgSeqFragments.Done()
-	}()
-	return nullChan, nullProfile
 }
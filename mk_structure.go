@@ -1,16 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"flag"
-	"fmt"
 	"io/ioutil"
 	path "path/filepath"
 	"strings"
 
 	"github.com/ndaniels/esfragbag"
-	"github.com/TuftsBCB/io/pdb"
-	"github.com/TuftsBCB/structure"
+	"github.com/ndaniels/flib/build"
 	"github.com/ndaniels/tools/util"
 )
 
@@ -38,36 +35,12 @@ func mkStructure(c *command) {
 	brkContents, err := ioutil.ReadAll(util.OpenFile(c.flags.Arg(0)))
 	util.Assert(err)
 
-	pdbFragments := bytes.Split(brkContents, []byte("TER"))
-	fragments := make([][]structure.Coords, 0)
-	for i, pdbFrag := range pdbFragments {
-		pdbFrag = bytes.TrimSpace(pdbFrag)
-		if len(pdbFrag) == 0 {
-			continue
-		}
-		fragments = append(fragments, coords(i, pdbFrag))
-	}
-
 	libName := stripExt(path.Base(brkFile))
-	lib, err := fragbag.NewStructureAtoms(libName, fragments)
+	lib, err := build.StructureLibrary(libName, brkContents)
 	util.Assert(err)
 	fragbag.Save(util.CreateFile(saveto), lib)
 }
 
-func coords(num int, atomRecords []byte) []structure.Coords {
-	r := bytes.NewReader(atomRecords)
-	name := fmt.Sprintf("fragment %d", num)
-
-	entry, err := pdb.Read(r, name)
-	util.Assert(err, "Fragment contents could not be read in PDB format")
-
-	atoms := entry.OneChain().CaAtoms()
-	if len(atoms) == 0 {
-		util.Fatalf("Fragment %d has no ATOM coordinates.", num)
-	}
-	return atoms
-}
-
 func stripExt(s string) string {
 	return strings.TrimSuffix(s, path.Ext(s))
 }
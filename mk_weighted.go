@@ -2,9 +2,10 @@ package main
 
 import (
 	"flag"
-	"math"
 
 	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/flib/build"
 	"github.com/ndaniels/tools/util"
 )
 
@@ -22,7 +23,8 @@ new fragment library with those weights embedded in its representation.
 The 'train-frag-lib' is the library to use to compute BOWs for the given
 bower files. The bower files correspond to the document corpus to train
 on. Namely, it should be representative of the space you are searching.
-Bower files may either be PDB files or FASTA files.
+Bower files may be PDB, mmCIF or FASTA files (optionally compressed with
+gzip).
 
 The 'in-frag-lib' is the unweighted library with which to add weights.
 The file given is not modified.
@@ -40,56 +42,77 @@ you could use this command (with the PDB Select 25 acting as the
 representative of the document space):
 
     pdbs-chains pdb25-file
-	  | xargs flib weighted structure.json sequence.json sequence-weighted.json
-`,
+	  | flib mk-weighted structure.json sequence.json sequence-weighted.json -
+
+Reading the bower files from stdin (with '-') or from a file (with '-list')
+is preferable to using xargs, since xargs may split a large list of bower
+files into several invocations that each see only part of the corpus.
+` + bowerFilesHelp + checkpointHelp,
 	flags: flag.NewFlagSet("mk-weighted", flag.ExitOnError),
 	run:   mkWeighted,
 	addFlags: func(c *command) {
 		c.setOverwriteFlag()
+		c.setBowerListFlag()
+		c.setErrorsFlag()
+		c.setCheckpointFlags()
 		c.flags.StringVar(&flagWeightedScheme, "scheme", flagWeightedScheme,
 			"The weight scheme to use. Currently, only 'tfidf' is supported.")
 	},
 }
 
 func mkWeighted(c *command) {
-	c.assertLeastNArg(4)
+	c.assertLeastNArg(3)
 
 	train := util.Library(c.flags.Arg(0))
 	in := util.Library(c.flags.Arg(1))
 	outPath := c.flags.Arg(2)
-	bowPaths := c.flags.Args()[3:]
+	bowSpecs := c.bowerSpecs(3, true)
 
-	util.AssertOverwritable(outPath, flagOverwrite)
+	cp := c.checkpoint(3, bowSpecs)
+	if !flagResume {
+		util.AssertOverwritable(outPath, flagOverwrite)
+	}
 
-	// The inverse-document-frequencies of each fragment in the "in" fragment
-	// library.
-	numFrags := in.Size()
-	idfs := make([]float32, numFrags)
-	for i := range idfs {
-		idfs[i] = 1 // pseudocount
+	// The number of bowers that each fragment in the "in" fragment library
+	// occurred in.
+	df := build.NewDocFreqs(in.Size())
+	if cp.load(df) && len(df.Counts) != in.Size() {
+		util.Fatalf("The checkpoint has %d fragments, but '%s' has %d.",
+			len(df.Counts), in.Name(), in.Size())
 	}
 
 	// Compute the BOWs for each bower against the training fragment lib.
-	bows := util.ProcessBowers(bowPaths, train, false, flagCpu, util.FlagQuiet)
-
-	// Now tally the number of bowers that each fragment occurred in.
-	totalBows := float32(1) // for pseudocount correction
-	for bow := range bows {
-		totalBows += 1
-		for fragi := 0; fragi < numFrags; fragi++ {
-			if bow.Bow.Freqs[fragi] > 0 {
-				idfs[fragi]++
+	ctx := commandContext()
+	processed := processSpecBowers(ctx, cp.remaining(bowSpecs),
+		train, false, flagBowOpts, util.FlagQuiet)
+
+	// Now tally the number of bowers that each fragment occurred in, saving
+	// a checkpoint after each bower file that was read completely.
+	docs := make(chan build.Docs)
+	go func() {
+		defer close(docs)
+		for sb := range processed {
+			sb := sb
+			d := build.Docs{Bows: make([]bow.Bow, len(sb.bows))}
+			for i, b := range sb.bows {
+				d.Bows[i] = b.Bow
+			}
+			d.Counted = func() {
+				if sb.err == nil && cp.inputDone(sb.spec) {
+					cp.save(df)
+				}
+			}
+			select {
+			case docs <- d:
+			case <-ctx.Done():
 			}
 		}
-	}
-
-	// Compute the IDF using the frequencies against all the BOWs.
-	for i := range idfs {
-		idfs[i] = float32(math.Log(float64(totalBows / idfs[i])))
-	}
+	}()
 
 	// Finally, wrap the given library as a weighted library and save it.
-	wlib, err := fragbag.NewWeightedTfIdf(in, idfs)
+	wlib, err := build.TfIdf(ctx, in, df, docs)
+	exitIfCancelled(func() { cp.interrupt(df) })
 	util.Assert(err)
 	fragbag.Save(util.CreateFile(outPath), wlib)
+	cp.finish()
 }
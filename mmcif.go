@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The pdb package only reads PDB formatted files, so mmCIF files are read by
+// converting the parts of them we care about (the header, SEQRES, missing
+// residues and coordinates) to PDB records.
+//
+// PDB records only have room for single character chain identifiers, so
+// longer mmCIF chain names are mapped to unused characters. The mapping is
+// returned so that the original chain names can be used in BOW identifiers.
+
+// cifTable is a single mmCIF category (e.g., '_atom_site'), which is either
+// a loop with many rows or a list of key-value pairs with one row.
+type cifTable struct {
+	cols map[string]int
+	rows [][]string
+}
+
+// get returns the value of the column in the row given, or "" if the column
+// does not exist or has an unknown ('?') or inapplicable ('.') value.
+func (t *cifTable) get(row []string, col string) string {
+	i, ok := t.cols[col]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	if v := row[i]; v != "?" && v != "." {
+		return v
+	}
+	return ""
+}
+
+// first is like get, but tries each column given in order and returns the
+// first value found.
+func (t *cifTable) first(row []string, cols ...string) string {
+	for _, col := range cols {
+		if v := t.get(row, col); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// readCif reads every category in the first data block of an mmCIF file.
+func readCif(r io.Reader) (map[string]*cifTable, error) {
+	tokens, err := cifTokens(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string]*cifTable)
+	table := func(name string) *cifTable {
+		if tables[name] == nil {
+			tables[name] = &cifTable{cols: make(map[string]int)}
+		}
+		return tables[name]
+	}
+	splitTag := func(tag string) (string, string) {
+		if i := strings.Index(tag, "."); i > -1 {
+			return tag[:i], tag[i+1:]
+		}
+		return tag, ""
+	}
+
+	seenData := false
+	for i := 0; i < len(tokens); {
+		tok := tokens[i]
+		lower := strings.ToLower(tok.val)
+		switch {
+		case !tok.quoted && strings.HasPrefix(lower, "data_"):
+			if seenData {
+				return tables, nil
+			}
+			seenData = true
+			i++
+		case !tok.quoted && lower == "loop_":
+			i++
+			var cat string
+			var ncols int
+			for ; i < len(tokens) && isCifTag(tokens[i]); i++ {
+				c, col := splitTag(tokens[i].val)
+				cat = c
+				table(cat).cols[col] = ncols
+				ncols++
+			}
+			if ncols == 0 {
+				return nil, fmt.Errorf("mmCIF loop without any columns")
+			}
+			t := table(cat)
+			for i < len(tokens) && !isCifKeyword(tokens[i]) {
+				if i+ncols > len(tokens) {
+					return nil, fmt.Errorf("Incomplete row in mmCIF loop %s", cat)
+				}
+				row := make([]string, ncols)
+				for j := range row {
+					row[j] = tokens[i+j].val
+				}
+				t.rows = append(t.rows, row)
+				i += ncols
+			}
+		case isCifTag(tok):
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("mmCIF item %s has no value", tok.val)
+			}
+			cat, col := splitTag(tok.val)
+			t := table(cat)
+			if len(t.rows) == 0 {
+				t.rows = append(t.rows, nil)
+			}
+			t.cols[col] = len(t.rows[0])
+			t.rows[0] = append(t.rows[0], tokens[i+1].val)
+			i += 2
+		default:
+			// Global blocks, save frames, etc. aren't used in PDB files.
+			i++
+		}
+	}
+	if !seenData {
+		return nil, fmt.Errorf("No data block found in mmCIF file")
+	}
+	return tables, nil
+}
+
+type cifToken struct {
+	val    string
+	quoted bool
+}
+
+func isCifTag(tok cifToken) bool {
+	return !tok.quoted && strings.HasPrefix(tok.val, "_")
+}
+
+func isCifKeyword(tok cifToken) bool {
+	if tok.quoted {
+		return false
+	}
+	lower := strings.ToLower(tok.val)
+	return strings.HasPrefix(lower, "_") ||
+		strings.HasPrefix(lower, "data_") ||
+		strings.HasPrefix(lower, "save_") ||
+		lower == "loop_" || lower == "global_" || lower == "stop_"
+}
+
+// cifTokens splits an mmCIF file into its values, handling quoted strings,
+// comments and multi-line text fields.
+func cifTokens(r io.Reader) ([]cifToken, error) {
+	var tokens []cifToken
+	var text []string
+	inText := false
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inText {
+			if strings.HasPrefix(line, ";") {
+				tokens = append(tokens,
+					cifToken{strings.Join(text, "\n"), true})
+				inText, text = false, nil
+				line = line[1:]
+			} else {
+				text = append(text, line)
+				continue
+			}
+		} else if strings.HasPrefix(line, ";") {
+			inText, text = true, []string{line[1:]}
+			continue
+		}
+
+		for i := 0; i < len(line); {
+			c := line[i]
+			switch {
+			case c == ' ' || c == '\t':
+				i++
+			case c == '#':
+				i = len(line)
+			case c == '\'' || c == '"':
+				// A quote only ends a value when followed by whitespace.
+				end := i + 1
+				for ; end < len(line); end++ {
+					if line[end] == c &&
+						(end+1 == len(line) || line[end+1] == ' ' ||
+							line[end+1] == '\t') {
+						break
+					}
+				}
+				if end >= len(line) {
+					return nil, fmt.Errorf("Unterminated quote in mmCIF "+
+						"line: %s", line)
+				}
+				tokens = append(tokens, cifToken{line[i+1 : end], true})
+				i = end + 1
+			default:
+				end := i
+				for end < len(line) && line[end] != ' ' && line[end] != '\t' {
+					end++
+				}
+				tokens = append(tokens, cifToken{line[i:end], false})
+				i = end
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if inText {
+		return nil, fmt.Errorf("Unterminated text field in mmCIF file")
+	}
+	return tokens, nil
+}
+
+// cifToPDB converts the mmCIF file given to PDB records. The map returned
+// contains the original chain name of every chain identifier whose name
+// could not be used as is.
+func cifToPDB(r io.Reader) ([]byte, map[byte]string, error) {
+	tables, err := readCif(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	atoms := tables["_atom_site"]
+	if atoms == nil || len(atoms.rows) == 0 {
+		return nil, nil, fmt.Errorf("mmCIF file has no atom coordinates")
+	}
+	polySeq := tables["_pdbx_poly_seq_scheme"]
+
+	// Author chain names are used since they are the ones that appear in
+	// PDB files.
+	atomChain := func(row []string) string {
+		return atoms.first(row, "auth_asym_id", "label_asym_id")
+	}
+	var names []string
+	for _, row := range atoms.rows {
+		names = append(names, atomChain(row))
+	}
+	if polySeq != nil {
+		for _, row := range polySeq.rows {
+			names = append(names, polySeq.first(row, "pdb_strand_id", "asym_id"))
+		}
+	}
+	idents, renamed, err := cifChainIdents(names)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	w := func(format string, v ...interface{}) {
+		fmt.Fprintf(buf, format+"\n", v...)
+	}
+
+	var idCode, classification string
+	if t := tables["_entry"]; t != nil && len(t.rows) > 0 {
+		idCode = t.get(t.rows[0], "id")
+	}
+	if t := tables["_struct_keywords"]; t != nil && len(t.rows) > 0 {
+		classification = t.get(t.rows[0], "pdbx_keywords")
+	}
+	w("HEADER    %-40.40s%-9s   %-4.4s", classification, "", idCode)
+
+	// Missing residues and the full sequence of each chain come from the
+	// poly_seq_scheme table when it's available. Otherwise, the sequence is
+	// taken from the residues with coordinates.
+	var chainOrder []byte
+	seqres := make(map[byte][]string)
+	type missing struct {
+		chain   byte
+		name    string
+		num     int
+		insCode byte
+	}
+	var missings []missing
+	if polySeq != nil {
+		for _, row := range polySeq.rows {
+			ident := idents[polySeq.first(row, "pdb_strand_id", "asym_id")]
+			if _, ok := seqres[ident]; !ok {
+				chainOrder = append(chainOrder, ident)
+			}
+			name := cifResName(polySeq.get(row, "mon_id"))
+			seqres[ident] = append(seqres[ident], name)
+
+			if len(polySeq.get(row, "pdb_mon_id")) > 0 {
+				continue
+			}
+			numStr := polySeq.first(row, "pdb_seq_num", "seq_id")
+			num, err := strconv.Atoi(numStr)
+			if err != nil {
+				continue
+			}
+			missings = append(missings, missing{
+				ident, name, num, cifInsCode(polySeq.get(row, "pdb_ins_code")),
+			})
+		}
+	} else {
+		type resKey struct {
+			chain byte
+			seq   string
+		}
+		seen := make(map[resKey]bool)
+		firstModel := atoms.get(atoms.rows[0], "pdbx_PDB_model_num")
+		for _, row := range atoms.rows {
+			if atoms.get(row, "group_PDB") != "ATOM" {
+				continue
+			}
+			if atoms.get(row, "pdbx_PDB_model_num") != firstModel {
+				break
+			}
+			ident := idents[atomChain(row)]
+			key := resKey{ident, atoms.first(row, "auth_seq_id",
+				"label_seq_id") + atoms.get(row, "pdbx_PDB_ins_code")}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if _, ok := seqres[ident]; !ok {
+				chainOrder = append(chainOrder, ident)
+			}
+			seqres[ident] = append(seqres[ident], cifResName(
+				atoms.first(row, "auth_comp_id", "label_comp_id")))
+		}
+	}
+
+	if len(missings) > 0 {
+		w("REMARK 465")
+		w("REMARK 465 MISSING RESIDUES")
+		w("REMARK 465 THE FOLLOWING RESIDUES WERE NOT LOCATED IN THE")
+		w("REMARK 465 EXPERIMENT. (M=MODEL NUMBER; RES=RESIDUE NAME; C=CHAIN")
+		w("REMARK 465 IDENTIFIER; SSSEQ=SEQUENCE NUMBER; I=INSERTION CODE.)")
+		w("REMARK 465")
+		w("REMARK 465   M RES C SSSEQI")
+		for _, m := range missings {
+			w("REMARK 465     %3s %s %5d%c",
+				m.name, []byte{m.chain}, m.num, m.insCode)
+		}
+	}
+	for _, ident := range chainOrder {
+		residues := seqres[ident]
+		for i := 0; i*13 < len(residues); i++ {
+			end := (i + 1) * 13
+			if end > len(residues) {
+				end = len(residues)
+			}
+			w("SEQRES %3d %s %4d  %s", i+1, []byte{ident}, len(residues),
+				seqresRow(residues[i*13:end]))
+		}
+	}
+
+	// Now write the coordinates, separated into models if there are more
+	// than one.
+	models := make(map[string]bool)
+	for _, row := range atoms.rows {
+		models[atoms.get(row, "pdbx_PDB_model_num")] = true
+	}
+	multiModel := len(models) > 1
+	model, lastChain := "", byte(0)
+	for i, row := range atoms.rows {
+		group := atoms.get(row, "group_PDB")
+		if len(group) == 0 {
+			group = "ATOM"
+		}
+		ident := idents[atomChain(row)]
+		if m := atoms.get(row, "pdbx_PDB_model_num"); i == 0 || m != model {
+			if multiModel {
+				if i > 0 {
+					w("TER")
+					w("ENDMDL")
+				}
+				num, _ := strconv.Atoi(m)
+				w("MODEL     %4d", num)
+			}
+			model, lastChain = m, ident
+		} else if ident != lastChain {
+			w("TER")
+			lastChain = ident
+		}
+
+		name := atoms.first(row, "auth_atom_id", "label_atom_id")
+		element := atoms.get(row, "type_symbol")
+		if len(name) < 4 && len(element) < 2 {
+			name = " " + name
+		}
+		seqNum, _ := strconv.Atoi(atoms.first(row, "auth_seq_id", "label_seq_id"))
+		x, _ := strconv.ParseFloat(atoms.get(row, "Cartn_x"), 64)
+		y, _ := strconv.ParseFloat(atoms.get(row, "Cartn_y"), 64)
+		z, _ := strconv.ParseFloat(atoms.get(row, "Cartn_z"), 64)
+		occ, err := strconv.ParseFloat(atoms.get(row, "occupancy"), 64)
+		if err != nil {
+			occ = 1
+		}
+		bfactor, _ := strconv.ParseFloat(atoms.get(row, "B_iso_or_equiv"), 64)
+		w("%-6s%5d %-4s%c%3s %s%4d%c   %8.3f%8.3f%8.3f%6.2f%6.2f          %2s",
+			group, (i+1)%100000, name, cifInsCode(atoms.get(row, "label_alt_id")),
+			cifResName(atoms.first(row, "auth_comp_id", "label_comp_id")),
+			[]byte{ident},
+			seqNum,
+			cifInsCode(atoms.get(row, "pdbx_PDB_ins_code")),
+			x, y, z, occ, bfactor, element)
+	}
+	w("TER")
+	if multiModel {
+		w("ENDMDL")
+	}
+	w("END")
+	return buf.Bytes(), renamed, nil
+}
+
+// cifChainIdents assigns a single character chain identifier to every chain
+// name given. Single character names are used as is. Every other name is
+// assigned an identifier that isn't used by any other chain, and is included
+// in the second map returned.
+func cifChainIdents(names []string) (map[string]byte, map[byte]string, error) {
+	idents := make(map[string]byte)
+	used := make(map[byte]bool)
+	var long []string
+	for _, name := range names {
+		if _, ok := idents[name]; ok {
+			continue
+		}
+		if len(name) == 1 {
+			idents[name] = name[0]
+			used[name[0]] = true
+		} else {
+			idents[name] = 0 // assigned below
+			long = append(long, name)
+		}
+	}
+	sort.Strings(long)
+
+	renamed := make(map[byte]string)
+	free := cifFreeIdents(used)
+	if len(long) > len(free) {
+		return nil, nil, fmt.Errorf("Too many chains in mmCIF file "+
+			"(%d, but at most %d are supported)",
+			len(idents), len(idents)-len(long)+len(free))
+	}
+	for i, name := range long {
+		idents[name] = free[i]
+		renamed[free[i]] = name
+	}
+	return idents, renamed, nil
+}
+
+// cifFreeIdents returns every chain identifier not used, in order of
+// preference: letters and digits, then other printable characters and
+// finally bytes outside of ASCII.
+func cifFreeIdents(used map[byte]bool) []byte {
+	var free []byte
+	add := func(from, to byte) {
+		for b := int(from); b <= int(to); b++ {
+			if !used[byte(b)] && strings.IndexByte(" '\"", byte(b)) == -1 {
+				free = append(free, byte(b))
+			}
+		}
+	}
+	add('A', 'Z')
+	add('a', 'z')
+	add('0', '9')
+	add('!', '/')
+	add(':', '@')
+	add('[', '`')
+	add('{', '~')
+	add(0x80, 0xff)
+	return free
+}
+
+// cifResName returns the residue name used in PDB records, which only have
+// room for three characters. Longer names (from the extended chemical
+// component dictionary) are truncated.
+func cifResName(name string) string {
+	if len(name) > 3 {
+		return name[:3]
+	}
+	return name
+}
+
+// seqresRow returns the residue names of a SEQRES record, each right
+// justified in a column of three characters (e.g., "  A" for adenine).
+func seqresRow(names []string) string {
+	cols := make([]string, len(names))
+	for i, name := range names {
+		cols[i] = fmt.Sprintf("%3s", name)
+	}
+	return strings.Join(cols, " ")
+}
+
+// cifInsCode returns the single character used for an insertion code or
+// alternate location in PDB records.
+func cifInsCode(s string) byte {
+	if len(s) == 0 {
+		return ' '
+	}
+	return s[0]
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/TuftsBCB/io/pdb"
+)
+
+// testCif has two chains: 'A', with four residues of which the third is
+// missing, and 'AB', whose name is too long for PDB records. Chain 'A' also
+// has a ligand with a five character name.
+const testCif = `data_1ABC
+_entry.id 1ABC
+_struct_keywords.pdbx_keywords 'TEST PROTEIN'
+loop_
+_pdbx_poly_seq_scheme.asym_id
+_pdbx_poly_seq_scheme.seq_id
+_pdbx_poly_seq_scheme.mon_id
+_pdbx_poly_seq_scheme.pdb_seq_num
+_pdbx_poly_seq_scheme.pdb_mon_id
+_pdbx_poly_seq_scheme.pdb_strand_id
+_pdbx_poly_seq_scheme.pdb_ins_code
+A 1 MET 1 MET A .
+A 2 ALA 2 ALA A .
+A 3 GLY 3 ? A .
+A 4 SER 4 SER A .
+B 1 ALA 1 ALA AB .
+B 2 TRP 2 TRP AB .
+loop_
+_atom_site.group_PDB
+_atom_site.id
+_atom_site.type_symbol
+_atom_site.label_atom_id
+_atom_site.label_alt_id
+_atom_site.label_comp_id
+_atom_site.label_asym_id
+_atom_site.label_seq_id
+_atom_site.pdbx_PDB_ins_code
+_atom_site.Cartn_x
+_atom_site.Cartn_y
+_atom_site.Cartn_z
+_atom_site.occupancy
+_atom_site.B_iso_or_equiv
+_atom_site.auth_seq_id
+_atom_site.auth_comp_id
+_atom_site.auth_asym_id
+_atom_site.auth_atom_id
+_atom_site.pdbx_PDB_model_num
+ATOM   1 C CA . MET A 1 ? 1.000 2.000 3.000 1.00 10.00 1 MET A CA 1
+ATOM   2 C CA . ALA A 2 ? 4.500 5.000 6.000 1.00 11.00 2 ALA A CA 1
+ATOM   3 C CA . SER A 4 ? -7.125 8.000 9.000 0.50 12.00 4 SER A CA 1
+HETATM 4 C C1 . A1AB2 C . ? 0.000 0.000 0.000 1.00 20.00 101 A1AB2 A C1 1
+ATOM   5 C CA . ALA B 1 ? 10.000 11.000 12.000 1.00 13.00 1 ALA AB CA 1
+ATOM   6 C CA . TRP B 2 ? 13.000 14.000 15.000 1.00 14.00 2 TRP AB CA 1
+`
+
+// TestCifToPDBColumns checks that every field of the coordinate records
+// is in the column that PDB files use.
+func TestCifToPDBColumns(t *testing.T) {
+	records, renamed, err := cifToPDB(strings.NewReader(testCif))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renamed) != 1 {
+		t.Fatalf("Expected one renamed chain, but got %v.", renamed)
+	}
+	var ab byte
+	for ident, name := range renamed {
+		if name != "AB" {
+			t.Fatalf("Expected chain 'AB' to be renamed, but got '%s'.", name)
+		}
+		ab = ident
+	}
+	if ab == 'A' {
+		t.Fatalf("Chain 'AB' was given the identifier of chain 'A'.")
+	}
+
+	tests := []struct {
+		name  string
+		chain byte
+		num   int
+		x     float64
+	}{
+		{"MET", 'A', 1, 1},
+		{"ALA", 'A', 2, 4.5},
+		{"SER", 'A', 4, -7.125},
+		{"A1A", 'A', 101, 0},
+		{"ALA", ab, 1, 10},
+		{"TRP", ab, 2, 13},
+	}
+	var coords []string
+	var sawMissing, sawSeqres bool
+	for _, line := range strings.Split(string(records), "\n") {
+		switch {
+		case strings.HasPrefix(line, "ATOM"), strings.HasPrefix(line, "HETATM"):
+			coords = append(coords, line)
+		case strings.HasPrefix(line, "REMARK 465     GLY A     3"):
+			sawMissing = true
+		case strings.HasPrefix(line, "SEQRES   1 A    4  MET ALA GLY SER"):
+			sawSeqres = true
+		}
+	}
+	if !sawMissing {
+		t.Errorf("Missing residue GLY A 3 not in REMARK 465:\n%s", records)
+	}
+	if !sawSeqres {
+		t.Errorf("SEQRES of chain A not found:\n%s", records)
+	}
+	if len(coords) != len(tests) {
+		t.Fatalf("Expected %d coordinate records, but got %d:\n%s",
+			len(tests), len(coords), records)
+	}
+	for i, test := range tests {
+		line := coords[i]
+		if len(line) < 78 {
+			t.Errorf("Record %d is too short: '%s'", i, line)
+			continue
+		}
+		if got := line[17:20]; got != test.name {
+			t.Errorf("Record %d: residue name '%s', expected '%s'.",
+				i, got, test.name)
+		}
+		if got := line[21]; got != test.chain {
+			t.Errorf("Record %d: chain '%c', expected '%c'.", i, got, test.chain)
+		}
+		num, err := strconv.Atoi(strings.TrimSpace(line[22:26]))
+		if err != nil || num != test.num {
+			t.Errorf("Record %d: residue number '%s', expected %d.",
+				i, line[22:26], test.num)
+		}
+		x, err := strconv.ParseFloat(strings.TrimSpace(line[30:38]), 64)
+		if err != nil || x != test.x {
+			t.Errorf("Record %d: x coordinate '%s', expected %g.",
+				i, line[30:38], test.x)
+		}
+		if got := strings.TrimSpace(line[12:16]); got != "CA" && got != "C1" {
+			t.Errorf("Record %d: atom name '%s'.", i, got)
+		}
+	}
+}
+
+// TestCifToPDBRead checks that the records of an mmCIF file are read by the
+// pdb package as they would be from the equivalent PDB file.
+func TestCifToPDBRead(t *testing.T) {
+	records, renamed, err := cifToPDB(strings.NewReader(testCif))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := pdb.Read(bytes.NewReader(records), "1abc.cif")
+	if err != nil {
+		t.Fatalf("Could not read converted records: %s\n%s", err, records)
+	}
+	if entry.IdCode != "1ABC" {
+		t.Errorf("Expected id code '1ABC', but got '%s'.", entry.IdCode)
+	}
+
+	chains := make(map[string]*pdb.Chain)
+	for _, chain := range entry.Chains {
+		name := string(chain.Ident)
+		if orig, ok := renamed[chain.Ident]; ok {
+			name = orig
+		}
+		chains[name] = chain
+	}
+	tests := []struct {
+		chain    string
+		sequence string
+		xs       []float64 // NaN for missing residues
+	}{
+		{"A", "MAGS", []float64{1, 4.5, math.NaN(), -7.125}},
+		{"AB", "AW", []float64{10, 13}},
+	}
+	for _, test := range tests {
+		chain := chains[test.chain]
+		if chain == nil {
+			t.Errorf("Chain '%s' not found.", test.chain)
+			continue
+		}
+		var got []byte
+		for _, r := range chain.AsSequence().Residues {
+			got = append(got, byte(r))
+		}
+		if string(got) != test.sequence {
+			t.Errorf("Chain '%s': sequence '%s', expected '%s'.",
+				test.chain, got, test.sequence)
+		}
+		atoms := chain.SequenceCaAtoms()
+		if len(atoms) != len(test.xs) {
+			t.Errorf("Chain '%s': %d residues with atoms, expected %d.",
+				test.chain, len(atoms), len(test.xs))
+			continue
+		}
+		for i, x := range test.xs {
+			switch {
+			case math.IsNaN(x) && atoms[i] != nil:
+				t.Errorf("Chain '%s': residue %d should be missing.",
+					test.chain, i+1)
+			case !math.IsNaN(x) && (atoms[i] == nil || atoms[i].X != x):
+				t.Errorf("Chain '%s': residue %d has CA %v, expected x=%g.",
+					test.chain, i+1, atoms[i], x)
+			}
+		}
+	}
+}
+
+// TestSeqresRow checks that residue names shorter than three characters,
+// such as those of nucleotides, are right justified in SEQRES records.
+func TestSeqresRow(t *testing.T) {
+	got := seqresRow([]string{"A", "DG", "MET"})
+	if expected := "  A  DG MET"; got != expected {
+		t.Errorf("Got '%s', expected '%s'.", got, expected)
+	}
+}
@@ -9,8 +9,6 @@ import (
 	"github.com/ndaniels/tools/util"
 )
 
-var flagPairdistModels = false
-
 var cmdPairdist = &command{
 	name:            "pairdist",
 	positionalUsage: "frag-lib bower-file [ bower-file ... ]",
@@ -19,30 +17,31 @@ var cmdPairdist = &command{
 The pairdist command returns the cosine distance between every pair of
 Fragbag frequency vectors produced by the given bower files.
 
-Bower files may either be PDB files or FASTA files.
-`,
+Bower files may be PDB, mmCIF or FASTA files. Files ending with '.gz' are
+decompressed automatically.
+` + bowerFilesHelp,
 	flags: flag.NewFlagSet("pairdist", flag.ExitOnError),
 	run:   pairdist,
 	addFlags: func(c *command) {
-		c.flags.BoolVar(&flagPairdistModels, "models", flagPairdistModels,
-			"When set, the models for each bower file given (if a PDB file)\n"+
-				"will be used. Otherwise, the first the model from each\n"+
-				"chain specified will be used.")
+		c.setModelsFlag()
+		c.setBowerListFlag()
+		c.setErrorsFlag()
 	},
 }
 
 func pairdist(c *command) {
-	c.assertLeastNArg(2)
+	c.assertLeastNArg(1)
 	flib := util.Library(c.flags.Arg(0))
-	bowPaths := c.flags.Args()[1:]
+	bowSpecs := c.bowerSpecs(1, true)
 
+	ctx := commandContext()
 	bows := make([]bow.Bowed, 0, 1000)
-	results := util.ProcessBowers(bowPaths, flib, flagPairdistModels,
-		flagCpu, util.FlagQuiet)
+	results := processBowers(ctx, bowSpecs, flib, flagModels,
+		flagBowOpts, util.FlagQuiet)
 	for r := range results {
 		bows = append(bows, r)
 	}
-	for i := 0; i < len(bows); i++ {
+	for i := 0; i < len(bows) && ctx.Err() == nil; i++ {
 		b1 := bows[i]
 		for j := i + 1; j < len(bows); j++ {
 			b2 := bows[j]
@@ -50,4 +49,5 @@ func pairdist(c *command) {
 			fmt.Printf("%s\t%s\t%0.4f\n", b1.Id, b2.Id, dist)
 		}
 	}
+	exitIfCancelled(nil)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/TuftsBCB/io/pdb"
+	"github.com/ndaniels/tools/util"
+)
+
+// structFile is a PDB entry read from a PDB or mmCIF file, possibly
+// compressed with gzip.
+type structFile struct {
+	path   string
+	entry  *pdb.Entry
+	chains []*pdb.Chain
+
+	// chainNames maps chain identifiers to the chain names used in the file
+	// when they differ. (mmCIF chain names may be longer than the single
+	// character allowed by the pdb package.)
+	chainNames map[byte]string
+}
+
+// pdbOpen reads a PDB entry from a PDB or mmCIF file. Files ending with
+// '.gz' are decompressed transparently. Uncompressed PDB files are read with
+// util.PDBOpen so that they are handled exactly as before.
+func pdbOpen(fpath string) (*structFile, error) {
+	lower := strings.ToLower(fpath)
+	isGzip := strings.HasSuffix(lower, ".gz")
+	if !isGzip && !isCif(fpath) {
+		entry, chains, err := util.PDBOpen(fpath)
+		if err != nil {
+			return nil, err
+		}
+		return &structFile{path: fpath, entry: entry, chains: chains}, nil
+	}
+
+	records, chainNames, err := readRecords(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return newStructFile(fpath, records, chainNames)
+}
+
+// newStructFile reads the PDB records given. Only protein chains are kept.
+func newStructFile(
+	fpath string,
+	records []byte,
+	chainNames map[byte]string,
+) (*structFile, error) {
+	entry, err := pdb.Read(bytes.NewReader(records), fpath)
+	if err != nil {
+		return nil, err
+	}
+	sf := &structFile{path: fpath, entry: entry, chainNames: chainNames}
+	for _, chain := range entry.Chains {
+		if chain.IsProtein() {
+			sf.chains = append(sf.chains, chain)
+		}
+	}
+	return sf, nil
+}
+
+// openInput opens the file at the path given for reading. If the path ends
+// with '.gz', the file is decompressed while it is read.
+func openInput(fpath string) (io.ReadCloser, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(strings.ToLower(fpath), ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not decompress '%s': %s", fpath, err)
+	}
+	return gzipFile{gz, f}, nil
+}
+
+// gzipFile closes both the decompressor and the underlying file.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (gf gzipFile) Close() error {
+	gf.Reader.Close()
+	return gf.f.Close()
+}
+
+// idCode returns the lower case PDB identifier of the entry, or the name of
+// its file if the entry doesn't have an identifier.
+func (sf *structFile) idCode() string {
+	if idCode := strings.ToLower(strings.TrimSpace(sf.entry.IdCode)); len(idCode) > 0 {
+		return idCode
+	}
+	return fileId(sf.path)
+}
+
+// chainName returns the name of the chain as it appears in the file.
+func (sf *structFile) chainName(chain *pdb.Chain) string {
+	if name, ok := sf.chainNames[chain.Ident]; ok {
+		return name
+	}
+	return string(chain.Ident)
+}
+
+// chainId returns the identifier used for BOWs of the chain given. It is the
+// PDB identifier followed by the chain name.
+func (sf *structFile) chainId(chain *pdb.Chain) string {
+	return sf.idCode() + sf.chainName(chain)
+}
+
+// isCif returns true if the path has an mmCIF file extension.
+func isCif(fpath string) bool {
+	fpath = strings.TrimSuffix(strings.ToLower(fpath), ".gz")
+	switch path.Ext(fpath) {
+	case ".cif", ".mmcif":
+		return true
+	}
+	return false
+}
+
+// fileId returns the base name of the path given without any extensions
+// (e.g., '1abc' for '/data/1abc.cif.gz').
+func fileId(fpath string) string {
+	base := path.Base(fpath)
+	if strings.HasSuffix(strings.ToLower(base), ".gz") {
+		base = base[:len(base)-3]
+	}
+	return stripExt(base)
+}
@@ -0,0 +1,57 @@
+// Package query searches BOW databases created by flib. It is the library
+// behind the flib search commands, so that other programs can search BOW
+// databases without running flib.
+//
+// Functions in this package return errors instead of exiting. Functions that
+// may run for a long time accept a context, and stop early with the context's
+// error when it is cancelled.
+package query
+
+import (
+	"sort"
+
+	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/esfragbag/bowdb"
+)
+
+// LibraryTag returns the tag of the library given followed by the tags of
+// all of its sub-libraries.
+func LibraryTag(lib fragbag.Library) []string {
+	if sub := lib.SubLibrary(); sub == nil {
+		return []string{lib.Tag()}
+	} else {
+		return append([]string{lib.Tag()}, LibraryTag(sub)...)
+	}
+}
+
+// SortDist returns the distance of a search result that it is sorted by.
+func SortDist(opts bowdb.SearchOptions, r bowdb.SearchResult) float64 {
+	if opts.SortBy == bowdb.SortByEuclid {
+		return r.Euclid
+	}
+	return r.Cosine
+}
+
+// SortResults sorts search results by the field and in the order given by
+// the search options.
+func SortResults(opts bowdb.SearchOptions, results []bowdb.SearchResult) {
+	sort.Stable(resultsSorter{opts, results})
+}
+
+type resultsSorter struct {
+	opts    bowdb.SearchOptions
+	results []bowdb.SearchResult
+}
+
+func (rs resultsSorter) Len() int { return len(rs.results) }
+func (rs resultsSorter) Swap(i, j int) {
+	rs.results[i], rs.results[j] = rs.results[j], rs.results[i]
+}
+func (rs resultsSorter) Less(i, j int) bool {
+	di := SortDist(rs.opts, rs.results[i])
+	dj := SortDist(rs.opts, rs.results[j])
+	if rs.opts.Order == bowdb.OrderDesc {
+		return di > dj
+	}
+	return di < dj
+}
@@ -0,0 +1,548 @@
+package query
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/esfragbag/bowdb"
+)
+
+// A Searcher compares a block of queries with every BOW in a database at
+// once. The norm of every BOW in the database is computed once, so that
+// comparing a query with a BOW is a single dot product. BOWs are processed in
+// tiles small enough to stay in cache while every query in the block is
+// compared with them. With a dense columnar file (see 'flib bowdb-columns'),
+// the BOWs are one contiguous matrix in memory.
+//
+// Distances computed from dot products and norms may differ from those of
+// bow.Bow in the last few bits, so they are only used to pick the results.
+// The distances reported are computed again with bow.Bow, and are checked
+// against the minimum and maximum distances again.
+
+const (
+	// The number of database rows compared with each query in a block before
+	// moving on to the next tile. 64 rows of 600 fragments fit in 160KB.
+	batchRowTile = 64
+
+	// The error allowed in distances computed from dot products when they are
+	// compared with the minimum and maximum distances.
+	batchSlack = 1e-5
+)
+
+// Searcher searches a Store for a block of queries at a time. It is safe to
+// use from multiple goroutines.
+type Searcher struct {
+	store Store
+	rows  [][]float32
+	norms []float32
+
+	// The positions of the BOWs sorted by norm. Use normOrder.
+	byNorm     []int32
+	byNormOnce sync.Once
+}
+
+// Neighbor is a BOW found by Searcher.Nearest: its position in the store and
+// its approximate distance from the query.
+type Neighbor struct {
+	Index int
+	Dist  float64
+}
+
+// NewSearcher prepares the BOWs in the store given for batched searches. The
+// BOWs of a store that allocates a new vector for each BOW (e.g., a sparse
+// columnar file) are expanded into memory.
+func NewSearcher(store Store) *Searcher {
+	s := &Searcher{
+		store: store,
+		rows:  make([][]float32, store.Len()),
+		norms: make([]float32, store.Len()),
+	}
+	ns, hasNorms := store.(NormStore)
+	for i := range s.rows {
+		s.rows[i] = store.Freqs(i)
+		if hasNorms {
+			s.norms[i] = ns.Norm(i)
+		} else {
+			s.norms[i] = Norm(s.rows[i])
+		}
+	}
+	return s
+}
+
+// Store returns the store searched.
+func (s *Searcher) Store() Store {
+	return s.store
+}
+
+// Rows returns the frequency vector of every BOW in the store, by position.
+// The vectors must not be modified.
+func (s *Searcher) Rows() [][]float32 {
+	return s.rows
+}
+
+// Norms returns the Euclidean norm of every BOW in the store, by position.
+// The norms must not be modified.
+func (s *Searcher) Norms() []float32 {
+	return s.norms
+}
+
+// Search returns the results of searching for each of the queries given.
+// The results are the same as those of bowdb.DB.Search. Only the best
+// opts.Limit results of each query are kept while searching. If the context
+// is cancelled, its error is returned.
+func (s *Searcher) Search(
+	ctx context.Context,
+	opts bowdb.SearchOptions,
+	queries []bow.Bowed,
+) ([][]bowdb.SearchResult, error) {
+	best, err := s.searchTop(ctx, opts, queries)
+	if err != nil {
+		return nil, err
+	}
+	results := make([][]bowdb.SearchResult, len(queries))
+	for qi, q := range queries {
+		results[qi] = best[qi].results(s.store, opts, q)
+	}
+	return results, nil
+}
+
+// Nearest returns the best results of each of the queries given, like
+// Search, but without computing their exact distances. The neighbors of each
+// query are in no particular order, and results that tie with the worst one
+// kept may be left out. If the context is cancelled, its error is returned.
+func (s *Searcher) Nearest(
+	ctx context.Context,
+	opts bowdb.SearchOptions,
+	queries []bow.Bowed,
+) ([][]Neighbor, error) {
+	best, err := s.searchTop(ctx, opts, queries)
+	if err != nil {
+		return nil, err
+	}
+	neighbors := make([][]Neighbor, len(queries))
+	for qi, top := range best {
+		neighbors[qi] = make([]Neighbor, len(top.items))
+		for i, item := range top.items {
+			neighbors[qi][i] = Neighbor{item.index, item.dist}
+		}
+	}
+	return neighbors, nil
+}
+
+// searchTop returns the best results found for each of the queries given by
+// their positions in the store. Their distances are approximate.
+func (s *Searcher) searchTop(
+	ctx context.Context,
+	opts bowdb.SearchOptions,
+	queries []bow.Bowed,
+) ([]*topK, error) {
+	if err := s.checkQueries(queries); err != nil {
+		return nil, err
+	}
+	best := make([]*topK, len(queries))
+	for qi := range queries {
+		best[qi] = newTopK(opts)
+	}
+	if opts.SortBy == bowdb.SortByEuclid && opts.Order == bowdb.OrderAsc {
+		for qi, q := range queries {
+			if err := s.scanByNorm(ctx, opts, q, best[qi]); err != nil {
+				return nil, err
+			}
+		}
+		return best, nil
+	}
+	err := s.scan(ctx, opts, queries, func(qi, r int, dist float64) {
+		best[qi].add(r, dist)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return best, nil
+}
+
+// SearchStream searches for each of the queries given without a limit on the
+// number of results. Results are given to emit as they are found, in no
+// particular order, a tile of the database at a time. If the context is
+// cancelled, its error is returned and emit isn't called again.
+func (s *Searcher) SearchStream(
+	ctx context.Context,
+	opts bowdb.SearchOptions,
+	queries []bow.Bowed,
+	emit func(query bow.Bowed, results []bowdb.SearchResult),
+) error {
+	if err := s.checkQueries(queries); err != nil {
+		return err
+	}
+	found := make([][]bowdb.SearchResult, len(queries))
+	return s.scan(ctx, opts, queries, func(qi, r int, dist float64) {
+		if dist < opts.Min-batchSlack || dist > opts.Max+batchSlack {
+			return
+		}
+		q, b := queries[qi], Bowed(s.store, r)
+		res := bowdb.SearchResult{
+			Bowed:  b,
+			Cosine: q.Bow.Cosine(b.Bow),
+			Euclid: q.Bow.Euclid(b.Bow),
+		}
+		if d := SortDist(opts, res); d >= opts.Min && d <= opts.Max {
+			found[qi] = append(found[qi], res)
+		}
+	}, func() {
+		for qi, q := range queries {
+			if len(found[qi]) > 0 {
+				emit(q, found[qi])
+				found[qi] = nil
+			}
+		}
+	})
+}
+
+// Dist returns the distance between the BOWs at positions i and j, computed
+// from their dot product and norms, by the field given.
+func (s *Searcher) Dist(sortBy bowdb.SortByType, i, j int) float64 {
+	if i == j {
+		return 0
+	}
+	opts := bowdb.SearchOptions{SortBy: sortBy}
+	d := Dot(s.rows[i], s.rows[j])
+	return batchDist(opts, s.norms[i], s.norms[j], d)
+}
+
+// checkQueries returns an error if a query doesn't have the same number of
+// fragments as the BOWs searched.
+func (s *Searcher) checkQueries(queries []bow.Bowed) error {
+	if len(s.rows) == 0 {
+		return nil
+	}
+	return checkQueries(len(s.rows[0]), queries)
+}
+
+func checkQueries(dim int, queries []bow.Bowed) error {
+	for _, q := range queries {
+		if len(q.Bow.Freqs) != dim {
+			return fmt.Errorf("The BOW of query '%s' has %d fragments, but "+
+				"the BOWs searched have %d.", q.Id, len(q.Bow.Freqs), dim)
+		}
+	}
+	return nil
+}
+
+// scan calls visit with the approximate distance of every pair of a query
+// and a BOW in the database that the minimum and maximum distances haven't
+// ruled out. If tileDone is not nil, it is called after each tile. The
+// context is checked before each tile.
+//
+// When sorting by Euclidean distance, the difference and the sum of the
+// norms of two BOWs bound the distance between them, so pairs outside of the
+// minimum and maximum distances are skipped without computing a dot product.
+func (s *Searcher) scan(
+	ctx context.Context,
+	opts bowdb.SearchOptions,
+	queries []bow.Bowed,
+	visit func(qi, r int, dist float64),
+	tileDone func(),
+) error {
+	n := len(s.rows)
+	qnorms := make([]float32, len(queries))
+	for qi, q := range queries {
+		qnorms[qi] = Norm(q.Bow.Freqs)
+	}
+	euclid := opts.SortBy == bowdb.SortByEuclid
+	lo, hi := opts.Min-batchSlack, opts.Max+batchSlack
+	for r0 := 0; r0 < n; r0 += batchRowTile {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r1 := r0 + batchRowTile
+		if r1 > n {
+			r1 = n
+		}
+		for qi, q := range queries {
+			qfreqs, qnorm := q.Bow.Freqs, qnorms[qi]
+			for r := r0; r < r1; r++ {
+				if euclid {
+					n1, n2 := float64(qnorm), float64(s.norms[r])
+					if math.Abs(n1-n2) > hi || n1+n2 < lo {
+						continue
+					}
+				}
+				d := Dot(qfreqs, s.rows[r])
+				visit(qi, r, batchDist(opts, qnorm, s.norms[r], d))
+			}
+		}
+		if tileDone != nil {
+			tileDone()
+		}
+	}
+	return nil
+}
+
+// scanByNorm finds the closest BOWs to the query by Euclidean distance. BOWs
+// are visited in order of how close their norm is to the norm of the query,
+// which is a lower bound on their distance. The scan stops as soon as that
+// bound exceeds the maximum distance or the distance of the worst result
+// kept. The context is checked after every tile's worth of BOWs.
+func (s *Searcher) scanByNorm(
+	ctx context.Context,
+	opts bowdb.SearchOptions,
+	query bow.Bowed,
+	top *topK,
+) error {
+	byNorm := s.normOrder()
+	qnorm := Norm(query.Bow.Freqs)
+	n := len(byNorm)
+	hi := sort.Search(n, func(i int) bool {
+		return s.norms[byNorm[i]] >= qnorm
+	})
+	lo := hi - 1
+	for visited := 0; lo >= 0 || hi < n; visited++ {
+		if visited%batchRowTile == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		var r int32
+		var bound float64
+		if hi >= n || (lo >= 0 &&
+			qnorm-s.norms[byNorm[lo]] <= s.norms[byNorm[hi]]-qnorm) {
+			r, bound = byNorm[lo], float64(qnorm-s.norms[byNorm[lo]])
+			lo--
+		} else {
+			r, bound = byNorm[hi], float64(s.norms[byNorm[hi]]-qnorm)
+			hi++
+		}
+		if bound > top.bound()+batchSlack {
+			break
+		}
+		d := Dot(query.Bow.Freqs, s.rows[r])
+		top.add(int(r), batchDist(opts, qnorm, s.norms[r], d))
+	}
+	return nil
+}
+
+// normOrder returns the positions of the BOWs in the database sorted by their
+// norms. It is computed the first time it is needed.
+func (s *Searcher) normOrder() []int32 {
+	s.byNormOnce.Do(func() {
+		s.byNorm = make([]int32, len(s.rows))
+		for i := range s.byNorm {
+			s.byNorm[i] = int32(i)
+		}
+		sort.Sort(byNorm{s.byNorm, s.norms})
+	})
+	return s.byNorm
+}
+
+type byNorm struct {
+	points []int32
+	norms  []float32
+}
+
+func (bn byNorm) Len() int { return len(bn.points) }
+func (bn byNorm) Less(i, j int) bool {
+	return bn.norms[bn.points[i]] < bn.norms[bn.points[j]]
+}
+func (bn byNorm) Swap(i, j int) {
+	bn.points[i], bn.points[j] = bn.points[j], bn.points[i]
+}
+
+// batchDist returns the distance used to sort results given the norms of two
+// BOWs and their dot product.
+func batchDist(opts bowdb.SearchOptions, norm1, norm2, dot float32) float64 {
+	n1, n2, d := float64(norm1), float64(norm2), float64(dot)
+	if opts.SortBy == bowdb.SortByEuclid {
+		return math.Sqrt(math.Max(0, n1*n1+n2*n2-2*d))
+	}
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+	return math.Max(0, 1-d/(n1*n2))
+}
+
+// SearchStore compares each query with every BOW in the store given, and
+// returns the results of each query with the same options and in the same
+// order as bowdb.DB.Search. Unlike a Searcher, it doesn't keep anything in
+// memory besides the best opts.Limit results of a query. The context is
+// checked before each query, and its error is returned if it is cancelled.
+func SearchStore(
+	ctx context.Context,
+	store Store,
+	opts bowdb.SearchOptions,
+	queries []bow.Bowed,
+) ([][]bowdb.SearchResult, error) {
+	if store.Len() > 0 {
+		if err := checkQueries(len(store.Freqs(0)), queries); err != nil {
+			return nil, err
+		}
+	}
+	all := make([][]bowdb.SearchResult, len(queries))
+	for qi, q := range queries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		top := newTopK(opts)
+		for i := 0; i < store.Len(); i++ {
+			b := Bowed(store, i)
+			if opts.SortBy == bowdb.SortByEuclid {
+				top.add(i, q.Bow.Euclid(b.Bow))
+			} else {
+				top.add(i, q.Bow.Cosine(b.Bow))
+			}
+		}
+		all[qi] = top.results(store, opts, q)
+	}
+	return all, nil
+}
+
+// topK keeps the best search results seen so far for a query. The worst
+// result kept is at the root of the heap, so it can be replaced quickly.
+type topK struct {
+	opts  bowdb.SearchOptions
+	items []topKItem
+
+	// Results that weren't kept, but whose distance is within the error of
+	// approximate distances of the worst result kept (see add).
+	near []topKItem
+}
+
+type topKItem struct {
+	index int
+	dist  float64
+}
+
+func newTopK(opts bowdb.SearchOptions) *topK {
+	return &topK{opts: opts}
+}
+
+// add considers the BOW at position i with the distance given.
+func (h *topK) add(i int, dist float64) {
+	if dist < h.opts.Min-batchSlack || dist > h.opts.Max+batchSlack ||
+		h.opts.Limit == 0 {
+		return
+	}
+	item := topKItem{i, dist}
+	if h.opts.Limit < 0 || len(h.items) < h.opts.Limit {
+		heap.Push(h, item)
+		return
+	}
+
+	// Results with the same distance may have approximate distances that
+	// differ slightly, so results that could tie with the worst result kept
+	// are set aside. Which of them are returned is decided by results, with
+	// exact distances.
+	if worst := h.items[0]; h.worse(worst, item) {
+		h.items[0] = item
+		heap.Fix(h, 0)
+		item = worst
+	}
+	if h.isNear(item) {
+		h.near = append(h.near, item)
+		if len(h.near) > 2*h.opts.Limit+batchRowTile {
+			h.pruneNear()
+		}
+	}
+}
+
+// isNear returns true if the result given may tie with the worst result
+// kept.
+func (h *topK) isNear(item topKItem) bool {
+	if h.opts.Order == bowdb.OrderDesc {
+		return item.dist >= h.items[0].dist-batchSlack
+	}
+	return item.dist <= h.items[0].dist+batchSlack
+}
+
+// pruneNear removes the results set aside that can no longer tie with the
+// worst result kept.
+func (h *topK) pruneNear() {
+	near := h.near[:0]
+	for _, item := range h.near {
+		if h.isNear(item) {
+			near = append(near, item)
+		}
+	}
+	h.near = near
+}
+
+// bound returns the largest distance that a result may have to be kept.
+func (h *topK) bound() float64 {
+	if h.opts.Order == bowdb.OrderAsc && h.opts.Limit >= 0 &&
+		len(h.items) == h.opts.Limit && len(h.items) > 0 {
+		return math.Min(h.opts.Max, h.items[0].dist)
+	}
+	return h.opts.Max
+}
+
+// worse returns true if a should be ranked after b. Ties are broken by
+// position in the database, like the stable sort of bowdb.DB.Search.
+func (h *topK) worse(a, b topKItem) bool {
+	if a.dist == b.dist {
+		return a.index > b.index
+	}
+	if h.opts.Order == bowdb.OrderDesc {
+		return a.dist < b.dist
+	}
+	return a.dist > b.dist
+}
+
+// results returns the results kept for the query given in sorted order. No
+// results may be added afterwards.
+func (h *topK) results(
+	store Store,
+	opts bowdb.SearchOptions,
+	q bow.Bowed,
+) []bowdb.SearchResult {
+	items := h.items
+	if len(h.near) > 0 {
+		h.pruneNear()
+		items = append(items, h.near...)
+	}
+
+	// Results are sorted stably, so they must start in database order for
+	// ties to be ranked as bowdb.DB.Search does.
+	sort.Sort(topKByIndex(items))
+	results := make([]bowdb.SearchResult, 0, len(items))
+	for _, item := range items {
+		b := Bowed(store, item.index)
+		r := bowdb.SearchResult{
+			Bowed:  b,
+			Cosine: q.Bow.Cosine(b.Bow),
+			Euclid: q.Bow.Euclid(b.Bow),
+		}
+		if d := SortDist(opts, r); d >= opts.Min && d <= opts.Max {
+			results = append(results, r)
+		}
+	}
+	SortResults(opts, results)
+	if opts.Limit >= 0 && len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+	return results
+}
+
+type topKByIndex []topKItem
+
+func (items topKByIndex) Len() int { return len(items) }
+func (items topKByIndex) Less(i, j int) bool {
+	return items[i].index < items[j].index
+}
+func (items topKByIndex) Swap(i, j int) {
+	items[i], items[j] = items[j], items[i]
+}
+
+func (h *topK) Len() int           { return len(h.items) }
+func (h *topK) Less(i, j int) bool { return h.worse(h.items[i], h.items[j]) }
+func (h *topK) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+func (h *topK) Push(x interface{}) { h.items = append(h.items, x.(topKItem)) }
+func (h *topK) Pop() interface{} {
+	x := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return x
+}
@@ -0,0 +1,278 @@
+package query
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/esfragbag/bowdb"
+)
+
+// testEntries returns n random sparse BOWs with dim fragments. Every fourth
+// BOW is a copy of the one before it, so that searches have ties.
+func testEntries(rng *rand.Rand, n, dim int) Entries {
+	entries := make(Entries, n)
+	for i := range entries {
+		freqs := make([]float32, dim)
+		if i%4 == 3 {
+			copy(freqs, entries[i-1].Bow.Freqs)
+		} else {
+			for j := 0; j < dim/4; j++ {
+				freqs[rng.Intn(dim)] += float32(1 + rng.Intn(5))
+			}
+		}
+		entries[i] = bow.Bowed{
+			Id:  "e" + strconv.Itoa(i),
+			Bow: bow.Bow{Freqs: freqs},
+		}
+	}
+	return entries
+}
+
+// linearSearch compares each query with every BOW given, in the same way as
+// bowdb.DB.Search.
+func linearSearch(
+	entries Entries,
+	opts bowdb.SearchOptions,
+	queries []bow.Bowed,
+) [][]bowdb.SearchResult {
+	all := make([][]bowdb.SearchResult, len(queries))
+	for qi, q := range queries {
+		var results []bowdb.SearchResult
+		for _, b := range entries {
+			r := bowdb.SearchResult{
+				Bowed:  b,
+				Cosine: q.Bow.Cosine(b.Bow),
+				Euclid: q.Bow.Euclid(b.Bow),
+			}
+			if d := SortDist(opts, r); d >= opts.Min && d <= opts.Max {
+				results = append(results, r)
+			}
+		}
+		SortResults(opts, results)
+		if opts.Limit >= 0 && len(results) > opts.Limit {
+			results = results[:opts.Limit]
+		}
+		all[qi] = results
+	}
+	return all
+}
+
+// testSearchOpts are the search options that the searches are checked with.
+// They cover the general scan and the scan by norm (Euclidean distance in
+// ascending order), with and without limits and distance bounds.
+func testSearchOpts() map[string]bowdb.SearchOptions {
+	opts := make(map[string]bowdb.SearchOptions)
+	add := func(name string, limit int, min, max float64,
+		sortBy bowdb.SortByType, order bowdb.OrderType) {
+		o := bowdb.SearchDefault
+		o.Limit, o.Min, o.Max, o.SortBy, o.Order = limit, min, max, sortBy, order
+		opts[name] = o
+	}
+	add("cosine", 10, 0, 1, bowdb.SortByCosine, bowdb.OrderAsc)
+	add("cosine-desc", 5, 0, 1, bowdb.SortByCosine, bowdb.OrderDesc)
+	add("cosine-range", -1, 0.2, 0.6, bowdb.SortByCosine, bowdb.OrderAsc)
+	add("cosine-none", 0, 0, 1, bowdb.SortByCosine, bowdb.OrderAsc)
+	add("euclid", 10, 0, 1e9, bowdb.SortByEuclid, bowdb.OrderAsc)
+	add("euclid-desc", 7, 0, 1e9, bowdb.SortByEuclid, bowdb.OrderDesc)
+	add("euclid-max", -1, 0, 15, bowdb.SortByEuclid, bowdb.OrderAsc)
+	return opts
+}
+
+// checkSameResults fails the test if two lists of search results don't have
+// the same entries in the same order with the same distances.
+func checkSameResults(
+	t *testing.T,
+	name string,
+	got, expected []bowdb.SearchResult,
+) {
+	if len(got) != len(expected) {
+		t.Errorf("%s: %d results, expected %d.", name, len(got), len(expected))
+		return
+	}
+	for i := range got {
+		g, e := got[i], expected[i]
+		if g.Bowed.Id != e.Bowed.Id ||
+			g.Cosine != e.Cosine || g.Euclid != e.Euclid {
+			t.Errorf("%s: result %d is %s (cosine %g, euclid %g), expected "+
+				"%s (cosine %g, euclid %g).", name, i,
+				g.Bowed.Id, g.Cosine, g.Euclid, e.Bowed.Id, e.Cosine, e.Euclid)
+			return
+		}
+	}
+}
+
+// TestSearch checks that a Searcher and SearchStore return the same results
+// as comparing each query with every BOW, including the order of ties.
+func TestSearch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	entries := testEntries(rng, 500, 40)
+	queries := append(testEntries(rng, 20, 40), entries[:20]...)
+	s := NewSearcher(entries)
+	ctx := context.Background()
+
+	for name, opts := range testSearchOpts() {
+		expected := linearSearch(entries, opts, queries)
+		got, err := s.Search(ctx, opts, queries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		linear, err := SearchStore(ctx, entries, opts, queries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for qi := range queries {
+			checkSameResults(t, name+"/batch/"+queries[qi].Id,
+				got[qi], expected[qi])
+			checkSameResults(t, name+"/store/"+queries[qi].Id,
+				linear[qi], expected[qi])
+		}
+	}
+}
+
+// TestSearchErrors checks that searches stop with the context's error when
+// it is cancelled, and that queries with the wrong number of fragments are
+// rejected.
+func TestSearchErrors(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	entries := testEntries(rng, 100, 20)
+	s := NewSearcher(entries)
+	emit := func(bow.Bowed, []bowdb.SearchResult) {
+		t.Errorf("Results were emitted after the search was cancelled.")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, opts := range testSearchOpts() {
+		if _, err := s.Search(ctx, opts, entries[:5]); err != ctx.Err() {
+			t.Errorf("%s: got error %v, expected %v.", name, err, ctx.Err())
+		}
+		if _, err := SearchStore(ctx, entries, opts, entries[:5]); err !=
+			ctx.Err() {
+			t.Errorf("%s/store: got error %v, expected %v.",
+				name, err, ctx.Err())
+		}
+		if err := s.SearchStream(ctx, opts, entries[:5], emit); err !=
+			ctx.Err() {
+			t.Errorf("%s/stream: got error %v, expected %v.",
+				name, err, ctx.Err())
+		}
+	}
+
+	wrong := testEntries(rng, 1, 30)
+	_, err := s.Search(context.Background(), bowdb.SearchDefault, wrong)
+	if err == nil {
+		t.Errorf("Expected an error for a query with 30 fragments.")
+	}
+}
+
+// TestTopKTies checks that results with the same distance are kept and
+// ranked by their position in the database, whatever the order they are
+// added in.
+func TestTopKTies(t *testing.T) {
+	opts := bowdb.SearchDefault
+	opts.Limit = 3
+	top := newTopK(opts)
+	for _, i := range []int{7, 2, 9, 4, 1, 8} {
+		dist := 0.5
+		if i == 9 {
+			dist = 0.25
+		}
+		top.add(i, dist)
+	}
+	expected := map[int]bool{9: true, 1: true, 2: true}
+	if len(top.items) != len(expected) {
+		t.Fatalf("Kept %d results, expected %d.",
+			len(top.items), len(expected))
+	}
+	for _, item := range top.items {
+		if !expected[item.index] {
+			t.Errorf("Kept %d, but expected %v.", item.index, expected)
+		}
+	}
+}
+
+// The database searched by the benchmarks: 10,000 BOWs of a 400 fragment
+// library. It is only built when a benchmark is run (see benchDb).
+var (
+	benchEntries     Entries
+	benchEntriesOnce sync.Once
+)
+
+// benchDb returns the database searched by the benchmarks, building it the
+// first time, and resets the benchmark's timer.
+func benchDb(b *testing.B) Entries {
+	benchEntriesOnce.Do(func() {
+		benchEntries = testEntries(rand.New(rand.NewSource(3)), 10000, 400)
+	})
+	b.ResetTimer()
+	return benchEntries
+}
+
+// BenchmarkSearchLinear searches for 64 queries by comparing each with every
+// BOW, as bowdb.DB.Search does.
+func BenchmarkSearchLinear(b *testing.B) {
+	entries := benchDb(b)
+	queries := entries[:64]
+	for i := 0; i < b.N; i++ {
+		linearSearch(entries, bowdb.SearchDefault, queries)
+	}
+}
+
+// BenchmarkSearchBatch searches for the same 64 queries as a single block
+// with a Searcher.
+func BenchmarkSearchBatch(b *testing.B) {
+	entries := benchDb(b)
+	queries := entries[:64]
+	s := NewSearcher(entries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Search(context.Background(), bowdb.SearchDefault, queries)
+	}
+}
+
+// BenchmarkSearchBatchEuclid is like BenchmarkSearchBatch, but sorts by
+// Euclidean distance, which scans the database by norm.
+func BenchmarkSearchBatchEuclid(b *testing.B) {
+	entries := benchDb(b)
+	queries := entries[:64]
+	opts := bowdb.SearchDefault
+	opts.SortBy, opts.Max = bowdb.SortByEuclid, 1e9
+	s := NewSearcher(entries)
+	s.normOrder()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Search(context.Background(), opts, queries)
+	}
+}
+
+// BenchmarkDot computes the dot product of two BOWs of the benchmark
+// database.
+func BenchmarkDot(b *testing.B) {
+	entries := benchDb(b)
+	x, y := entries[0].Bow.Freqs, entries[1].Bow.Freqs
+	b.SetBytes(int64(8 * len(x)))
+	for i := 0; i < b.N; i++ {
+		Dot(x, y)
+	}
+}
+
+// BenchmarkTopK adds the distances of a query to every BOW of the benchmark
+// database to a topK with the default limit.
+func BenchmarkTopK(b *testing.B) {
+	rng := rand.New(rand.NewSource(4))
+	dists := make([]float64, len(benchDb(b)))
+	for i := range dists {
+		dists[i] = rng.Float64()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		top := newTopK(bowdb.SearchDefault)
+		for j, d := range dists {
+			top.add(j, d)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package query
+
+import (
+	"math"
+
+	"github.com/ndaniels/esfragbag/bow"
+)
+
+// Store is a read-only collection of the BOWs in a database, indexed by
+// their position in the database.
+type Store interface {
+	Len() int
+	Id(i int) string
+
+	// Freqs returns the frequency vector of the BOW at position i. The
+	// slice returned must not be modified.
+	Freqs(i int) []float32
+}
+
+// NormStore is a Store that already has the Euclidean norm of every BOW
+// (e.g., a columnar file written by 'flib bowdb-columns'), so that a Searcher
+// doesn't compute them.
+type NormStore interface {
+	Store
+	Norm(i int) float32
+}
+
+// Entries is a Store of BOWs in memory, such as those read with
+// bowdb.DB.ReadAll.
+type Entries []bow.Bowed
+
+func (es Entries) Len() int              { return len(es) }
+func (es Entries) Id(i int) string       { return es[i].Id }
+func (es Entries) Freqs(i int) []float32 { return es[i].Bow.Freqs }
+
+// Bowed returns the BOW at position i of the store given.
+func Bowed(store Store, i int) bow.Bowed {
+	if es, ok := store.(Entries); ok {
+		return es[i]
+	}
+	return bow.Bowed{Id: store.Id(i), Bow: bow.Bow{Freqs: store.Freqs(i)}}
+}
+
+// Norm returns the Euclidean norm of a frequency vector.
+func Norm(freqs []float32) float32 {
+	sum := 0.0
+	for _, f := range freqs {
+		sum += float64(f) * float64(f)
+	}
+	return float32(math.Sqrt(sum))
+}
+
+// Dot returns the dot product of two vectors of the same length. The loop is
+// unrolled with independent sums so that the compiler can keep several
+// multiplications in flight.
+func Dot(a, b []float32) float32 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return (s0 + s1) + (s2 + s3)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ndaniels/esfragbag/bow"
+)
+
+// readQueryVectors reads BOWs from the file at the path given ('-' is stdin).
+// Each line has an identifier followed by the BOW's frequencies, separated
+// by tabs. Frequencies are either dense, with one column for each fragment
+// in the library (the output of the vectors command), or sparse, with
+// 'index:frequency' pairs for the non-zero frequencies only (indices start
+// at 0). Sparse pairs may also be separated by spaces. Blank lines and lines
+// starting with '#' are ignored.
+//
+// Every BOW must have dim fragments.
+func readQueryVectors(fpath string, dim int) ([]bow.Bowed, error) {
+	var r io.Reader = os.Stdin
+	if fpath != "-" {
+		f, err := openInput(fpath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var bows []bow.Bowed
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(strings.TrimSpace(line)) == 0 || line[0] == '#' {
+			continue
+		}
+		b, err := parseQueryVector(line, dim)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of '%s': %s", lineNum, fpath, err)
+		}
+		bows = append(bows, b)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return bows, nil
+}
+
+func parseQueryVector(line string, dim int) (bow.Bowed, error) {
+	fields := strings.Split(line, "\t")
+	id := strings.TrimSpace(fields[0])
+	if len(id) == 0 {
+		return bow.Bowed{}, fmt.Errorf("missing identifier")
+	}
+	fields = fields[1:]
+
+	freqs := make([]float32, dim)
+	sparse := false
+	for _, field := range fields {
+		if strings.Contains(field, ":") {
+			sparse = true
+			break
+		}
+	}
+	if !sparse {
+		if len(fields) != dim {
+			return bow.Bowed{}, fmt.Errorf("'%s' has %d frequencies, but "+
+				"the fragment library has %d", id, len(fields), dim)
+		}
+		for i, field := range fields {
+			f, err := strconv.ParseFloat(strings.TrimSpace(field), 32)
+			if err != nil {
+				return bow.Bowed{}, fmt.Errorf("invalid frequency '%s'", field)
+			}
+			freqs[i] = float32(f)
+		}
+		return bow.Bowed{Id: id, Bow: bow.Bow{Freqs: freqs}}, nil
+	}
+
+	for _, pair := range strings.Fields(strings.Join(fields, " ")) {
+		pieces := strings.SplitN(pair, ":", 2)
+		if len(pieces) != 2 {
+			return bow.Bowed{}, fmt.Errorf("invalid sparse frequency '%s' "+
+				"(expected 'index:frequency')", pair)
+		}
+		i, err := strconv.Atoi(pieces[0])
+		if err != nil || i < 0 || i >= dim {
+			return bow.Bowed{}, fmt.Errorf("invalid fragment index '%s' "+
+				"(the fragment library has %d fragments)", pieces[0], dim)
+		}
+		f, err := strconv.ParseFloat(pieces[1], 32)
+		if err != nil {
+			return bow.Bowed{}, fmt.Errorf("invalid frequency '%s'", pieces[1])
+		}
+		freqs[i] = float32(f)
+	}
+	return bow.Bowed{Id: id, Bow: bow.Bow{Freqs: freqs}}, nil
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"text/tabwriter"
 
+	"github.com/ndaniels/esfragbag"
 	"github.com/ndaniels/esfragbag/bow"
 	"github.com/ndaniels/esfragbag/bowdb"
+	"github.com/ndaniels/flib/build"
+	"github.com/ndaniels/flib/query"
 	"github.com/ndaniels/tools/util"
 )
 
@@ -18,17 +23,112 @@ var (
 	flagSearchOutFmt = "plain"
 	flagSearchSort   = "cosine"
 	flagSearchDesc   = false
+	flagSearchEf     = 0
+	flagSearchBatch  = 32
+	flagSearchStream = false
+	flagSearchFuse   = ""
+	flagSearchDepth  = 0
+	flagSearchWeight = ""
+	flagSearchVecs   = ""
+	flagSearchById   = false
+	flagSearchIdFile = ""
+	flagSearchNoSelf = false
+	flagSearchRerank = ""
+	flagSearchRankK  = 100
+	flagSearchPdbDir = ""
+	flagSearchCols   = ""
 )
 
 var cmdSearch = &command{
 	name:            "search",
-	positionalUsage: "bowdb-path bower-file [ bower-file ... ]",
+	positionalUsage: "bowdb-path[,bowdb-path ...] [ bower-file ... ]",
 	shortHelp:       "search a BOW database",
 	help: `
 The search command searches the given BOW database for entries closest to the
 bower files given. The fragment library used to compute BOWs for the queries
 is the one contained inside the given BOW database.
-`,
+
+Several BOW databases can be searched at once by separating their paths with
+commas. The BOW of each query is computed once for every distinct fragment
+library among the databases, and the hits from all databases are merged
+into a single list for each query. The '-limit' flag applies to that list,
+and the database of each hit is shown. Queries are matched between
+libraries by their position among the queries given, and are written in
+that order. FASTA files are only searched in databases with sequence
+fragment libraries.
+
+With '-fuse', the hits of a query from every database are joined by their
+identifiers instead, which is useful for databases of the same chains built
+with structure and sequence libraries (see mk-seq-profile and mk-seq-hmm).
+Each hit is ranked by a score that combines its distances in each database:
+
+	sum   the weighted sum of its distances, where the distance of a hit
+	      missing from a database is the largest distance of the hits
+	      found in that database. Smaller scores are better.
+	rrf   reciprocal rank fusion: the sum of weight / (60 + rank) over the
+	      databases that found it. Larger scores are better.
+	min   the smallest of its distances. Smaller scores are better.
+
+The distances shown for a fused hit are from the database where it is
+closest to the query. Since FASTA files are only searched in sequence
+databases, their hits are ranked by the sequence databases alone.
+
+The top hits of each query can be re-ranked by structure with '-rerank
+structural'. The structure of the query is aligned with the structure of each
+of its top '-rerank-k' hits in the style of TM-align, and those hits are
+sorted by TM-score (normalized by the length of the query). The TM-score,
+the RMSD of the aligned residues and the number of residues aligned within
+5 angstroms are shown for each re-ranked hit. The structures of hits are read
+from the bower files stored in the database by mk-bowdb, or from the
+'-pdb-dir' directory, where files are looked up by PDB identifier (e.g.,
+'1abc.pdb', 'pdb1abc.ent.gz' or 'ab/pdb1abc.ent.gz').
+
+With '-rerank sequence', the sequence of the query is aligned with the
+sequence of each of its top hits instead, with the Smith-Waterman algorithm
+(BLOSUM62, with a gap of length n costing 11 + n). Those hits are sorted by
+alignment score, and the score, the fraction of identical residues in the
+alignment and the fraction of the query covered by the alignment are shown.
+The sequences of hits are read from the database if it was created with
+'mk-bowdb -sequences', and from their bower files otherwise.
+
+The provenance of each hit recorded by mk-bowdb (see view-bowdb) can be
+shown with '-columns', which takes a comma-separated list of 'source' (the
+bower file argument), 'chain', 'residues' and 'windows'. Values that the
+database doesn't have are shown as '-'.
+
+If the BOW database has an index built by the bowdb-index command, it is used
+automatically for searches that it supports.
+
+If the BOW database has been converted with the bowdb-columns command, then
+its BOWs are mapped into memory from the columnar file instead of being read
+from the database.
+
+Bower files may be PDB, mmCIF or FASTA files. Files ending with '.gz' are
+decompressed automatically.
+
+BOWs can also be used as queries directly with '-query-vectors', which reads
+a tab-separated file with an identifier followed by frequencies on each
+line. The frequencies may be dense, with one column for each fragment in
+the library (as written by the vectors command), or sparse, with
+'index:frequency' pairs for non-zero frequencies (indices start at 0). This
+allows searching with the centroid of a family, for example. Every BOW must
+have the same number of fragments as the library of the database. When
+searching several databases, they must all have the same fragment library.
+
+Entries of the database can be used as queries with '-by-id', in which case
+the arguments after the database are entry identifiers instead of bower
+files, or with '-by-id-file', which reads one identifier per line. The BOW
+stored for an entry is used as is. When searching several databases, each
+fragment library uses its own entry for an identifier. For example, to find
+the neighbors of two entries without the entries themselves:
+
+	flib search -by-id -exclude-self my.bowdb 1abcA 2xyzB
+
+If the BOW database was created with options that change how BOWs are
+computed (like '-assign-k' or '-max-rmsd'), then the same options are used
+for the queries. Those flags only need to be set when searching a database
+that was created by an older version of flib.
+` + domainsHelp + bowerFilesHelp,
 	flags: flag.NewFlagSet("search", flag.ExitOnError),
 	run:   search,
 	addFlags: func(c *command) {
@@ -50,11 +150,64 @@ is the one contained inside the given BOW database.
 				"Valid values are 'cosine' and 'euclid'.")
 		c.flags.BoolVar(&flagSearchDesc, "desc", flagSearchDesc,
 			"When set, results will be shown in descending order.")
+		c.flags.IntVar(&flagSearchEf, "ef", flagSearchEf,
+			"When the database has an index (see 'bowdb-index'), this is\n"+
+				"the maximum number of BOWs each query is compared with.\n"+
+				"Smaller values are faster but may miss some of the closest\n"+
+				"entries. When 0, searches with the index are exact.")
+		c.flags.IntVar(&flagSearchBatch, "batch", flagSearchBatch,
+			"The number of queries compared with the database together.\n"+
+				"When 0, each query is searched separately with the bowdb\n"+
+				"package.")
+		c.flags.BoolVar(&flagSearchStream, "stream", flagSearchStream,
+			"When set, hits are written as soon as they are found instead\n"+
+				"of being sorted. This requires '-limit -1' and\n"+
+				"'-outfmt csv', and uses little memory for huge result sets.")
+		c.flags.StringVar(&flagSearchFuse, "fuse", flagSearchFuse,
+			"When set, the hits of several databases are joined by their\n"+
+				"identifiers and ranked by a combined score. Valid values\n"+
+				"are 'sum', 'rrf' and 'min'.")
+		c.flags.IntVar(&flagSearchDepth, "fuse-depth", flagSearchDepth,
+			"The number of hits of each database that are fused. When 0,\n"+
+				"this is four times '-limit', and at least 100.")
+		c.flags.StringVar(&flagSearchWeight, "fuse-weights", flagSearchWeight,
+			"A comma-separated list of weights of each database for\n"+
+				"'-fuse sum' and '-fuse rrf'. By default, every database\n"+
+				"has a weight of 1.")
+		c.flags.StringVar(&flagSearchVecs, "query-vectors", flagSearchVecs,
+			"A file of BOWs to use as queries, in addition to any bower\n"+
+				"files given. Use '-' to read from stdin.")
+		c.flags.BoolVar(&flagSearchById, "by-id", flagSearchById,
+			"When set, the arguments after the database are identifiers\n"+
+				"of entries in the database to use as queries instead of\n"+
+				"bower files.")
+		c.flags.StringVar(&flagSearchIdFile, "by-id-file", flagSearchIdFile,
+			"A file with identifiers of entries in the database to use as\n"+
+				"queries, one per line. Use '-' to read from stdin.")
+		c.flags.BoolVar(&flagSearchNoSelf, "exclude-self", flagSearchNoSelf,
+			"When set, hits with the same identifier as the query are\n"+
+				"not shown.")
+		c.flags.StringVar(&flagSearchRerank, "rerank", flagSearchRerank,
+			"When set, the top hits are re-ranked by aligning them with\n"+
+				"the query. Valid values are 'structural' and 'sequence'.")
+		c.flags.IntVar(&flagSearchRankK, "rerank-k", flagSearchRankK,
+			"The number of top hits of each query that are re-ranked.")
+		c.flags.StringVar(&flagSearchCols, "columns", flagSearchCols,
+			"A comma-separated list of the provenance of hits to show:\n"+
+				"'source', 'chain', 'residues' and 'windows'.")
+		c.flags.StringVar(&flagSearchPdbDir, "pdb-dir", flagSearchPdbDir,
+			"A directory with the structures of hits, for databases that\n"+
+				"don't store the paths of their bower files or when the\n"+
+				"files have moved.")
+		c.setBowerListFlag()
+		c.setErrorsFlag()
+		c.setDomainsFlag()
+		c.setBowFlags()
 	},
 }
 
 func search(c *command) {
-	c.assertLeastNArg(2)
+	c.assertLeastNArg(1)
 
 	// Some search options don't translate directly to command line parameters
 	// specified by the flag package.
@@ -69,16 +222,370 @@ func search(c *command) {
 	default:
 		util.Fatalf("Unknown sort field '%s'.", flagSearchSort)
 	}
+	if flagSearchStream {
+		if flagSearchOpts.Limit >= 0 {
+			util.Fatalf("'-stream' requires '-limit -1'.")
+		}
+		if flagSearchOutFmt != "csv" {
+			util.Fatalf("'-stream' requires '-outfmt csv'.")
+		}
+		if flagSearchBatch <= 0 {
+			util.Fatalf("'-stream' cannot be used with '-batch 0'.")
+		}
+		if len(flagSearchFuse) > 0 {
+			util.Fatalf("'-stream' cannot be used with '-fuse'.")
+		}
+		if len(flagSearchRerank) > 0 {
+			util.Fatalf("'-stream' cannot be used with '-rerank'.")
+		}
+	}
 
-	db := util.OpenBowDB(c.flags.Arg(0))
-	bowPaths := c.flags.Args()[1:]
+	searchProvCols = searchProvColumns()
+	dbPaths := searchDbPaths(c.flags.Arg(0))
+	var bowSpecs []bowerSpec
+	var entryIds []string
+	if flagSearchById || len(flagSearchIdFile) > 0 {
+		entryIds = searchEntryIds(c)
+	} else {
+		bowSpecs = c.bowerSpecs(1, len(flagSearchVecs) == 0)
+	}
 
-	_, err := db.ReadAll()
-	util.Assert(err, "Could not read BOW database entries")
+	// With re-ranking, at least as many hits as are re-ranked are needed,
+	// but no more than the limit are shown.
+	showLimit := flagSearchOpts.Limit
+	if len(flagSearchRerank) > 0 && showLimit >= 0 &&
+		showLimit < flagSearchRankK {
+		flagSearchOpts.Limit = flagSearchRankK
+	}
+
+	// combine merges the hits of a query from every database. (The options
+	// are copied since the limit of each database may change below.)
+	combineOpts := flagSearchOpts
+	combine := func(hits []searchHit) []searchHit {
+		return limitHits(combineOpts, hits)
+	}
+	if len(flagSearchFuse) > 0 {
+		f := newHitFuser(dbPaths)
+		combine = f.fuse
+
+		// Each database is searched for more hits than will be shown, so
+		// that the hits of different databases overlap.
+		flagSearchOpts.Limit = f.depth
+	}
+	if flagSearchNoSelf && flagSearchOpts.Limit >= 0 {
+		// The query itself may take the place of a hit in each database.
+		flagSearchOpts.Limit++
+	}
+
+	// Queries are identified across libraries by their position among the
+	// queries given (see queryPos), and given counts the queries given
+	// before the bower files.
+	groups := searchGroups(c, dbPaths)
+	multi := len(dbPaths) > 1
+	given := 0
+	if len(flagSearchVecs) > 0 {
+		// The BOWs given can only be compared with BOWs computed with the
+		// same library. (Groups may also differ by BOW options, which don't
+		// matter here.)
+		for _, g := range groups[1:] {
+			if g.libJson != groups[0].libJson {
+				util.Fatalf("'-query-vectors' requires every database to "+
+					"have the same fragment library, but '%s' has library "+
+					"'%s' and '%s' has library '%s'.",
+					g.targets[0].path, g.lib.Name(),
+					groups[0].targets[0].path, groups[0].lib.Name())
+			}
+		}
+		vecs, err := readQueryVectors(flagSearchVecs, groups[0].lib.Size())
+		util.Assert(err, "Could not read query vectors")
+		for _, g := range groups {
+			for i, v := range vecs {
+				g.queries = append(g.queries,
+					searchQuery{Bowed: v, pos: queryPos{input: i}})
+			}
+		}
+		given += len(vecs)
+	}
+	if len(entryIds) > 0 {
+		// Each group searches with its own entry for an identifier, since
+		// the BOWs of different libraries can't be compared.
+		missing := make(map[string]int)
+		for _, g := range groups {
+			found, gmissing := g.entries(entryIds, given)
+			g.queries = append(g.queries, found...)
+			for _, id := range gmissing {
+				missing[id]++
+			}
+		}
+		for _, id := range entryIds {
+			if missing[id] == len(groups) {
+				util.Fatalf("There is no entry '%s' in any of the databases.",
+					id)
+			}
+		}
+		given += len(entryIds)
+	}
+	for _, g := range groups {
+		g.setSpecs(bowSpecs, given, multi)
+	}
+	var rr *reranker
+	if len(flagSearchRerank) > 0 {
+		rr = newReranker(groups)
+	}
+
+	// finish combines the hits of a query from every database and re-ranks
+	// them.
+	finish := func(sr searchResult) searchResult {
+		sr.hits = combine(excludeSelf(sr))
+		if rr != nil {
+			sr.hits = rr.rerank(sr)
+			if showLimit >= 0 && len(sr.hits) > showLimit {
+				sr.hits = sr.hits[:showLimit]
+			}
+		}
+		return sr
+	}
+	out, outDone := outputter(multi)
+
+	// When interrupted, the results of every query that was searched (by
+	// every library) are written before exiting.
+	ctx := commandContext()
+	if flagSearchStream {
+		for _, g := range groups {
+			g.search(ctx, func(sr searchResult) {
+				sr.hits = excludeSelf(sr)
+				out <- sr
+			})
+		}
+	} else if len(groups) == 1 {
+		groups[0].search(ctx, func(sr searchResult) {
+			out <- finish(sr)
+		})
+	} else {
+		// The results of a query with each library are only complete when
+		// every library has been searched. They are written in the order
+		// that the queries were given.
+		var lock sync.Mutex
+		merged := make(map[queryPos]*searchResult)
+		searched := make(map[queryPos]int) // the number of groups
+		for _, g := range groups {
+			g.search(ctx, func(sr searchResult) {
+				lock.Lock()
+				defer lock.Unlock()
+				searched[sr.pos]++
+				if m, ok := merged[sr.pos]; ok {
+					m.hits = append(m.hits, sr.hits...)
+					if m.bower == nil {
+						m.bower = sr.bower
+					}
+				} else {
+					merged[sr.pos] = &sr
+				}
+			})
+		}
+		// When interrupted, the queries that some group didn't finish are
+		// left out, since their hits from its databases are missing.
+		var order []queryPos
+		for pos := range merged {
+			if ctx.Err() != nil && searched[pos] < searchingGroups(groups, pos) {
+				continue
+			}
+			order = append(order, pos)
+		}
+		sort.Sort(queryPositions(order))
+		finished := make([]searchResult, len(order))
+		parallelRange(len(order), func(i int) {
+			finished[i] = finish(*merged[order[i]])
+		})
+		for _, sr := range finished {
+			out <- sr
+		}
+	}
+
+	close(out)
+	<-outDone
+	for _, g := range groups {
+		for _, t := range g.targets {
+			t.close()
+		}
+	}
+	exitIfCancelled(nil)
+}
+
+// searchDbPaths splits a comma-separated list of BOW database paths. A path
+// to a file that exists is never split.
+func searchDbPaths(arg string) []string {
+	if _, err := os.Stat(arg); err == nil {
+		return []string{arg}
+	}
+	var paths []string
+	for _, p := range strings.Split(arg, ",") {
+		if len(p) > 0 {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// searchTarget is a BOW database being searched.
+type searchTarget struct {
+	path      string
+	db        *bowdb.DB
+	searcher  searcher
+	batchSize int
+	cols      *colStore
+	store     query.Store
+
+	// The provenance of each entry, by identifier. It is only read when it
+	// is needed (see '-rerank' and '-columns').
+	entries map[string]*bowDbEntry
+}
+
+// openSearchTarget opens the BOW database given and picks the fastest way to
+// search it with flagSearchOpts.
+func openSearchTarget(dbPath string) *searchTarget {
+	db := util.OpenBowDB(dbPath)
+	t := &searchTarget{path: dbPath, db: db, searcher: dbSearcher{db},
+		batchSize: 1}
+	store := readBowStore(dbPath, db)
+	t.store = store
+	if cols, ok := store.(*colStore); ok {
+		t.cols, t.searcher = cols, storeSearcher{cols}
+	}
+	if flagSearchBatch > 0 {
+		t.searcher, t.batchSize = query.NewSearcher(store), flagSearchBatch
+	}
 
-	// always hide the progress bar here.
-	bows := util.ProcessBowers(bowPaths, db.Lib, false, flagCpu, true)
-	out, outDone := outputter()
+	tree, err := readVPTree(dbPath)
+	util.Assert(err)
+	if tree != nil {
+		fresh, err := tree.fresh(dbPath)
+		util.Assert(err)
+		if !fresh || tree.Size != store.Len() {
+			util.Verbosef("Ignoring out of date index in '%s' (the database "+
+				"changed after the index was built).", dbPath)
+		} else if tree.usable(flagSearchOpts) {
+			t.searcher = newVPSearcher(t.searcher, tree, store, flagSearchEf)
+			t.batchSize = 1
+		}
+	}
+	return t
+}
+
+func (t *searchTarget) close() {
+	if t.cols != nil {
+		util.Assert(t.cols.Close())
+	}
+	util.Assert(t.db.Close())
+}
+
+// searchGroup is a set of BOW databases with the same fragment library and
+// BOW options, so that the BOW of a query only needs to be computed once for
+// all of them.
+type searchGroup struct {
+	lib     fragbag.Library
+	libJson string // the JSON of the library, which identifies it
+	bowOpts build.Options
+	targets []*searchTarget
+
+	// BOWs to search for in addition to the BOWs of bower files.
+	queries []searchQuery
+
+	// The bower files that BOWs can be computed for with the group's
+	// library (see setSpecs), and the input position of each.
+	specs   []bowerSpec
+	specPos []int
+}
+
+// searchGroups opens the BOW databases given and groups them by fragment
+// library and BOW options, in the order that they are given.
+func searchGroups(c *command, dbPaths []string) []*searchGroup {
+	var groups []*searchGroup
+	byKey := make(map[string]*searchGroup)
+	for _, dbPath := range dbPaths {
+		meta, err := readBowDbMeta(dbPath)
+		util.Assert(err)
+		bowOpts := c.bowOptsFor(meta)
+		libJson, err := readBowDbFile(dbPath, "frag-lib.json")
+		util.Assert(err)
+
+		t := openSearchTarget(dbPath)
+		if len(flagSearchRerank) > 0 || len(flagSearchCols) > 0 {
+			prov, err := readBowDbProvenance(dbPath)
+			util.Assert(err)
+			if prov != nil {
+				t.entries = prov.entries()
+			}
+		}
+		key := bowOpts.String() + "\x00" + string(libJson)
+		g, ok := byKey[key]
+		if !ok {
+			g = &searchGroup{
+				lib:     t.db.Lib,
+				libJson: string(libJson),
+				bowOpts: bowOpts,
+			}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.targets = append(g.targets, t)
+	}
+	return groups
+}
+
+// setSpecs sets the bower files that BOWs can be computed for with the
+// group's library. The first bower file has the input position given. When
+// searching several databases, FASTA files are only used with sequence
+// fragment libraries.
+func (g *searchGroup) setSpecs(specs []bowerSpec, first int, multi bool) {
+	for i, spec := range specs {
+		if multi && fragbag.IsStructure(g.lib) && isFasta(spec.path) {
+			continue
+		}
+		g.specs = append(g.specs, spec)
+		g.specPos = append(g.specPos, first+i)
+	}
+}
+
+// searches returns true if the group searches the query at the input
+// position given. (The queries and bower files of the group are in input
+// order.)
+func (g *searchGroup) searches(input int) bool {
+	i := sort.Search(len(g.queries), func(i int) bool {
+		return g.queries[i].pos.input >= input
+	})
+	if i < len(g.queries) && g.queries[i].pos.input == input {
+		return true
+	}
+	i = sort.SearchInts(g.specPos, input)
+	return i < len(g.specPos) && g.specPos[i] == input
+}
+
+// searchingGroups returns the number of groups that search the query at the
+// position given.
+func searchingGroups(groups []*searchGroup, pos queryPos) int {
+	n := 0
+	for _, g := range groups {
+		if g.searches(pos.input) {
+			n++
+		}
+	}
+	return n
+}
+
+// search computes the BOW of every query with the group's library and
+// searches every database in the group for it. The hits of each query from
+// all of the databases are given to emit together. When the context is
+// cancelled, queries that haven't been searched yet are skipped.
+func (g *searchGroup) search(ctx context.Context, emit func(searchResult)) {
+	batchSize := 1
+	for _, t := range g.targets {
+		if t.batchSize > batchSize {
+			batchSize = t.batchSize
+		}
+	}
+
+	batches := batchQueries(g.readQueries(ctx), batchSize)
 
 	// launch goroutines to search queries in parallel
 	wgSearch := new(sync.WaitGroup)
@@ -87,39 +594,258 @@ func search(c *command) {
 		go func() {
 			defer wgSearch.Done()
 
-			for b := range bows {
-				sr := db.Search(flagSearchOpts, b)
-				out <- searchResult{b, sr}
+			for batch := range batches {
+				if ctx.Err() != nil {
+					continue
+				}
+				queries := make([]bow.Bowed, len(batch))
+				for i, q := range batch {
+					queries[i] = q.Bowed
+				}
+				if flagSearchStream {
+					g.stream(ctx, queries, emit)
+					continue
+				}
+				hits, err := g.searchTargets(ctx, queries)
+				if ctx.Err() != nil {
+					// The batch is skipped like any other query that
+					// wasn't searched before the interruption.
+					continue
+				}
+				util.Assert(err)
+				for i, q := range batch {
+					emit(searchResult{
+						query: q.Bowed,
+						pos:   q.pos,
+						hits:  hits[i],
+						bower: q.bower,
+					})
+				}
 			}
 		}()
 	}
-
 	wgSearch.Wait()
-	close(out)
-	<-outDone
-	util.Assert(db.Close())
 }
 
+// searchTargets searches every database in the group for the queries given,
+// and returns the hits of each query from all of them.
+func (g *searchGroup) searchTargets(
+	ctx context.Context,
+	queries []bow.Bowed,
+) ([][]searchHit, error) {
+	hits := make([][]searchHit, len(queries))
+	for _, t := range g.targets {
+		results, err := t.searcher.Search(ctx, flagSearchOpts, queries)
+		if err != nil {
+			return nil, err
+		}
+		for i, sr := range results {
+			hits[i] = append(hits[i], newSearchHits(t, sr)...)
+		}
+	}
+	return hits, nil
+}
+
+// stream gives the hits of the queries to emit as soon as they are found.
+func (g *searchGroup) stream(
+	ctx context.Context,
+	queries []bow.Bowed,
+	emit func(searchResult),
+) {
+	for _, t := range g.targets {
+		err := t.searcher.(*query.Searcher).SearchStream(ctx, flagSearchOpts,
+			queries, func(q bow.Bowed, sr []bowdb.SearchResult) {
+				emit(searchResult{query: q, hits: newSearchHits(t, sr)})
+			})
+		if ctx.Err() != nil {
+			return
+		}
+		util.Assert(err)
+	}
+}
+
+// readQueries sends the queries given to the group, followed by the BOW of
+// every bower in its bower files, on the channel returned. The progress bar
+// is always hidden.
+func (g *searchGroup) readQueries(ctx context.Context) <-chan searchQuery {
+	processed := processSpecBowers(ctx, g.specs, g.lib, false, g.bowOpts,
+		true)
+	queries := make(chan searchQuery, flagCpu*2)
+	go func() {
+		for _, q := range g.queries {
+			queries <- q
+		}
+		for sb := range processed {
+			for i, b := range sb.bows {
+				q := searchQuery{
+					Bowed: b.Bowed,
+					pos:   queryPos{input: g.specPos[sb.index], bower: i},
+				}
+				if len(flagSearchRerank) > 0 {
+					bower := b.bower
+					q.bower = &bower
+				}
+				queries <- q
+			}
+		}
+		close(queries)
+	}()
+	return queries
+}
+
+// batchQueries groups the queries received into blocks of at most size
+// queries.
+func batchQueries(queries <-chan searchQuery, size int) <-chan []searchQuery {
+	if size < 1 {
+		size = 1
+	}
+	batches := make(chan []searchQuery)
+	go func() {
+		var batch []searchQuery
+		for q := range queries {
+			batch = append(batch, q)
+			if len(batch) == size {
+				batches <- batch
+				batch = nil
+			}
+		}
+		if len(batch) > 0 {
+			batches <- batch
+		}
+		close(batches)
+	}()
+	return batches
+}
+
+// readBowStore returns the BOWs of the database given. They are mapped into
+// memory from the database's columnar file if it is up to date, and read
+// from the database otherwise. A *colStore must be closed when done.
+func readBowStore(dbPath string, db *bowdb.DB) query.Store {
+	if cols := openFreshColumns(dbPath, db.Lib.Size()); cols != nil {
+		return cols
+	}
+	entries, err := db.ReadAll()
+	util.Assert(err, "Could not read BOW database entries")
+	return query.Entries(entries)
+}
+
+// openFreshColumns maps the columnar file of the BOW database given (see
+// bowdb-columns) into memory. If there is no columnar file or it is out of
+// date, nil is returned.
+func openFreshColumns(dbPath string, dim int) *colStore {
+	cols, err := openColumns(colPath(dbPath))
+	util.Assert(err)
+	if cols == nil {
+		return nil
+	}
+	fresh, err := cols.fresh(dbPath)
+	util.Assert(err)
+	if !fresh || cols.Dim() != dim {
+		util.Verbosef("Ignoring out of date columnar file '%s'.",
+			colPath(dbPath))
+		util.Assert(cols.Close())
+		return nil
+	}
+	return cols
+}
+
+// searchQuery is a query along with its position among the queries given.
+type searchQuery struct {
+	bow.Bowed
+	pos queryPos
+
+	// The bower of the query, when it was read from a bower file and is
+	// needed to re-rank the hits.
+	bower *build.Bower
+}
+
+// queryPos is the position of a query among the queries given, which
+// identifies it across fragment libraries even when identifiers are
+// repeated. BOWs given directly (see '-query-vectors' and '-by-id') come
+// first, followed by the bower files. Each bower of a bower file has its own
+// position.
+type queryPos struct {
+	input int // the position of the BOW or bower file
+	bower int // the position of the bower in the bower file
+}
+
+type queryPositions []queryPos
+
+func (ps queryPositions) Len() int { return len(ps) }
+func (ps queryPositions) Less(i, j int) bool {
+	if ps[i].input != ps[j].input {
+		return ps[i].input < ps[j].input
+	}
+	return ps[i].bower < ps[j].bower
+}
+func (ps queryPositions) Swap(i, j int) { ps[i], ps[j] = ps[j], ps[i] }
+
 type searchResult struct {
-	query   bow.Bowed
-	results []bowdb.SearchResult
+	query bow.Bowed
+	pos   queryPos
+	hits  []searchHit
+
+	// The bower of the query, when it was read from a bower file and is
+	// needed to re-rank the hits.
+	bower *build.Bower
 }
 
-func outputter() (chan searchResult, chan struct{}) {
+// searchHit is a search result along with the database it came from.
+type searchHit struct {
+	bowdb.SearchResult
+	db string
+
+	// The combined score of a hit from several databases (see '-fuse').
+	score float64
+
+	// The structural or sequence alignment of the hit with the query (see
+	// '-rerank'). Both are nil if the hit wasn't re-ranked.
+	structAln *structAlignment
+	seqAln    *seqAlignment
+
+	// The provenance of the hit, when it is needed and the database has it.
+	entry *bowDbEntry
+}
+
+func newSearchHits(t *searchTarget, results []bowdb.SearchResult) []searchHit {
+	hits := make([]searchHit, len(results))
+	for i, r := range results {
+		hits[i] = searchHit{SearchResult: r, db: t.path}
+		if t.entries != nil {
+			hits[i].entry = t.entries[r.Bowed.Id]
+		}
+	}
+	return hits
+}
+
+// limitHits sorts hits from several databases and keeps at most the number
+// of hits allowed by the search options.
+func limitHits(opts bowdb.SearchOptions, hits []searchHit) []searchHit {
+	sort.Stable(hitsSorter{opts, hits})
+	if opts.Limit >= 0 && len(hits) > opts.Limit {
+		hits = hits[:opts.Limit]
+	}
+	return hits
+}
+
+// outputter writes search results to stdout. If multi is true, the database
+// of each hit is written too.
+func outputter(multi bool) (chan searchResult, chan struct{}) {
 	out := make(chan searchResult)
 	done := make(chan struct{})
 	go func() {
 		if flagSearchOutFmt == "csv" {
-			fmt.Printf("QueryID\tHitID\tCosine\tEuclid\n")
+			fmt.Printf("QueryID\tHitID\t%s\n",
+				strings.Join(hitColumns(multi), "\t"))
 		}
 
 		first := true
 		for sr := range out {
 			switch flagSearchOutFmt {
 			case "plain":
-				outputPlain(sr, first)
+				outputPlain(sr, first, multi)
 			case "csv":
-				outputCsv(sr, first)
+				outputCsv(sr, first, multi)
 			default:
 				util.Fatalf("Invalid output format '%s'.", flagSearchOutFmt)
 			}
@@ -130,7 +856,81 @@ func outputter() (chan searchResult, chan struct{}) {
 	return out, done
 }
 
-func outputPlain(sr searchResult, first bool) {
+// hitColumns returns the names of the columns written for each hit after
+// its identifier.
+func hitColumns(multi bool) []string {
+	var cols []string
+	if len(flagSearchFuse) > 0 {
+		cols = append(cols, "Score")
+	}
+	cols = append(cols, "Cosine", "Euclid")
+	switch flagSearchRerank {
+	case "structural":
+		cols = append(cols, "TM-score", "RMSD", "Aligned")
+	case "sequence":
+		cols = append(cols, "SW-score", "Identity", "Coverage")
+	}
+	for _, col := range searchProvCols {
+		cols = append(cols, strings.Title(col))
+	}
+	if multi {
+		cols = append(cols, "Database")
+	}
+	return cols
+}
+
+// The provenance columns of hits given by '-columns'.
+var searchProvCols []string
+
+// searchProvColumns returns the provenance columns given by '-columns'.
+func searchProvColumns() []string {
+	if len(flagSearchCols) == 0 {
+		return nil
+	}
+	cols := strings.Split(flagSearchCols, ",")
+	for i, col := range cols {
+		cols[i] = strings.ToLower(strings.TrimSpace(col))
+		switch cols[i] {
+		case "source", "chain", "residues", "windows":
+		default:
+			util.Fatalf("Unknown column '%s'.", col)
+		}
+	}
+	return cols
+}
+
+// hitValues returns the values of the columns given by hitColumns for the
+// hit given. Scores of hits that weren't re-ranked are written as '-'.
+func hitValues(hit searchHit, multi bool) []string {
+	var vals []string
+	if len(flagSearchFuse) > 0 {
+		vals = append(vals, fmt.Sprintf("%0.4f", hit.score))
+	}
+	vals = append(vals,
+		fmt.Sprintf("%0.4f", hit.Cosine), fmt.Sprintf("%0.4f", hit.Euclid))
+	switch {
+	case hit.structAln != nil:
+		aln := hit.structAln
+		vals = append(vals, fmt.Sprintf("%0.4f", aln.tmScore),
+			fmt.Sprintf("%0.2f", aln.rmsd), fmt.Sprintf("%d", aln.aligned))
+	case hit.seqAln != nil:
+		aln := hit.seqAln
+		vals = append(vals, fmt.Sprintf("%d", aln.score),
+			fmt.Sprintf("%0.4f", aln.identity),
+			fmt.Sprintf("%0.4f", aln.coverage))
+	case len(flagSearchRerank) > 0:
+		vals = append(vals, "-", "-", "-")
+	}
+	for _, col := range searchProvCols {
+		vals = append(vals, hit.entry.column(col))
+	}
+	if multi {
+		vals = append(vals, hit.db)
+	}
+	return vals
+}
+
+func outputPlain(sr searchResult, first, multi bool) {
 	w := tabwriter.NewWriter(os.Stdout, 5, 0, 4, ' ', 0)
 	wf := func(format string, v ...interface{}) {
 		fmt.Fprintf(w, format, v...)
@@ -139,20 +939,38 @@ func outputPlain(sr searchResult, first bool) {
 	if !first {
 		fmt.Println(strings.Repeat("-", 80))
 	}
-	header := fmt.Sprintf("%s (%d hits)", sr.query.Id, len(sr.results))
+	header := fmt.Sprintf("%s (%d hits)", sr.query.Id, len(sr.hits))
 
 	fmt.Println(header)
 	fmt.Println(strings.Repeat("-", len(header)))
-	wf("Hit\tCosine\tEuclid\n")
-	for _, result := range sr.results {
-		wf("%s\t%0.4f\t%0.4f\n", result.Bowed.Id, result.Cosine, result.Euclid)
+	wf("Hit\t%s\n", strings.Join(hitColumns(multi), "\t"))
+	for _, hit := range sr.hits {
+		wf("%s\t%s\n", hit.Bowed.Id, strings.Join(hitValues(hit, multi), "\t"))
 	}
 	w.Flush()
 }
 
-func outputCsv(sr searchResult, first bool) {
-	for _, result := range sr.results {
-		fmt.Printf("%s\t%s\t%0.4f\t%0.4f\n",
-			sr.query.Id, result.Bowed.Id, result.Cosine, result.Euclid)
+func outputCsv(sr searchResult, first, multi bool) {
+	for _, hit := range sr.hits {
+		fmt.Printf("%s\t%s\t%s\n", sr.query.Id, hit.Bowed.Id,
+			strings.Join(hitValues(hit, multi), "\t"))
+	}
+}
+
+type hitsSorter struct {
+	opts bowdb.SearchOptions
+	hits []searchHit
+}
+
+func (hs hitsSorter) Len() int { return len(hs.hits) }
+func (hs hitsSorter) Swap(i, j int) {
+	hs.hits[i], hs.hits[j] = hs.hits[j], hs.hits[i]
+}
+func (hs hitsSorter) Less(i, j int) bool {
+	di := query.SortDist(hs.opts, hs.hits[i].SearchResult)
+	dj := query.SortDist(hs.opts, hs.hits[j].SearchResult)
+	if hs.opts.Order == bowdb.OrderDesc {
+		return di > dj
 	}
+	return di < dj
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/esfragbag/bowdb"
+	"github.com/ndaniels/flib/query"
+	"github.com/ndaniels/tools/util"
+)
+
+var (
+	flagBenchOpts    = bowdb.SearchDefault
+	flagBenchSort    = "cosine"
+	flagBenchRuns    = 3
+	flagBenchQueries = 100
+	flagBenchBatch   = flagSearchBatch
+)
+
+var cmdSearchBench = &command{
+	name:            "search-bench",
+	positionalUsage: "bowdb-path [ bower-file ... ]",
+	shortHelp:       "compare the speed of search strategies",
+	help: `
+The search-bench command times searching the given BOW database with each of
+the strategies used by the search command, and checks that they return the
+same hits.
+
+The strategies are:
+
+	bowdb   each query is searched separately with the bowdb package
+	batch   queries are compared with the database in blocks (see the
+	        '-batch' flag of the search command)
+	columns the same as batch, but with the database's columnar file (only
+	        when one exists; see bowdb-columns)
+
+If no bower files are given, then the first BOWs in the database are used as
+queries. For example, to benchmark with the test database that comes with
+flib:
+
+	flib search-bench -queries 200 flibs-structure/my.bowdb
+
+Each strategy is run several times, and the fastest run is reported. The
+time to read the database and compute the BOWs of the queries is not
+included.
+` + bowerFilesHelp,
+	flags: flag.NewFlagSet("search-bench", flag.ExitOnError),
+	run:   searchBench,
+	addFlags: func(c *command) {
+		c.flags.IntVar(&flagBenchOpts.Limit, "limit", flagBenchOpts.Limit,
+			"The maximum number of search results to return.")
+		c.flags.StringVar(&flagBenchSort, "sort", flagBenchSort,
+			"The field to sort search results by.\n"+
+				"Valid values are 'cosine' and 'euclid'.")
+		c.flags.IntVar(&flagBenchRuns, "runs", flagBenchRuns,
+			"The number of times each strategy is run.")
+		c.flags.IntVar(&flagBenchQueries, "queries", flagBenchQueries,
+			"The number of BOWs in the database used as queries when no\n"+
+				"bower files are given.")
+		c.flags.IntVar(&flagBenchBatch, "batch", flagBenchBatch,
+			"The number of queries compared with the database together.")
+		c.setBowerListFlag()
+		c.setErrorsFlag()
+		c.setBowFlags()
+	},
+}
+
+func searchBench(c *command) {
+	c.assertLeastNArg(1)
+
+	switch flagBenchSort {
+	case "cosine":
+		flagBenchOpts.SortBy = bowdb.SortByCosine
+	case "euclid":
+		flagBenchOpts.SortBy = bowdb.SortByEuclid
+	default:
+		util.Fatalf("Unknown sort field '%s'.", flagBenchSort)
+	}
+	if flagBenchRuns < 1 {
+		util.Fatalf("The number of runs must be at least 1.")
+	}
+
+	dbPath := c.flags.Arg(0)
+	db := util.OpenBowDB(dbPath)
+	entries, err := db.ReadAll()
+	util.Assert(err, "Could not read BOW database entries")
+
+	var queries []bow.Bowed
+	if c.flags.NArg() > 1 || len(flagBowerList) > 0 {
+		meta, err := readBowDbMeta(dbPath)
+		util.Assert(err)
+		bowOpts := c.bowOptsFor(meta)
+		// The benchmark isn't stopped gracefully, since timings of an
+		// interrupted run are useless anyway.
+		bows := processBowers(context.Background(), c.bowerSpecs(1, true),
+			db.Lib, false, bowOpts, true)
+		for b := range bows {
+			queries = append(queries, b)
+		}
+	} else {
+		queries = entries
+		if len(queries) > flagBenchQueries {
+			queries = queries[:flagBenchQueries]
+		}
+	}
+	if len(queries) == 0 {
+		util.Fatalf("There are no queries to search for.")
+	}
+
+	strategies := []benchStrategy{
+		{"bowdb", func() searcher { return dbSearcher{db} }, 1},
+		{"batch", func() searcher {
+			return query.NewSearcher(query.Entries(entries))
+		}, flagBenchBatch},
+	}
+	if cols := openFreshColumns(dbPath, db.Lib.Size()); cols != nil {
+		defer cols.Close()
+		strategies = append(strategies, benchStrategy{"columns", func() searcher {
+			return query.NewSearcher(cols)
+		}, flagBenchBatch})
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 5, 0, 4, ' ', 0)
+	fmt.Fprintf(w, "Strategy\tSetup\tSearch\tQueries/sec\tMismatches\n")
+	var expected [][]bowdb.SearchResult
+	for _, strat := range strategies {
+		start := time.Now()
+		s := strat.setup()
+		setup := time.Since(start)
+
+		var best time.Duration
+		var results [][]bowdb.SearchResult
+		for run := 0; run < flagBenchRuns; run++ {
+			start := time.Now()
+			results = benchSearch(s, queries, strat.batch)
+			if elapsed := time.Since(start); run == 0 || elapsed < best {
+				best = elapsed
+			}
+		}
+		if expected == nil {
+			expected = results
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%0.1f\t%d\n",
+			strat.name, setup, best,
+			float64(len(queries))/best.Seconds(),
+			benchMismatches(expected, results))
+	}
+	w.Flush()
+	util.Assert(db.Close())
+}
+
+type benchStrategy struct {
+	name  string
+	setup func() searcher
+	batch int
+}
+
+// benchSearch searches for every query with flagCpu goroutines in the same
+// way as the search command, and returns the results in the order of the
+// queries.
+func benchSearch(
+	s searcher,
+	queries []bow.Bowed,
+	batchSize int,
+) [][]bowdb.SearchResult {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	results := make([][]bowdb.SearchResult, len(queries))
+	starts := make(chan int)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < flagCpu; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range starts {
+				end := start + batchSize
+				if end > len(queries) {
+					end = len(queries)
+				}
+				found, err := s.Search(context.Background(), flagBenchOpts,
+					queries[start:end])
+				util.Assert(err)
+				copy(results[start:end], found)
+			}
+		}()
+	}
+	for start := 0; start < len(queries); start += batchSize {
+		starts <- start
+	}
+	close(starts)
+	wg.Wait()
+	return results
+}
+
+// benchMismatches returns the number of queries whose hits differ between
+// the two sets of results given. Hits with the same distance may be in any
+// order.
+func benchMismatches(expected, got [][]bowdb.SearchResult) int {
+	mismatches := 0
+	for i := range expected {
+		if len(expected[i]) != len(got[i]) {
+			mismatches++
+			continue
+		}
+		for j := range expected[i] {
+			e, g := expected[i][j], got[i][j]
+			ed, gd := query.SortDist(flagBenchOpts, e), query.SortDist(flagBenchOpts, g)
+			if e.Bowed.Id != g.Bowed.Id && math.Abs(ed-gd) > 1e-6 {
+				mismatches++
+				break
+			}
+		}
+	}
+	return mismatches
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ndaniels/esfragbag/bowdb"
+	"github.com/ndaniels/flib/query"
+	"github.com/ndaniels/tools/util"
+)
+
+// The reciprocal rank fusion constant, as suggested by Cormack et al. (2009).
+const rrfK = 60
+
+// hitFuser joins the hits of a query from several databases by their
+// identifiers and ranks them by a combined score (see the '-fuse' flag).
+type hitFuser struct {
+	method  string
+	weights map[string]float64
+	opts    bowdb.SearchOptions
+
+	// The number of hits requested from each database.
+	depth int
+}
+
+func newHitFuser(dbPaths []string) *hitFuser {
+	switch flagSearchFuse {
+	case "sum", "rrf", "min":
+	default:
+		util.Fatalf("Unknown fusion method '%s'.", flagSearchFuse)
+	}
+	if len(dbPaths) < 2 {
+		util.Fatalf("'-fuse' requires at least two BOW databases.")
+	}
+	if flagSearchOpts.Order != bowdb.OrderAsc {
+		util.Fatalf("'-fuse' cannot be used with '-desc'.")
+	}
+
+	f := &hitFuser{
+		method:  flagSearchFuse,
+		weights: make(map[string]float64),
+		opts:    flagSearchOpts,
+		depth:   flagSearchDepth,
+	}
+	for _, dbPath := range dbPaths {
+		f.weights[dbPath] = 1
+	}
+	if len(flagSearchWeight) > 0 {
+		ws := strings.Split(flagSearchWeight, ",")
+		if len(ws) != len(dbPaths) {
+			util.Fatalf("%d fusion weights given for %d databases.",
+				len(ws), len(dbPaths))
+		}
+		for i, w := range ws {
+			weight, err := strconv.ParseFloat(strings.TrimSpace(w), 64)
+			util.Assert(err, "Invalid fusion weight '%s'", w)
+			f.weights[dbPaths[i]] = weight
+		}
+	}
+	if f.depth == 0 {
+		f.depth = 4 * f.opts.Limit
+		if f.depth < 100 {
+			f.depth = 100
+		}
+	}
+	if f.opts.Limit < 0 {
+		f.depth = -1
+	}
+	return f
+}
+
+// fuse joins the hits given by identifier and returns the best of them by
+// their fused scores.
+func (f *hitFuser) fuse(hits []searchHit) []searchHit {
+	// The hits of each database, in order of distance.
+	byDb := make(map[string][]searchHit)
+	for _, hit := range hits {
+		byDb[hit.db] = append(byDb[hit.db], hit)
+	}
+	for _, dbHits := range byDb {
+		sort.Stable(hitsSorter{f.opts, dbHits})
+	}
+
+	fused := make(map[string]*searchHit)
+	var order []string
+	dists := make(map[string]map[string]float64) // hit id -> db -> distance
+	for db, dbHits := range byDb {
+		for rank, hit := range dbHits {
+			id := hit.Bowed.Id
+			d := query.SortDist(f.opts, hit.SearchResult)
+			best, ok := fused[id]
+			if !ok {
+				hit := hit
+				best = &hit
+				fused[id] = best
+				order = append(order, id)
+				dists[id] = make(map[string]float64)
+			} else if d < query.SortDist(f.opts, best.SearchResult) {
+				best.SearchResult = hit.SearchResult
+			}
+			if _, ok := dists[id][db]; !ok {
+				dists[id][db] = d
+				if f.method == "rrf" {
+					best.score += f.weights[db] / float64(rrfK+rank+1)
+				}
+			}
+		}
+	}
+	sort.Strings(order) // map iteration order is random
+
+	results := make([]searchHit, 0, len(order))
+	for _, id := range order {
+		hit := fused[id]
+		var dbs []string
+		for db := range dists[id] {
+			dbs = append(dbs, db)
+		}
+		sort.Strings(dbs)
+		hit.db = strings.Join(dbs, ",")
+
+		switch f.method {
+		case "sum":
+			hit.score = 0
+			for db, dbHits := range byDb {
+				d, ok := dists[id][db]
+				if !ok {
+					d = query.SortDist(f.opts, dbHits[len(dbHits)-1].SearchResult)
+				}
+				hit.score += f.weights[db] * d
+			}
+		case "min":
+			hit.score = math.Inf(1)
+			for _, d := range dists[id] {
+				hit.score = math.Min(hit.score, d)
+			}
+		}
+		results = append(results, *hit)
+	}
+
+	sort.Stable(fusedSorter{f.method == "rrf", results})
+	if f.opts.Limit >= 0 && len(results) > f.opts.Limit {
+		results = results[:f.opts.Limit]
+	}
+	return results
+}
+
+// fusedSorter sorts fused hits by score, with the largest first when desc
+// is true.
+type fusedSorter struct {
+	desc bool
+	hits []searchHit
+}
+
+func (fs fusedSorter) Len() int { return len(fs.hits) }
+func (fs fusedSorter) Swap(i, j int) {
+	fs.hits[i], fs.hits[j] = fs.hits[j], fs.hits[i]
+}
+func (fs fusedSorter) Less(i, j int) bool {
+	if fs.desc {
+		return fs.hits[i].score > fs.hits[j].score
+	}
+	return fs.hits[i].score < fs.hits[j].score
+}
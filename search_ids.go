@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/flib/query"
+	"github.com/ndaniels/tools/util"
+)
+
+// searchEntryIds returns the identifiers of database entries to use as
+// queries: the positional arguments after the database (with '-by-id') and
+// the lines of the '-by-id-file' file.
+func searchEntryIds(c *command) []string {
+	var ids []string
+	if len(flagSearchIdFile) > 0 {
+		var r io.Reader = os.Stdin
+		if flagSearchIdFile != "-" {
+			f := util.OpenFile(flagSearchIdFile)
+			defer f.Close()
+			r = f
+		}
+		fileIds, err := readEntryIds(r)
+		util.Assert(err, "Could not read identifiers from '%s'",
+			flagSearchIdFile)
+		ids = append(ids, fileIds...)
+	}
+	if flagSearchById {
+		ids = append(ids, c.flags.Args()[1:]...)
+	} else if c.flags.NArg() > 1 {
+		util.Fatalf("Bower files cannot be given with '-by-id-file'. " +
+			"Use '-by-id' to give more identifiers as arguments.")
+	}
+	if len(ids) == 0 {
+		c.showUsage()
+	}
+	return ids
+}
+
+// readEntryIds reads one identifier from each line of r. Only the first
+// column of a line is used, and blank lines and lines starting with '#' are
+// ignored.
+func readEntryIds(r io.Reader) ([]string, error) {
+	var ids []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		ids = append(ids, fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// entries returns the stored BOWs of the entries with the identifiers given,
+// in the same order. An identifier is looked up in each database of the
+// group in turn, and the first entry found is used. The identifiers that
+// aren't in any of the databases are returned as missing.
+//
+// The query of the identifier at position i has the input position first+i.
+func (g *searchGroup) entries(
+	ids []string,
+	first int,
+) (found []searchQuery, missing []string) {
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	byId := make(map[string]bow.Bowed, len(ids))
+	for _, t := range g.targets {
+		for i := 0; i < t.store.Len(); i++ {
+			id := t.store.Id(i)
+			if _, ok := byId[id]; ok || !want[id] {
+				continue
+			}
+			byId[id] = query.Bowed(t.store, i)
+		}
+	}
+	for i, id := range ids {
+		if b, ok := byId[id]; ok {
+			found = append(found,
+				searchQuery{Bowed: b, pos: queryPos{input: first + i}})
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return found, missing
+}
+
+// excludeSelf returns the hits of the search result given, without the hits
+// that have the same identifier as the query when '-exclude-self' is set.
+func excludeSelf(sr searchResult) []searchHit {
+	if !flagSearchNoSelf {
+		return sr.hits
+	}
+	hits := make([]searchHit, 0, len(sr.hits))
+	for _, hit := range sr.hits {
+		if hit.Bowed.Id != sr.query.Id {
+			hits = append(hits, hit)
+		}
+	}
+	return hits
+}
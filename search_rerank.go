@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/TuftsBCB/structure"
+	"github.com/ndaniels/flib/build"
+	"github.com/ndaniels/tools/util"
+)
+
+// The maximum number of bowers of hits kept in memory while re-ranking.
+const rerankCacheSize = 10000
+
+// reranker re-ranks the top hits of each query by aligning the query with
+// each hit, either by structure or by sequence (see '-rerank').
+type reranker struct {
+	method  string
+	k       int
+	pdbDir  string
+	targets []*searchTarget
+
+	// The sequences stored in each database, for sequence re-ranking.
+	sequences map[*searchTarget]map[string]string
+
+	lock   sync.Mutex
+	bowers map[string]*build.Bower // by database path and identifier
+}
+
+func newReranker(groups []*searchGroup) *reranker {
+	switch flagSearchRerank {
+	case "structural", "sequence":
+	default:
+		util.Fatalf("Unknown re-ranking method '%s'.", flagSearchRerank)
+	}
+	if flagSearchRankK < 1 {
+		util.Fatalf("The number of hits to re-rank must be at least 1.")
+	}
+	r := &reranker{
+		method:    flagSearchRerank,
+		k:         flagSearchRankK,
+		pdbDir:    flagSearchPdbDir,
+		sequences: make(map[*searchTarget]map[string]string),
+		bowers:    make(map[string]*build.Bower),
+	}
+	for _, g := range groups {
+		for _, t := range g.targets {
+			r.targets = append(r.targets, t)
+			if r.method == "sequence" {
+				seqs, err := readBowDbSequences(t.path)
+				util.Assert(err)
+				r.sequences[t] = seqs
+			}
+		}
+	}
+	return r
+}
+
+// rerank returns the hits of the search result given with the top k sorted
+// by their alignment scores, followed by the rest of the hits in their
+// original order. Hits that can't be aligned are placed after the other top
+// hits.
+func (r *reranker) rerank(sr searchResult) []searchHit {
+	var queryAtoms []structure.Coords
+	var querySeq string
+	var err error
+	if r.method == "structural" {
+		queryAtoms, err = r.atoms(sr.bower, "", sr.query.Id)
+	} else {
+		querySeq, err = r.sequence(sr.bower, "", sr.query.Id)
+	}
+	if err != nil {
+		log.Printf("Could not re-rank the hits of '%s': %s", sr.query.Id, err)
+		return sr.hits
+	}
+
+	k := r.k
+	if k > len(sr.hits) {
+		k = len(sr.hits)
+	}
+	hits := make([]searchHit, len(sr.hits))
+	copy(hits, sr.hits)
+	for i := range hits[:k] {
+		hit := &hits[i]
+		if r.method == "structural" {
+			var atoms []structure.Coords
+			if atoms, err = r.atoms(nil, hit.db, hit.Bowed.Id); err == nil {
+				aln := tmAlign(queryAtoms, atoms)
+				hit.structAln = &aln
+			}
+		} else {
+			var s string
+			if s, err = r.sequence(nil, hit.db, hit.Bowed.Id); err == nil {
+				aln := swAlign(querySeq, s)
+				hit.seqAln = &aln
+			}
+		}
+		if err != nil {
+			util.Verbosef("Could not align hit '%s': %s", hit.Bowed.Id, err)
+		}
+	}
+	sort.Stable(rerankedSorter(hits[:k]))
+	return hits
+}
+
+// atoms returns the alpha-carbon atoms of the bower given or, if it is nil,
+// of the entry with the identifier given in the databases given (a
+// comma-separated list of paths, or every database if empty).
+func (r *reranker) atoms(b *build.Bower, dbs, id string) ([]structure.Coords, error) {
+	if b == nil {
+		var err error
+		if b, err = r.bower(dbs, id); err != nil {
+			return nil, err
+		}
+	}
+	if len(b.Atoms) == 0 {
+		return nil, fmt.Errorf("'%s' has no structure", id)
+	}
+	return b.AllAtoms(), nil
+}
+
+// sequence returns the residues of the bower given or, if it is nil, of the
+// entry with the identifier given in the databases given (see atoms). The
+// sequences stored in the databases are used if possible.
+func (r *reranker) sequence(b *build.Bower, dbs, id string) (string, error) {
+	if b == nil {
+		for _, t := range r.targetsIn(dbs) {
+			if s, ok := r.sequences[t][id]; ok {
+				return s, nil
+			}
+		}
+		var err error
+		if b, err = r.bower(dbs, id); err != nil {
+			return "", err
+		}
+	}
+	if s := b.Residues(); len(s) > 0 {
+		return s, nil
+	}
+	return "", fmt.Errorf("'%s' has no sequence", id)
+}
+
+// bower returns the bower of the entry with the identifier given, from the
+// first of the databases given that has it (see atoms).
+func (r *reranker) bower(dbs, id string) (*build.Bower, error) {
+	err := fmt.Errorf("'%s' is not in any database", id)
+	for _, t := range r.targetsIn(dbs) {
+		var b *build.Bower
+		if b, err = r.entryBower(t, id); err == nil {
+			return b, nil
+		}
+	}
+	return nil, err
+}
+
+// targetsIn returns the databases with the paths in the comma-separated list
+// given, or every database if the list is empty.
+func (r *reranker) targetsIn(dbs string) []*searchTarget {
+	if len(dbs) == 0 {
+		return r.targets
+	}
+	var targets []*searchTarget
+	for _, dbPath := range strings.Split(dbs, ",") {
+		for _, t := range r.targets {
+			if t.path == dbPath {
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets
+}
+
+// entryBower returns the bower of the database entry with the identifier
+// given. It is read from the bower file stored in the database's metadata
+// or, failing that, from a file in the '-pdb-dir' directory.
+func (r *reranker) entryBower(t *searchTarget, id string) (*build.Bower, error) {
+	key := t.path + "\x00" + id
+	r.lock.Lock()
+	b, ok := r.bowers[key]
+	r.lock.Unlock()
+	if ok {
+		return b, nil
+	}
+
+	b, err := r.readEntryBower(t, id)
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	if len(r.bowers) < rerankCacheSize {
+		r.bowers[key] = b
+	}
+	r.lock.Unlock()
+	return b, nil
+}
+
+func (r *reranker) readEntryBower(t *searchTarget, id string) (*build.Bower, error) {
+	if e, ok := t.entries[id]; ok {
+		spec, err := parseBowerSpec(e.Source)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(spec.path); err == nil || len(r.pdbDir) == 0 {
+			return findBower(spec, t, id)
+		}
+	}
+	if len(r.pdbDir) == 0 {
+		return nil, fmt.Errorf("the database has no bower file for '%s' "+
+			"(use '-pdb-dir')", id)
+	}
+	for _, fpath := range pdbDirPaths(r.pdbDir, id) {
+		if _, err := os.Stat(fpath); err == nil {
+			return findBower(bowerSpec{path: fpath}, t, id)
+		}
+	}
+	return nil, fmt.Errorf("no file for '%s' in '%s'", id, r.pdbDir)
+}
+
+// findBower returns the bower with the identifier given among the bowers
+// selected by the spec. If the spec selects a single bower, it is returned
+// regardless of its identifier.
+func findBower(spec bowerSpec, t *searchTarget, id string) (*build.Bower, error) {
+	bowers, err := readBowers(spec, t.db.Lib, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(bowers) == 1 {
+		return &bowers[0], nil
+	}
+	for i := range bowers {
+		if bowers[i].Id == id {
+			return &bowers[i], nil
+		}
+	}
+
+	// The entry may be a single model of a chain.
+	if strings.Contains(id, ":") {
+		bowers, err = readBowers(spec, t.db.Lib, true)
+		if err != nil {
+			return nil, err
+		}
+		for i := range bowers {
+			if bowers[i].Id == id {
+				return &bowers[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("'%s' is not in '%s'", id, spec)
+}
+
+// pdbDirPaths returns the paths in the directory given where the structure
+// of the entry with the identifier given may be found. Both flat directories
+// and the PDB's divided layout (e.g., 'ab/pdb1abc.ent.gz') are supported.
+func pdbDirPaths(dir, id string) []string {
+	if i := strings.Index(id, ":"); i >= 0 {
+		id = id[:i]
+	}
+	names := []string{id}
+	if len(id) >= 4 && strings.ToLower(id[:4]) != id {
+		names = append(names, strings.ToLower(id[:4]))
+	}
+
+	var paths []string
+	for _, name := range names {
+		dirs := []string{dir}
+		if len(name) == 4 {
+			dirs = append(dirs, path.Join(dir, name[1:3]))
+		}
+		for _, d := range dirs {
+			for _, file := range []string{
+				name + ".pdb", name + ".ent", "pdb" + name + ".ent",
+				name + ".cif",
+			} {
+				paths = append(paths,
+					path.Join(d, file), path.Join(d, file+".gz"))
+			}
+		}
+	}
+	return paths
+}
+
+// rerankedSorter sorts hits by decreasing alignment score, with hits that
+// weren't aligned last.
+type rerankedSorter []searchHit
+
+func (rs rerankedSorter) Len() int      { return len(rs) }
+func (rs rerankedSorter) Swap(i, j int) { rs[i], rs[j] = rs[j], rs[i] }
+func (rs rerankedSorter) Less(i, j int) bool {
+	a, aok := rs[i].alignScore()
+	b, bok := rs[j].alignScore()
+	if !aok || !bok {
+		return aok && !bok
+	}
+	return a > b
+}
+
+// alignScore returns the TM-score or sequence alignment score of a
+// re-ranked hit. If the hit wasn't aligned, false is returned.
+func (hit searchHit) alignScore() (float64, bool) {
+	switch {
+	case hit.structAln != nil:
+		return hit.structAln.tmScore, true
+	case hit.seqAln != nil:
+		return float64(hit.seqAln.score), true
+	}
+	return 0, false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/esfragbag/bowdb"
+	"github.com/ndaniels/flib/query"
+)
+
+// searcher is anything that can search a BOW database for a block of queries
+// at a time. *query.Searcher is one. If the context is cancelled, a searcher
+// returns the context's error.
+type searcher interface {
+	Search(
+		ctx context.Context,
+		opts bowdb.SearchOptions,
+		queries []bow.Bowed,
+	) ([][]bowdb.SearchResult, error)
+}
+
+// dbSearcher searches a BOW database with bowdb.DB.Search, one query at a
+// time.
+type dbSearcher struct {
+	db *bowdb.DB
+}
+
+func (ds dbSearcher) Search(
+	ctx context.Context,
+	opts bowdb.SearchOptions,
+	queries []bow.Bowed,
+) ([][]bowdb.SearchResult, error) {
+	results := make([][]bowdb.SearchResult, len(queries))
+	for i, q := range queries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		results[i] = ds.db.Search(opts, q)
+	}
+	return results, nil
+}
+
+// storeSearcher searches a query.Store by comparing each query with every
+// BOW (see query.SearchStore).
+type storeSearcher struct {
+	store query.Store
+}
+
+func (ss storeSearcher) Search(
+	ctx context.Context,
+	opts bowdb.SearchOptions,
+	queries []bow.Bowed,
+) ([][]bowdb.SearchResult, error) {
+	return query.SearchStore(ctx, ss.store, opts, queries)
+}
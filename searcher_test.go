@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/TuftsBCB/structure"
+	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/esfragbag/bowdb"
+	"github.com/ndaniels/flib/query"
+)
+
+// testEntries returns n random sparse BOWs with dim fragments. Every fourth
+// BOW is a copy of the one before it, so that searches have ties.
+func testEntries(rng *rand.Rand, n, dim int) []bow.Bowed {
+	entries := make([]bow.Bowed, n)
+	for i := range entries {
+		freqs := make([]float32, dim)
+		if i%4 == 3 {
+			copy(freqs, entries[i-1].Bow.Freqs)
+		} else {
+			for j := 0; j < dim/4; j++ {
+				freqs[rng.Intn(dim)] += float32(1 + rng.Intn(5))
+			}
+		}
+		entries[i] = bow.Bowed{
+			Id:  "e" + strconv.Itoa(i),
+			Bow: bow.Bow{Freqs: freqs},
+		}
+	}
+	return entries
+}
+
+// linearSearch compares each query with every BOW given, in the same way as
+// bowdb.DB.Search.
+func linearSearch(
+	entries []bow.Bowed,
+	opts bowdb.SearchOptions,
+	queries []bow.Bowed,
+) [][]bowdb.SearchResult {
+	all := make([][]bowdb.SearchResult, len(queries))
+	for qi, q := range queries {
+		var results []bowdb.SearchResult
+		for _, b := range entries {
+			r := bowdb.SearchResult{
+				Bowed:  b,
+				Cosine: q.Bow.Cosine(b.Bow),
+				Euclid: q.Bow.Euclid(b.Bow),
+			}
+			if d := query.SortDist(opts, r); d >= opts.Min && d <= opts.Max {
+				results = append(results, r)
+			}
+		}
+		query.SortResults(opts, results)
+		if opts.Limit >= 0 && len(results) > opts.Limit {
+			results = results[:opts.Limit]
+		}
+		all[qi] = results
+	}
+	return all
+}
+
+// testSearchOpts are the search options that the searchers are checked with.
+// They cover the general scan and the scan by norm (Euclidean distance in
+// ascending order), with and without limits and distance bounds.
+func testSearchOpts() map[string]bowdb.SearchOptions {
+	opts := make(map[string]bowdb.SearchOptions)
+	add := func(name string, limit int, min, max float64,
+		sortBy bowdb.SortByType, order bowdb.OrderType) {
+		o := bowdb.SearchDefault
+		o.Limit, o.Min, o.Max, o.SortBy, o.Order = limit, min, max, sortBy, order
+		opts[name] = o
+	}
+	add("cosine", 10, 0, 1, bowdb.SortByCosine, bowdb.OrderAsc)
+	add("cosine-desc", 5, 0, 1, bowdb.SortByCosine, bowdb.OrderDesc)
+	add("cosine-range", -1, 0.2, 0.6, bowdb.SortByCosine, bowdb.OrderAsc)
+	add("cosine-none", 0, 0, 1, bowdb.SortByCosine, bowdb.OrderAsc)
+	add("euclid", 10, 0, 1e9, bowdb.SortByEuclid, bowdb.OrderAsc)
+	add("euclid-desc", 7, 0, 1e9, bowdb.SortByEuclid, bowdb.OrderDesc)
+	add("euclid-max", -1, 0, 15, bowdb.SortByEuclid, bowdb.OrderAsc)
+	return opts
+}
+
+// checkSameResults fails the test if two lists of search results don't have
+// the same entries in the same order with the same distances.
+func checkSameResults(
+	t *testing.T,
+	name string,
+	got, expected []bowdb.SearchResult,
+) {
+	if len(got) != len(expected) {
+		t.Errorf("%s: %d results, expected %d.", name, len(got), len(expected))
+		return
+	}
+	for i := range got {
+		g, e := got[i], expected[i]
+		if g.Bowed.Id != e.Bowed.Id ||
+			g.Cosine != e.Cosine || g.Euclid != e.Euclid {
+			t.Errorf("%s: result %d is %s (cosine %g, euclid %g), expected "+
+				"%s (cosine %g, euclid %g).", name, i,
+				g.Bowed.Id, g.Cosine, g.Euclid, e.Bowed.Id, e.Cosine, e.Euclid)
+			return
+		}
+	}
+}
+
+// TestSearchBowdb checks that the searchers used by the search command return
+// the same results as bowdb.DB.Search, including the order of ties. The
+// database is small so that bowdb.DB.Search sorts with insertion sort, which
+// is stable.
+func TestSearchBowdb(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	entries := testEntries(rng, 12, 8)
+	dbPath := testBowDb(t, entries)
+	defer os.RemoveAll(path.Dir(dbPath))
+
+	db, err := bowdb.Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	searchers := map[string]searcher{
+		"batch": query.NewSearcher(query.Entries(entries)),
+		"store": storeSearcher{query.Entries(entries)},
+		"bowdb": dbSearcher{db},
+	}
+	queries := append(testEntries(rng, 4, 8), entries...)
+	for name, opts := range testSearchOpts() {
+		for sname, s := range searchers {
+			got, err := s.Search(context.Background(), opts, queries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for qi, q := range queries {
+				checkSameResults(t, name+"/"+sname+"/"+q.Id,
+					got[qi], db.Search(opts, q))
+			}
+		}
+	}
+}
+
+// testBowDb creates a BOW database in a new temporary directory with the
+// entries given, which must have the same number of fragments.
+func testBowDb(t testing.TB, entries []bow.Bowed) string {
+	dir, err := ioutil.TempDir("", "flib-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := path.Join(dir, "test.bowdb")
+	db, err := bowdb.Create(testLibrary(t, len(entries[0].Bow.Freqs)), dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		db.Add(e)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dbPath
+}
+
+// testLibrary returns a structure fragment library with the number of
+// fragments given, each with three atoms.
+func testLibrary(t testing.TB, size int) fragbag.StructureLibrary {
+	frags := make([][]structure.Coords, size)
+	for i := range frags {
+		x := float64(i)
+		frags[i] = []structure.Coords{
+			{X: x, Y: 0, Z: 0}, {X: x, Y: 1, Z: 0}, {X: x, Y: 1, Z: 1},
+		}
+	}
+	lib, err := fragbag.NewStructureAtoms("test", frags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lib
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/TuftsBCB/io/pdb"
+)
+
+// A bower file argument may select part of the file it names:
+//
+//	1abc.pdb:A           chain A
+//	1abc.pdb:A,B         chains A and B
+//	1abc.pdb:*           every chain (the same as no selection)
+//	1abc.pdb:A:10-150    residues 10 through 150 of chain A
+//	1abc.pdb:A:1-50,80-  residues 1 through 50 and 80 onwards of chain A
+//	1abc.pdb@model=3     only the third model of every chain
+//
+// The model selection may be combined with the others, as in
+// '1abc.pdb:A:10-150@model=3'. Residues are identified by their sequence
+// numbers in the file (the author numbering in mmCIF files).
+//
+// When more than one residue range is given, each range is a separate segment
+// of the chain. Windows of a structure never span two segments.
+
+const bowerFilesHelp = `
+Any bower file argument may select only part of the file: '1abc.pdb:A' or
+'1abc.pdb:A,B' selects chains, '1abc.pdb:A:10-150' selects a range of
+residues (by their sequence number in the file) of a single chain and
+'1abc.pdb@model=3' selects a single model. Several residue ranges may be
+given, separated by commas, and open ranges like '80-' are allowed. Windows
+never span two residue ranges.
+
+Instead of (or in addition to) listing bower files as arguments, a list of
+bower files may be read from a file with the '-list' flag, or from stdin by
+giving '-' as an argument. Each line of a list has a bower file argument and,
+optionally, an identifier separated by a tab. The identifier replaces the one
+that would be derived from the file, and may only be given when the line
+selects exactly one chain or sequence. Empty lines and lines starting with
+'#' are ignored.
+
+Bower files that can't be read are skipped, as are chains without a single
+window of alpha-carbon atoms when training. Bowers without any windows are
+kept, but their BOWs are empty. A summary of these inputs is shown at the
+end, and the '-errors' flag writes each one to a tab-separated file with its
+reason: 'parse error', 'no CA atoms', 'too short' (fewer residues than the
+fragment size) or 'all windows gapped' (every window is missing an atom).
+`
+
+const domainsHelp = `
+Domain-level BOWs can be computed with the '-domains' flag, which reads a
+tab-separated file of domain boundaries. Each line has a domain identifier,
+the path to a PDB or mmCIF file (relative to the directory of the domain
+file), a chain and a comma-separated list of residue ranges (or '-' for the
+whole chain). Discontinuous domains are supported: windows that span two
+residue ranges are not counted. The BOW of each domain has the domain
+identifier as its identifier.
+`
+
+// bowerSpec is a bower file argument.
+type bowerSpec struct {
+	path string
+
+	// When not empty, the identifier to use for the BOW instead of the one
+	// derived from the file. Only valid if a single bower is selected.
+	id string
+
+	// The names of the chains selected. When nil, all chains are selected.
+	chains []string
+
+	// The model selected. When 0, the first model is used (or every model if
+	// models are requested).
+	model int
+
+	// The residue ranges selected. Only allowed when a single chain is
+	// selected.
+	ranges []resRange
+}
+
+// resRange is an inclusive range of residue sequence numbers.
+type resRange struct {
+	start, end int
+}
+
+const (
+	resRangeMin = -1 << 30
+	resRangeMax = 1 << 30
+)
+
+func (r resRange) contains(num int) bool {
+	return num >= r.start && num <= r.end
+}
+
+func (r resRange) String() string {
+	switch {
+	case r.start == resRangeMin && r.end == resRangeMax:
+		return "-"
+	case r.start == resRangeMin:
+		return fmt.Sprintf("-%d", r.end)
+	case r.end == resRangeMax:
+		return fmt.Sprintf("%d-", r.start)
+	}
+	return fmt.Sprintf("%d-%d", r.start, r.end)
+}
+
+// selected returns true if the spec selects anything less than the whole
+// file.
+func (spec bowerSpec) selected() bool {
+	return len(spec.chains) > 0 || spec.model > 0 || len(spec.ranges) > 0
+}
+
+// rangesString returns the residue ranges in the same format they're given
+// on the command line.
+func (spec bowerSpec) rangesString() string {
+	strs := make([]string, len(spec.ranges))
+	for i, r := range spec.ranges {
+		strs[i] = r.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+func (spec bowerSpec) String() string {
+	s := spec.path
+	if len(spec.chains) > 0 {
+		s += ":" + strings.Join(spec.chains, ",")
+	}
+	if len(spec.ranges) > 0 {
+		s += ":" + spec.rangesString()
+	}
+	if spec.model > 0 {
+		s += fmt.Sprintf("@model=%d", spec.model)
+	}
+	return s
+}
+
+// readBowerList reads a list of bower file arguments, one per line. Each
+// line may have a second column (separated by a tab, or by spaces if there
+// are no tabs) with an identifier for the BOW.
+func readBowerList(r io.Reader) ([]bowerSpec, error) {
+	var specs []bowerSpec
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		var cols []string
+		if strings.Contains(line, "\t") {
+			cols = strings.Split(line, "\t")
+		} else {
+			cols = strings.Fields(line)
+		}
+		if len(cols) > 2 {
+			return nil, fmt.Errorf("Line %d: expected at most 2 columns, "+
+				"but got %d", lineNum, len(cols))
+		}
+		spec, err := parseBowerSpec(strings.TrimSpace(cols[0]))
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", lineNum, err)
+		}
+		if len(cols) == 2 {
+			spec.id = strings.TrimSpace(cols[1])
+		}
+		specs = append(specs, spec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return specs, nil
+}
+
+// readDomains reads a domain boundary file. Each line has four
+// tab-separated columns: the domain identifier, the path to its PDB or mmCIF
+// file, its chain and its residue ranges (like the residue ranges of a bower
+// file argument). The residue ranges may be '-' or omitted to select the
+// whole chain. Empty lines and lines starting with '#' are ignored. Relative
+// paths are relative to the directory given (that of the domain file).
+//
+// Each domain is a bower file argument with the domain identifier as its
+// identifier.
+func readDomains(r io.Reader, dir string) ([]bowerSpec, error) {
+	var specs []bowerSpec
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		cols := strings.Split(line, "\t")
+		for i := range cols {
+			cols[i] = strings.TrimSpace(cols[i])
+		}
+		if len(cols) < 3 || len(cols) > 4 {
+			return nil, fmt.Errorf("Line %d: expected 3 or 4 columns, but "+
+				"got %d", lineNum, len(cols))
+		}
+		if len(cols[0]) == 0 || len(cols[1]) == 0 || len(cols[2]) == 0 {
+			return nil, fmt.Errorf("Line %d: empty domain identifier, file "+
+				"or chain", lineNum)
+		}
+		fpath := cols[1]
+		if !path.IsAbs(fpath) {
+			fpath = path.Join(dir, fpath)
+		}
+		spec := bowerSpec{
+			path:   fpath,
+			id:     cols[0],
+			chains: []string{cols[2]},
+		}
+		if len(cols) == 4 && len(cols[3]) > 0 && cols[3] != "-" {
+			for _, rstr := range strings.Split(cols[3], ",") {
+				r, err := parseResRange(strings.TrimSpace(rstr))
+				if err != nil {
+					return nil, fmt.Errorf("Line %d: %s", lineNum, err)
+				}
+				spec.ranges = append(spec.ranges, r)
+			}
+		}
+		specs = append(specs, spec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return specs, nil
+}
+
+// parseBowerSpec parses a bower file argument with an optional selection.
+func parseBowerSpec(arg string) (bowerSpec, error) {
+	spec := bowerSpec{path: arg}
+	if i := strings.LastIndex(arg, "@model="); i > -1 {
+		model, err := strconv.Atoi(arg[i+len("@model="):])
+		if err != nil || model < 1 {
+			return spec, fmt.Errorf("Invalid model in '%s'", arg)
+		}
+		spec.path, spec.model = arg[:i], model
+	}
+
+	// A file that exists with the full name is never split on a colon.
+	if _, err := os.Stat(spec.path); err == nil {
+		return spec, nil
+	}
+	slash := strings.LastIndex(spec.path, "/") + 1
+	colon := strings.Index(spec.path[slash:], ":")
+	if colon == -1 {
+		return spec, nil
+	}
+	sel := strings.Split(spec.path[slash+colon+1:], ":")
+	spec.path = spec.path[:slash+colon]
+	if len(sel) > 2 {
+		return spec, fmt.Errorf("Too many selections in '%s'", arg)
+	}
+
+	if sel[0] != "*" {
+		for _, chain := range strings.Split(sel[0], ",") {
+			if len(chain) == 0 {
+				return spec, fmt.Errorf("Empty chain name in '%s'", arg)
+			}
+			spec.chains = append(spec.chains, chain)
+		}
+	}
+	if len(sel) == 2 {
+		if len(spec.chains) != 1 {
+			return spec, fmt.Errorf("Residue ranges require exactly one "+
+				"chain in '%s'", arg)
+		}
+		for _, rstr := range strings.Split(sel[1], ",") {
+			r, err := parseResRange(rstr)
+			if err != nil {
+				return spec, fmt.Errorf("%s in '%s'", err, arg)
+			}
+			spec.ranges = append(spec.ranges, r)
+		}
+	}
+	return spec, nil
+}
+
+// parseResRange parses a range like '10-150', '-150', '10-' or '10'.
+// Negative residue numbers are allowed, as in '-5-20'.
+func parseResRange(s string) (resRange, error) {
+	r := resRange{resRangeMin, resRangeMax}
+	bad := fmt.Errorf("Invalid residue range '%s'", s)
+
+	// Find the dash separating the two numbers, skipping a leading minus
+	// sign of the first number.
+	dash := -1
+	for i := 1; i < len(s); i++ {
+		if s[i] == '-' {
+			dash = i
+			break
+		}
+	}
+	if len(s) > 0 && s[0] == '-' && dash == -1 {
+		dash = 0
+	}
+	if dash == -1 {
+		num, err := strconv.Atoi(s)
+		if err != nil {
+			return r, bad
+		}
+		return resRange{num, num}, nil
+	}
+
+	var err error
+	if start := s[:dash]; len(start) > 0 {
+		if r.start, err = strconv.Atoi(start); err != nil {
+			return r, bad
+		}
+	}
+	if end := s[dash+1:]; len(end) > 0 {
+		if r.end, err = strconv.Atoi(end); err != nil {
+			return r, bad
+		}
+	}
+	if r.start > r.end {
+		return r, bad
+	}
+	return r, nil
+}
+
+// open reads the PDB entries selected. When residue ranges are selected, an
+// entry is returned for each range that contains only the residues in that
+// range (for the selected chain).
+func (spec bowerSpec) open() ([]*structFile, error) {
+	if spec.model == 0 && len(spec.ranges) == 0 {
+		sf, err := pdbOpen(spec.path)
+		if err != nil {
+			return nil, err
+		}
+		if err := sf.selectChains(spec.chains); err != nil {
+			return nil, err
+		}
+		return []*structFile{sf}, nil
+	}
+
+	records, chainNames, err := readRecords(spec.path)
+	if err != nil {
+		return nil, err
+	}
+	if spec.model > 0 {
+		if records, err = filterModel(records, spec.model); err != nil {
+			return nil, fmt.Errorf("%s in '%s'", err, spec.path)
+		}
+	}
+
+	read := func(records []byte) (*structFile, error) {
+		sf, err := newStructFile(spec.path, records, chainNames)
+		if err != nil {
+			return nil, err
+		}
+		if err := sf.selectChains(spec.chains); err != nil {
+			return nil, err
+		}
+		return sf, nil
+	}
+	if len(spec.ranges) == 0 {
+		sf, err := read(records)
+		if err != nil {
+			return nil, err
+		}
+		return []*structFile{sf}, nil
+	}
+
+	ident, ok := chainIdent(spec.chains[0], chainNames)
+	if !ok {
+		return nil, fmt.Errorf("Invalid chain name '%s' in '%s'",
+			spec.chains[0], spec.path)
+	}
+	var sfs []*structFile
+	for _, r := range spec.ranges {
+		sf, err := read(filterResidues(records, ident, r))
+		if err != nil {
+			return nil, err
+		}
+		sfs = append(sfs, sf)
+	}
+	return sfs, nil
+}
+
+// openChains reads the chains selected by a bower file argument. Identifiers
+// given for the argument are ignored. When
+// residue ranges are selected, each range is returned as a separate chain.
+func openChains(spec bowerSpec) ([]*pdb.Chain, error) {
+	sfs, err := spec.open()
+	if err != nil {
+		return nil, err
+	}
+	var chains []*pdb.Chain
+	for _, sf := range sfs {
+		chains = append(chains, sf.chains...)
+	}
+	return chains, nil
+}
+
+// selectChains removes every chain not named. If names is empty, all chains
+// are kept. It is an error if a chain named does not exist.
+func (sf *structFile) selectChains(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	var chains []*pdb.Chain
+	for _, name := range names {
+		found := false
+		for _, chain := range sf.chains {
+			if sf.chainName(chain) == name {
+				chains = append(chains, chain)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Protein chain '%s' not found in '%s'",
+				name, sf.path)
+		}
+	}
+	sf.chains = chains
+	return nil
+}
+
+// chainIdent returns the single character chain identifier for the chain name
+// given.
+func chainIdent(name string, chainNames map[byte]string) (byte, bool) {
+	for ident, longName := range chainNames {
+		if longName == name {
+			return ident, true
+		}
+	}
+	if len(name) == 1 {
+		return name[0], true
+	}
+	return 0, false
+}
+
+// readRecords returns the PDB records of a PDB or mmCIF file, along with the
+// original names of any renamed chains (see cifToPDB).
+func readRecords(fpath string) ([]byte, map[byte]string, error) {
+	f, err := openInput(fpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	if isCif(fpath) {
+		records, chainNames, err := cifToPDB(f)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not read '%s': %s", fpath, err)
+		}
+		return records, chainNames, nil
+	}
+	records, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read '%s': %s", fpath, err)
+	}
+	return records, nil, nil
+}
+
+// isCoordRecord returns true for records that belong to a model.
+func isCoordRecord(line []byte) bool {
+	for _, name := range []string{"ATOM", "HETATM", "ANISOU", "TER",
+		"SIGATM", "SIGUIJ"} {
+		if bytes.HasPrefix(line, []byte(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterModel removes the coordinates of every model except the one given.
+// A file without MODEL records has a single model numbered 1.
+func filterModel(records []byte, model int) ([]byte, error) {
+	var out bytes.Buffer
+	sawModels, found := false, false
+	current := 1
+	for _, line := range bytes.SplitAfter(records, []byte("\n")) {
+		switch {
+		case bytes.HasPrefix(line, []byte("MODEL")):
+			num, err := strconv.Atoi(string(bytes.TrimSpace(line[5:])))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid MODEL record '%s'",
+					bytes.TrimSpace(line))
+			}
+			sawModels, current = true, num
+			continue
+		case bytes.HasPrefix(line, []byte("ENDMDL")):
+			current = -1
+			continue
+		case isCoordRecord(line):
+			if current != model {
+				continue
+			}
+			found = true
+		}
+		out.Write(line)
+	}
+	if !found || (!sawModels && model != 1) {
+		return nil, fmt.Errorf("Model %d not found", model)
+	}
+	return out.Bytes(), nil
+}
+
+// filterResidues removes every residue of the chain given that is not in the
+// residue range given. The SEQRES records of the chain are rewritten to
+// contain only the residues left (including missing residues in range).
+func filterResidues(records []byte, chain byte, r resRange) []byte {
+	// Missing and observed residues are collected separately, each in the
+	// order they appear in the file, and merged when SEQRES is rewritten.
+	var missing, observed []seqresResidue
+	seen := make(map[[2]int]bool)
+	addResidue := func(residues *[]seqresResidue, num int, insCode byte,
+		name string) {
+		key := [2]int{num, int(insCode)}
+		if !seen[key] {
+			seen[key] = true
+			*residues = append(*residues, seqresResidue{num, insCode, name})
+		}
+	}
+	resNum := func(line []byte, from, to int) (int, bool) {
+		if len(line) < to {
+			return 0, false
+		}
+		num, err := strconv.Atoi(string(bytes.TrimSpace(line[from:to])))
+		return num, err == nil
+	}
+
+	var lines [][]byte
+	seqresAt := -1
+	seqresNames := make(map[string]bool)
+	for _, line := range bytes.SplitAfter(records, []byte("\n")) {
+		switch {
+		case bytes.HasPrefix(line, []byte("SEQRES")) &&
+			len(line) > 11 && line[11] == chain:
+			for _, name := range bytes.Fields(line[19:]) {
+				seqresNames[string(name)] = true
+			}
+			if seqresAt == -1 {
+				seqresAt = len(lines)
+				lines = append(lines, nil) // replaced below
+			}
+			continue
+		case bytes.HasPrefix(line, []byte("REMARK 465")) &&
+			len(line) > 19 && line[19] == chain:
+			if num, ok := resNum(line, 21, 26); ok {
+				if !r.contains(num) {
+					continue
+				}
+				insCode := byte(' ')
+				if len(line) > 26 && line[26] != '\n' {
+					insCode = line[26]
+				}
+				addResidue(&missing, num, insCode,
+					string(bytes.TrimSpace(line[15:18])))
+			}
+		case isCoordRecord(line) && len(line) > 21 && line[21] == chain:
+			num, ok := resNum(line, 22, 26)
+			if !ok {
+				// TER records may not have a residue.
+				break
+			}
+			if !r.contains(num) {
+				continue
+			}
+			isAtom := bytes.HasPrefix(line, []byte("ATOM"))
+			isHet := bytes.HasPrefix(line, []byte("HETATM"))
+			if len(line) > 26 && (isAtom || isHet) {
+				name := string(bytes.TrimSpace(line[17:20]))
+				if isAtom || seqresNames[name] {
+					addResidue(&observed, num, line[26], name)
+				}
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	if seqresAt > -1 {
+		residues := mergeSeqres(missing, observed)
+		var seqres bytes.Buffer
+		for i := 0; i*13 < len(residues); i++ {
+			var names []string
+			for j := i * 13; j < (i+1)*13 && j < len(residues); j++ {
+				names = append(names, residues[j].name)
+			}
+			fmt.Fprintf(&seqres, "SEQRES %3d %s %4d  %s\n",
+				i+1, []byte{chain}, len(residues), seqresRow(names))
+		}
+		lines[seqresAt] = seqres.Bytes()
+	}
+	return bytes.Join(lines, nil)
+}
+
+type seqresResidue struct {
+	num     int
+	insCode byte
+	name    string
+}
+
+// mergeSeqres merges the missing residues of a chain into its observed
+// residues. The observed residues stay in the order of their coordinates,
+// even if their numbering isn't monotonic, and each missing residue goes
+// before the first observed residue numbered after it.
+func mergeSeqres(missing, observed []seqresResidue) []seqresResidue {
+	merged := make([]seqresResidue, 0, len(missing)+len(observed))
+	for _, res := range observed {
+		for len(missing) > 0 && missing[0].before(res) {
+			merged = append(merged, missing[0])
+			missing = missing[1:]
+		}
+		merged = append(merged, res)
+	}
+	return append(merged, missing...)
+}
+
+// before returns true if the residue is numbered before the one given.
+func (res seqresResidue) before(other seqresResidue) bool {
+	if res.num != other.num {
+		return res.num < other.num
+	}
+	return res.insCode < other.insCode
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestFilterResiduesOrder checks that SEQRES is rewritten with the residues
+// in the order of the file when their numbering isn't monotonic (here,
+// residue 10 comes after residue 100), with each missing residue placed
+// before the first residue numbered after it.
+func TestFilterResiduesOrder(t *testing.T) {
+	records := strings.Join([]string{
+		"REMARK 465     GLY A     2",
+		"SEQRES   1 A    4  MET GLY ALA SER",
+		"ATOM      1  CA  MET A   1       0.000   0.000   0.000",
+		"ATOM      2  CA  ALA A 100       0.000   0.000   0.000",
+		"ATOM      3  CA  SER A  10       0.000   0.000   0.000",
+		"ATOM      4  CA  TRP A  20       0.000   0.000   0.000",
+		"",
+	}, "\n")
+	filtered := filterResidues([]byte(records), 'A', resRange{1, 100})
+
+	expected := "SEQRES   1 A    5  MET GLY ALA SER TRP"
+	for _, line := range strings.Split(string(filtered), "\n") {
+		if strings.HasPrefix(line, "SEQRES") {
+			if line != expected {
+				t.Errorf("Got '%s', expected '%s'.", line, expected)
+			}
+			return
+		}
+	}
+	t.Errorf("SEQRES not found:\n%s", filtered)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/TuftsBCB/io/pdb"
+	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/flib/build"
+	"github.com/ndaniels/tools/util"
+)
+
+var flagErrors = ""
+
+// The reasons that an input is skipped. All but parse errors are the errors
+// returned by the build package for chains without windows.
+var (
+	skipParse  = "parse error"
+	skipNoCa   = build.ErrNoCaAtoms.Error()
+	skipShort  = build.ErrTooShort.Error()
+	skipGapped = build.ErrAllGapped.Error()
+)
+
+// The order that reasons are listed in the summary.
+var skipReasons = []string{skipParse, skipNoCa, skipShort, skipGapped}
+
+func (c *command) setErrorsFlag() {
+	c.flags.StringVar(&flagErrors, "errors", flagErrors,
+		"When set, every bower file argument, chain or bower that could\n"+
+			"not be used is written to the file given as tab-separated\n"+
+			"values, along with the reason.")
+}
+
+// skipped collects the inputs that could not be used by the command being
+// run. A summary is shown when the command finishes, and each input is
+// written to the '-errors' file if one was given.
+var skipped = &skipReport{counts: make(map[string]int)}
+
+// skipReport records inputs that could not be used, by reason.
+type skipReport struct {
+	lock   sync.Mutex
+	counts map[string]int
+	path   string
+	f      *os.File
+	buf    *bufio.Writer
+}
+
+// open starts writing skipped inputs to the file at the path given. Nothing
+// is written if the path is empty.
+func (r *skipReport) open(fpath string) {
+	if len(fpath) == 0 {
+		return
+	}
+	r.path = fpath
+	r.f = util.CreateFile(fpath)
+	r.buf = bufio.NewWriter(r.f)
+	fmt.Fprintf(r.buf, "input\tentry\treason\tdetail\n")
+}
+
+// add records a skipped input. The entry is the chain or bower of the input
+// that was skipped, and is empty if the whole input was skipped.
+func (r *skipReport) add(input, entry, reason, detail string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.counts[reason]++
+	if r.buf != nil {
+		if len(entry) == 0 {
+			entry = "-"
+		}
+		if len(detail) == 0 {
+			detail = "-"
+		}
+		fmt.Fprintf(r.buf, "%s\t%s\t%s\t%s\n", input, entry, reason, detail)
+	}
+}
+
+// input records a bower file argument that could not be read.
+func (r *skipReport) input(spec bowerSpec, err error) {
+	r.add(spec.String(), "", skipParse, err.Error())
+}
+
+// chain records a chain of a bower file argument that was skipped because
+// of the error given (see build.ChainWindows). Nothing is recorded if the
+// error is nil or if the chain isn't a protein.
+func (r *skipReport) chain(spec bowerSpec, chain *pdb.Chain, err error) {
+	if err == nil || !chain.IsProtein() {
+		return
+	}
+	sequence := chain.AsSequence()
+	util.Verbosef("Skipping chain '%s' of '%s' (length: %d): %s",
+		sequence.Name, spec, sequence.Len(), err)
+	r.add(spec.String(), string(chain.Ident), err.Error(),
+		fmt.Sprintf("%d residues", sequence.Len()))
+}
+
+// bower records a bower whose BOW with the library given is empty because
+// none of its windows can be counted.
+func (r *skipReport) bower(
+	spec bowerSpec,
+	b *build.Bower,
+	lib fragbag.Library,
+) {
+	if b.Windows(lib) > 0 {
+		return
+	}
+	reason := skipShort
+	if fragbag.IsStructure(lib) && len(b.AllAtoms()) == 0 {
+		reason = skipNoCa
+	}
+	r.add(spec.String(), b.Id, reason,
+		fmt.Sprintf("%d residues", len(b.Residues())))
+}
+
+// close writes the '-errors' file and shows a summary of the inputs skipped,
+// if there are any.
+func (r *skipReport) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.buf != nil {
+		util.Assert(r.buf.Flush(), "Could not write '%s'", r.path)
+		util.Assert(r.f.Close(), "Could not write '%s'", r.path)
+	}
+	total := 0
+	for _, count := range r.counts {
+		total += count
+	}
+	if total == 0 || util.FlagQuiet {
+		return
+	}
+	log.Printf("%d inputs could not be used:", total)
+	for _, reason := range skipReasons {
+		if r.counts[reason] > 0 {
+			log.Printf("    %s: %d", reason, r.counts[reason])
+		}
+	}
+	if len(r.path) > 0 {
+		log.Printf("Details were written to '%s'.", r.path)
+	} else {
+		log.Printf("Use '-errors' to list them.")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import "strings"
+
+// This file implements the local alignment of two protein sequences with
+// the Smith-Waterman algorithm, using the BLOSUM62 substitution matrix and
+// affine gap penalties (Gotoh, 1982).
+
+const (
+	// The cost of a gap of length n is swGapOpen + n*swGapExtend, as in the
+	// default BLASTP scoring.
+	swGapOpen   = 11
+	swGapExtend = 1
+)
+
+// seqAlignment is the result of aligning the sequence of a query with the
+// sequence of a hit.
+type seqAlignment struct {
+	// The score of the best local alignment.
+	score int
+
+	// The fraction of the columns of the alignment with identical residues.
+	// Unknown residues ('X') are never identical.
+	identity float64
+
+	// The fraction of the query's residues that are in the alignment.
+	coverage float64
+}
+
+// The order of the residues in the rows and columns of blosum62.
+const blosumResidues = "ARNDCQEGHILKMFPSTWYVBZX*"
+
+var blosum62 = [24][24]int8{
+	{4, -1, -2, -2, 0, -1, -1, 0, -2, -1, -1, -1, -1, -2, -1, 1, 0, -3, -2, 0, -2, -1, 0, -4},
+	{-1, 5, 0, -2, -3, 1, 0, -2, 0, -3, -2, 2, -1, -3, -2, -1, -1, -3, -2, -3, -1, 0, -1, -4},
+	{-2, 0, 6, 1, -3, 0, 0, 0, 1, -3, -3, 0, -2, -3, -2, 1, 0, -4, -2, -3, 3, 0, -1, -4},
+	{-2, -2, 1, 6, -3, 0, 2, -1, -1, -3, -4, -1, -3, -3, -1, 0, -1, -4, -3, -3, 4, 1, -1, -4},
+	{0, -3, -3, -3, 9, -3, -4, -3, -3, -1, -1, -3, -1, -2, -3, -1, -1, -2, -2, -1, -3, -3, -2, -4},
+	{-1, 1, 0, 0, -3, 5, 2, -2, 0, -3, -2, 1, 0, -3, -1, 0, -1, -2, -1, -2, 0, 3, -1, -4},
+	{-1, 0, 0, 2, -4, 2, 5, -2, 0, -3, -3, 1, -2, -3, -1, 0, -1, -3, -2, -2, 1, 4, -1, -4},
+	{0, -2, 0, -1, -3, -2, -2, 6, -2, -4, -4, -2, -3, -3, -2, 0, -2, -2, -3, -3, -1, -2, -1, -4},
+	{-2, 0, 1, -1, -3, 0, 0, -2, 8, -3, -3, -1, -2, -1, -2, -1, -2, -2, 2, -3, 0, 0, -1, -4},
+	{-1, -3, -3, -3, -1, -3, -3, -4, -3, 4, 2, -3, 1, 0, -3, -2, -1, -3, -1, 3, -3, -3, -1, -4},
+	{-1, -2, -3, -4, -1, -2, -3, -4, -3, 2, 4, -2, 2, 0, -3, -2, -1, -2, -1, 1, -4, -3, -1, -4},
+	{-1, 2, 0, -1, -3, 1, 1, -2, -1, -3, -2, 5, -1, -3, -1, 0, -1, -3, -2, -2, 0, 1, -1, -4},
+	{-1, -1, -2, -3, -1, 0, -2, -3, -2, 1, 2, -1, 5, 0, -2, -1, -1, -1, -1, 1, -3, -1, -1, -4},
+	{-2, -3, -3, -3, -2, -3, -3, -3, -1, 0, 0, -3, 0, 6, -4, -2, -2, 1, 3, -1, -3, -3, -1, -4},
+	{-1, -2, -2, -1, -3, -1, -1, -2, -2, -3, -3, -1, -2, -4, 7, -1, -1, -4, -3, -2, -2, -1, -2, -4},
+	{1, -1, 1, 0, -1, 0, 0, 0, -1, -2, -2, 0, -1, -2, -1, 4, 1, -3, -2, -2, 0, 0, 0, -4},
+	{0, -1, 0, -1, -1, -1, -1, -2, -2, -1, -1, -1, -1, -2, -1, 1, 5, -2, -2, 0, -1, -1, 0, -4},
+	{-3, -3, -4, -4, -2, -2, -3, -2, -2, -3, -2, -3, -1, 1, -4, -3, -2, 11, 2, -3, -4, -3, -2, -4},
+	{-2, -2, -2, -3, -2, -1, -2, -3, 2, -1, -1, -2, -1, 3, -3, -2, -2, 2, 7, -1, -3, -2, -1, -4},
+	{0, -3, -3, -3, -1, -2, -2, -3, -3, 3, 1, -2, 1, -1, -2, -2, 0, -3, -1, 4, -3, -2, -1, -4},
+	{-2, -1, 3, 4, -3, 0, 1, -1, 0, -3, -4, 0, -3, -3, -2, 0, -1, -4, -3, -3, 4, 1, -1, -4},
+	{-1, 0, 0, 1, -3, 3, 4, -2, 0, -3, -3, 1, -1, -3, -1, 0, -1, -3, -2, -2, 1, 4, -1, -4},
+	{0, -1, -1, -1, -2, -1, -1, -1, -1, -1, -1, -1, -1, -1, -2, 0, 0, -2, -1, -1, -1, -1, -1, -4},
+	{-4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, -4, 1},
+}
+
+// blosumIndex returns the positions of the residues given in blosum62.
+// Residues that aren't in the matrix are treated as 'X'.
+func blosumIndex(residues string) []uint8 {
+	unknown := strings.IndexByte(blosumResidues, 'X')
+	idx := make([]uint8, len(residues))
+	for i := 0; i < len(residues); i++ {
+		c := residues[i]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		j := strings.IndexByte(blosumResidues, c)
+		if j < 0 {
+			j = unknown
+		}
+		idx[i] = uint8(j)
+	}
+	return idx
+}
+
+// Where each cell of the alignment matrices comes from, for the traceback.
+const (
+	swStop = iota
+	swDiag
+	swFromE // a gap in the query
+	swFromF // a gap in the hit
+
+	swExtendE = 1 << 2 // E extends the gap to its left rather than opening one
+	swExtendF = 1 << 3 // F extends the gap above it rather than opening one
+)
+
+// swAlign returns the best local alignment of the query and hit sequences
+// given.
+func swAlign(query, hit string) seqAlignment {
+	q, h := blosumIndex(query), blosumIndex(hit)
+	n, m := len(q), len(h)
+	if n == 0 || m == 0 {
+		return seqAlignment{}
+	}
+
+	// H is the best score of an alignment ending at (i, j), E the best
+	// ending with a gap in the query and F the best ending with a gap in
+	// the hit. Only the previous row of each is kept.
+	const negInf = -1 << 30
+	hPrev, hCur := make([]int, m+1), make([]int, m+1)
+	fPrev, fCur := make([]int, m+1), make([]int, m+1)
+	for j := range fPrev {
+		fPrev[j] = negInf
+	}
+	trace := make([][]uint8, n+1)
+	trace[0] = make([]uint8, m+1)
+
+	best, bestI, bestJ := 0, 0, 0
+	for i := 1; i <= n; i++ {
+		trace[i] = make([]uint8, m+1)
+		hCur[0], fCur[0] = 0, negInf
+		e := negInf
+		row := blosum62[q[i-1]]
+		for j := 1; j <= m; j++ {
+			var t uint8
+
+			open, extend := hCur[j-1]-swGapOpen-swGapExtend, e-swGapExtend
+			if extend > open {
+				e, t = extend, t|swExtendE
+			} else {
+				e = open
+			}
+			open, extend = hPrev[j]-swGapOpen-swGapExtend, fPrev[j]-swGapExtend
+			if extend > open {
+				fCur[j], t = extend, t|swExtendF
+			} else {
+				fCur[j] = open
+			}
+
+			score, from := 0, uint8(swStop)
+			if d := hPrev[j-1] + int(row[h[j-1]]); d > score {
+				score, from = d, swDiag
+			}
+			if e > score {
+				score, from = e, swFromE
+			}
+			if fCur[j] > score {
+				score, from = fCur[j], swFromF
+			}
+			hCur[j] = score
+			trace[i][j] = t | from
+			if score > best {
+				best, bestI, bestJ = score, i, j
+			}
+		}
+		hPrev, hCur = hCur, hPrev
+		fPrev, fCur = fCur, fPrev
+	}
+	if best == 0 {
+		return seqAlignment{}
+	}
+
+	// Follow the alignment back from its end to count identities.
+	unknown := blosumIndex("X")[0]
+	columns, identical := 0, 0
+	i, j, state := bestI, bestJ, uint8(swDiag)
+traceback:
+	for i > 0 && j > 0 {
+		t := trace[i][j]
+		switch state {
+		case swDiag:
+			switch t & 3 {
+			case swStop:
+				break traceback
+			case swFromE, swFromF:
+				state = t & 3
+				continue
+			}
+			if q[i-1] == h[j-1] && q[i-1] != unknown {
+				identical++
+			}
+			i, j = i-1, j-1
+		case swFromE:
+			if t&swExtendE == 0 {
+				state = swDiag
+			}
+			j--
+		case swFromF:
+			if t&swExtendF == 0 {
+				state = swDiag
+			}
+			i--
+		}
+		columns++
+	}
+	return seqAlignment{
+		score:    best,
+		identity: float64(identical) / float64(columns),
+		coverage: float64(bestI-i) / float64(n),
+	}
+}
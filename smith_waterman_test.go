@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSwAlign(t *testing.T) {
+	tests := []struct {
+		query, hit string
+		score      int
+		identity   float64
+		coverage   float64
+	}{
+		// A4 C9 D6 E5 F6 G6 H8 I4 K5
+		{"ACDEFGHIK", "ACDEFGHIK", 53, 1, 1},
+		{"acdefghik", "ACDEFGHIK", 53, 1, 1},
+
+		// F/Y scores 3 instead of 6.
+		{"ACDEFGHIK", "ACDEYGHIK", 50, 8.0 / 9.0, 1},
+
+		// Only the tryptophans (W11) are aligned, since P/G scores -2.
+		{"PPPPWWWWW", "GGGGWWWWW", 55, 1, 5.0 / 9.0},
+
+		// W11 and C9, with a gap of length 3 in the query costing 11 + 3.
+		{"WWWWWCCCCC", "WWWWWGGGCCCCC", 55 + 45 - 14, 10.0 / 13.0, 1},
+
+		// The same gap in the hit.
+		{"WWWWWGGGCCCCC", "WWWWWCCCCC", 55 + 45 - 14, 10.0 / 13.0, 1},
+
+		// X/X scores -1 and is not identical.
+		{"WWWWXWWWW", "WWWWXWWWW", 44 - 1 + 44, 8.0 / 9.0, 1},
+
+		// Residues that aren't in BLOSUM62 are treated as 'X'.
+		{"WWWWOWWWW", "WWWWJWWWW", 44 - 1 + 44, 8.0 / 9.0, 1},
+
+		// W/P scores -4, so there is no alignment.
+		{"WWW", "PPP", 0, 0, 0},
+		{"", "WWW", 0, 0, 0},
+	}
+	for _, test := range tests {
+		aln := swAlign(test.query, test.hit)
+		if aln.score != test.score ||
+			math.Abs(aln.identity-test.identity) > 1e-9 ||
+			math.Abs(aln.coverage-test.coverage) > 1e-9 {
+			t.Errorf("Aligning '%s' with '%s': got score %d, identity %g "+
+				"and coverage %g, but expected %d, %g and %g.",
+				test.query, test.hit, aln.score, aln.identity, aln.coverage,
+				test.score, test.identity, test.coverage)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"math"
+
+	"github.com/TuftsBCB/structure"
+)
+
+// This file implements a structural alignment of two chains of alpha-carbon
+// atoms in the style of TM-align (Zhang and Skolnick, 2005): an initial
+// gapless alignment is refined by dynamic programming on a similarity matrix
+// computed from the superposition of the current alignment, and the final
+// alignment is scored with the TM-score.
+
+const (
+	// The penalty for opening a gap in the dynamic programming. Gaps are not
+	// penalized at either end of an alignment, and extending a gap is free.
+	tmGapOpen = -0.6
+
+	// The maximum number of rounds of dynamic programming.
+	tmMaxRounds = 20
+
+	// Residues further apart than this (in angstroms) after superposition
+	// are not counted as aligned for the RMSD.
+	tmAlignedCutoff = 5.0
+)
+
+// structAlignment is the result of aligning the structure of a query with
+// the structure of a hit.
+type structAlignment struct {
+	// The TM-score, normalized by the length of the query.
+	tmScore float64
+
+	// The RMSD of the aligned residues.
+	rmsd float64
+
+	// The number of residues that are aligned within tmAlignedCutoff of each
+	// other.
+	aligned int
+}
+
+type vec3 [3]float64
+
+func (v vec3) sub(u vec3) vec3 { return vec3{v[0] - u[0], v[1] - u[1], v[2] - u[2]} }
+
+func (v vec3) dist2(u vec3) float64 {
+	d := v.sub(u)
+	return d[0]*d[0] + d[1]*d[1] + d[2]*d[2]
+}
+
+func toVec3s(atoms []structure.Coords) []vec3 {
+	vs := make([]vec3, len(atoms))
+	for i, a := range atoms {
+		vs[i] = vec3{a.X, a.Y, a.Z}
+	}
+	return vs
+}
+
+// transform is a rotation followed by a translation.
+type transform struct {
+	rot   [3][3]float64
+	trans vec3
+}
+
+func (t transform) apply(v vec3) vec3 {
+	var r vec3
+	for i := 0; i < 3; i++ {
+		r[i] = t.rot[i][0]*v[0] + t.rot[i][1]*v[1] + t.rot[i][2]*v[2] +
+			t.trans[i]
+	}
+	return r
+}
+
+// tmPair is a pair of aligned residues, given by their positions in the
+// query and the hit.
+type tmPair struct{ x, y int }
+
+// tmAlign aligns the structure x with the structure y and returns the
+// TM-score of the best alignment found, normalized by the length of x.
+func tmAlign(xAtoms, yAtoms []structure.Coords) structAlignment {
+	x, y := toVec3s(xAtoms), toVec3s(yAtoms)
+	if len(x) < 3 || len(y) < 3 {
+		return structAlignment{}
+	}
+	d0 := tmD0(len(x))
+
+	// Start with the best alignment without gaps.
+	var best []tmPair
+	bestScore := -1.0
+	minOverlap := len(x)
+	if len(y) < minOverlap {
+		minOverlap = len(y)
+	}
+	minOverlap /= 2
+	if minOverlap < 3 {
+		minOverlap = 3
+	}
+	for shift := -(len(x) - minOverlap); shift <= len(y)-minOverlap; shift++ {
+		var pairs []tmPair
+		for i := range x {
+			if j := i + shift; j >= 0 && j < len(y) {
+				pairs = append(pairs, tmPair{i, j})
+			}
+		}
+		if score, _ := tmQuickScore(x, y, pairs, d0); score > bestScore {
+			best, bestScore = pairs, score
+		}
+	}
+
+	// Then refine it with dynamic programming, until the alignment stops
+	// improving.
+	bestScore, t := tmSearch(x, y, best, d0, true)
+	for round := 0; round < tmMaxRounds; round++ {
+		pairs := tmDynamic(x, y, t, d0)
+		score, next := tmSearch(x, y, pairs, d0, true)
+		if score <= bestScore+1e-6 {
+			break
+		}
+		best, bestScore, t = pairs, score, next
+	}
+
+	score, t := tmSearch(x, y, best, d0, false)
+	return structAlignment{tmScore: score}.withRMSD(x, y, best, t)
+}
+
+// withRMSD sets the RMSD and number of aligned residues of the alignment:
+// the pairs within tmAlignedCutoff of each other with the transform given
+// are superposed again, and their RMSD is computed.
+func (sa structAlignment) withRMSD(
+	x, y []vec3,
+	pairs []tmPair,
+	t transform,
+) structAlignment {
+	var close []tmPair
+	for _, p := range pairs {
+		if t.apply(x[p.x]).dist2(y[p.y]) < tmAlignedCutoff*tmAlignedCutoff {
+			close = append(close, p)
+		}
+	}
+	sa.aligned = len(close)
+	if len(close) < 3 {
+		return sa
+	}
+	t = superpose(x, y, close)
+	sum := 0.0
+	for _, p := range close {
+		sum += t.apply(x[p.x]).dist2(y[p.y])
+	}
+	sa.rmsd = math.Sqrt(sum / float64(len(close)))
+	return sa
+}
+
+// tmD0 returns the distance scale of the TM-score for a protein with n
+// residues.
+func tmD0(n int) float64 {
+	if n <= 21 {
+		return 0.5
+	}
+	d0 := 1.24*math.Cbrt(float64(n-15)) - 1.8
+	if d0 < 0.5 {
+		d0 = 0.5
+	}
+	return d0
+}
+
+// tmScoreWith returns the TM-score of the pairs given under the transform
+// given, along with the pairs that are within cutoff of each other.
+func tmScoreWith(
+	x, y []vec3,
+	pairs []tmPair,
+	t transform,
+	d0, cutoff float64,
+) (float64, []tmPair) {
+	score := 0.0
+	var close []tmPair
+	for _, p := range pairs {
+		d2 := t.apply(x[p.x]).dist2(y[p.y])
+		score += 1 / (1 + d2/(d0*d0))
+		if d2 < cutoff*cutoff {
+			close = append(close, p)
+		}
+	}
+	return score / float64(len(x)), close
+}
+
+// tmQuickScore approximates the TM-score of the alignment given by
+// superposing all of its pairs, and then only the pairs that are close.
+func tmQuickScore(x, y []vec3, pairs []tmPair, d0 float64) (float64, transform) {
+	t := superpose(x, y, pairs)
+	score, close := tmScoreWith(x, y, pairs, t, d0, tmSearchCutoff(d0))
+	if len(close) >= 3 && len(close) < len(pairs) {
+		t2 := superpose(x, y, close)
+		if score2, _ := tmScoreWith(x, y, pairs, t2, d0, 0); score2 > score {
+			return score2, t2
+		}
+	}
+	return score, t
+}
+
+// tmSearchCutoff returns the distance within which pairs are used for the
+// next superposition when searching for the best one.
+func tmSearchCutoff(d0 float64) float64 {
+	return math.Max(4.5, math.Min(8, d0))
+}
+
+// tmSearch returns the best TM-score of the alignment given and the
+// transform that achieves it. Superpositions of fragments of the alignment
+// are extended iteratively with the pairs that they bring close together.
+// When fast is true, fewer and longer fragments are tried.
+func tmSearch(
+	x, y []vec3,
+	pairs []tmPair,
+	d0 float64,
+	fast bool,
+) (float64, transform) {
+	n := len(pairs)
+	if n < 3 {
+		return 0, transform{rot: [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}}
+	}
+	maxIters, maxStarts, minLen := 20, 20, 4
+	if fast {
+		maxIters, maxStarts, minLen = 5, 4, n/2
+	}
+	if minLen < 3 {
+		minLen = 3
+	}
+	if minLen > n {
+		minLen = n
+	}
+	cutoff := tmSearchCutoff(d0)
+
+	bestScore := -1.0
+	var best transform
+	for l := n; ; l /= 2 {
+		if l < minLen {
+			l = minLen
+		}
+		step := (n - l) / maxStarts
+		if step < 1 {
+			step = 1
+		}
+		for start := 0; start+l <= n; start += step {
+			sel := pairs[start : start+l]
+			for iter := 0; iter < maxIters; iter++ {
+				t := superpose(x, y, sel)
+				score, close := tmScoreWith(x, y, pairs, t, d0, cutoff)
+				if score > bestScore {
+					bestScore, best = score, t
+				}
+				for c := cutoff + 0.5; len(close) < 3 && c < 2*cutoff+8; c += 0.5 {
+					_, close = tmScoreWith(x, y, pairs, t, d0, c)
+				}
+				if len(close) < 3 || samePairs(close, sel) {
+					break
+				}
+				sel = close
+			}
+		}
+		if l == minLen {
+			break
+		}
+	}
+	return bestScore, best
+}
+
+func samePairs(a, b []tmPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tmDynamic returns the alignment of x and y that maximizes the sum of
+// residue similarities after applying the transform given to x.
+func tmDynamic(x, y []vec3, t transform, d0 float64) []tmPair {
+	const (
+		diag = iota
+		up
+		left
+	)
+	n, m := len(x), len(y)
+	val := make([][]float64, n+1)
+	dir := make([][]uint8, n+1)
+	for i := range val {
+		val[i] = make([]float64, m+1)
+		dir[i] = make([]uint8, m+1)
+		dir[i][0] = up
+	}
+	for j := range dir[0] {
+		dir[0][j] = left
+	}
+
+	moved := make([]vec3, n)
+	for i := range x {
+		moved[i] = t.apply(x[i])
+	}
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			d := val[i-1][j-1] + 1/(1+moved[i-1].dist2(y[j-1])/(d0*d0))
+			h := val[i-1][j]
+			if dir[i-1][j] == diag && j < m {
+				h += tmGapOpen
+			}
+			v := val[i][j-1]
+			if dir[i][j-1] == diag && i < n {
+				v += tmGapOpen
+			}
+			switch {
+			case d >= h && d >= v:
+				val[i][j], dir[i][j] = d, diag
+			case h >= v:
+				val[i][j], dir[i][j] = h, up
+			default:
+				val[i][j], dir[i][j] = v, left
+			}
+		}
+	}
+
+	var pairs []tmPair
+	for i, j := n, m; i > 0 && j > 0; {
+		switch dir[i][j] {
+		case diag:
+			pairs = append(pairs, tmPair{i - 1, j - 1})
+			i, j = i-1, j-1
+		case up:
+			i--
+		default:
+			j--
+		}
+	}
+	for i, j := 0, len(pairs)-1; i < j; i, j = i+1, j-1 {
+		pairs[i], pairs[j] = pairs[j], pairs[i]
+	}
+	return pairs
+}
+
+// superpose returns the transform that minimizes the RMSD between the atoms
+// of x and y in the pairs given, using the quaternion method of Horn (1987).
+func superpose(x, y []vec3, pairs []tmPair) transform {
+	var cx, cy vec3
+	for _, p := range pairs {
+		for k := 0; k < 3; k++ {
+			cx[k] += x[p.x][k]
+			cy[k] += y[p.y][k]
+		}
+	}
+	for k := 0; k < 3; k++ {
+		cx[k] /= float64(len(pairs))
+		cy[k] /= float64(len(pairs))
+	}
+
+	var s [3][3]float64
+	for _, p := range pairs {
+		a, b := x[p.x].sub(cx), y[p.y].sub(cy)
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				s[i][j] += a[i] * b[j]
+			}
+		}
+	}
+	sxx, sxy, sxz := s[0][0], s[0][1], s[0][2]
+	syx, syy, syz := s[1][0], s[1][1], s[1][2]
+	szx, szy, szz := s[2][0], s[2][1], s[2][2]
+	q := maxEigenvector([4][4]float64{
+		{sxx + syy + szz, syz - szy, szx - sxz, sxy - syx},
+		{syz - szy, sxx - syy - szz, sxy + syx, szx + sxz},
+		{szx - sxz, sxy + syx, -sxx + syy - szz, syz + szy},
+		{sxy - syx, szx + sxz, syz + szy, -sxx - syy + szz},
+	})
+
+	q0, q1, q2, q3 := q[0], q[1], q[2], q[3]
+	t := transform{rot: [3][3]float64{
+		{q0*q0 + q1*q1 - q2*q2 - q3*q3, 2 * (q1*q2 - q0*q3), 2 * (q1*q3 + q0*q2)},
+		{2 * (q1*q2 + q0*q3), q0*q0 - q1*q1 + q2*q2 - q3*q3, 2 * (q2*q3 - q0*q1)},
+		{2 * (q1*q3 - q0*q2), 2 * (q2*q3 + q0*q1), q0*q0 - q1*q1 - q2*q2 + q3*q3},
+	}}
+	rcx := t.apply(cx)
+	t.trans = cy.sub(rcx)
+	return t
+}
+
+// maxEigenvector returns the unit eigenvector of the symmetric matrix given
+// with the largest eigenvalue, using the cyclic Jacobi method.
+func maxEigenvector(a [4][4]float64) [4]float64 {
+	var v [4][4]float64
+	for i := range v {
+		v[i][i] = 1
+	}
+	for sweep := 0; sweep < 50; sweep++ {
+		off := 0.0
+		for p := 0; p < 4; p++ {
+			for q := p + 1; q < 4; q++ {
+				off += a[p][q] * a[p][q]
+			}
+		}
+		if off < 1e-22 {
+			break
+		}
+		for p := 0; p < 4; p++ {
+			for q := p + 1; q < 4; q++ {
+				if math.Abs(a[p][q]) < 1e-300 {
+					continue
+				}
+				theta := (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t := 1 / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				if theta < 0 {
+					t = -t
+				}
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+				for k := 0; k < 4; k++ {
+					akp, akq := a[k][p], a[k][q]
+					a[k][p], a[k][q] = c*akp-s*akq, s*akp+c*akq
+				}
+				for k := 0; k < 4; k++ {
+					apk, aqk := a[p][k], a[q][k]
+					a[p][k], a[q][k] = c*apk-s*aqk, s*apk+c*aqk
+				}
+				for k := 0; k < 4; k++ {
+					vkp, vkq := v[k][p], v[k][q]
+					v[k][p], v[k][q] = c*vkp-s*vkq, s*vkp+c*vkq
+				}
+			}
+		}
+	}
+	best := 0
+	for i := 1; i < 4; i++ {
+		if a[i][i] > a[best][best] {
+			best = i
+		}
+	}
+	return [4]float64{v[0][best], v[1][best], v[2][best], v[3][best]}
+}
@@ -26,16 +26,24 @@ N+1 entries, where N is the number of fragments given in the library.
 Note that if a weighted fragment library is given, then the frequencies
 will be reported as floating point values.
 
-Bower files may either be PDB files or FASTA files.
-`,
+Bower files may be PDB, mmCIF or FASTA files. Files ending with '.gz' are
+decompressed automatically.
+` + domainsHelp + bowerFilesHelp,
 	flags: flag.NewFlagSet("vectors", flag.ExitOnError),
 	run:   vectors,
+	addFlags: func(c *command) {
+		c.setModelsFlag()
+		c.setBowerListFlag()
+		c.setErrorsFlag()
+		c.setDomainsFlag()
+		c.setBowFlags()
+	},
 }
 
 func vectors(c *command) {
-	c.assertLeastNArg(2)
+	c.assertLeastNArg(1)
 	flib := util.Library(c.flags.Arg(0))
-	bowPaths := c.flags.Args()[1:]
+	bowSpecs := c.bowerSpecs(1, true)
 
 	tostrs := func(freqs []float32) []string {
 		strs := make([]string, len(freqs))
@@ -45,9 +53,10 @@ func vectors(c *command) {
 		return strs
 	}
 
-	results := util.ProcessBowers(bowPaths, flib, flagPairdistModels,
-		flagCpu, true)
+	results := processBowers(commandContext(), bowSpecs, flib, flagModels,
+		flagBowOpts, true)
 	for r := range results {
 		fmt.Printf("%s\t%s\n", r.Id, strings.Join(tostrs(r.Bow.Freqs), "\t"))
 	}
+	exitIfCancelled(nil)
 }
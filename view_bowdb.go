@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ndaniels/flib/query"
+	"github.com/ndaniels/tools/util"
+)
+
+var flagViewBowDbEntries = false
+
+var cmdViewBowDb = &command{
+	name:            "view-bowdb",
+	positionalUsage: "bowdb-path",
+	shortHelp:       "view information about a BOW database",
+	help: `
+View information about a BOW database: its fragment library, the number of
+entries, the options used to compute its BOWs and the extra files stored
+with it (sequences, an index or a columnar file).
+
+If the database was created by a version of flib that records provenance,
+then the time it was created, the version of flib and the command line used
+and the size and SHA-256 checksum of every bower file are shown too. With
+'-entries', the bower file argument, chain, number of residues and number of
+windows of every entry are listed.
+`,
+	flags: flag.NewFlagSet("view-bowdb", flag.ExitOnError),
+	run:   viewBowDb,
+	addFlags: func(c *command) {
+		c.flags.BoolVar(&flagViewBowDbEntries, "entries", flagViewBowDbEntries,
+			"When set, the provenance of every entry is listed.")
+	},
+}
+
+func viewBowDb(c *command) {
+	c.assertNArg(1)
+
+	dbPath := c.flags.Arg(0)
+	db := util.OpenBowDB(dbPath)
+	store := readBowStore(dbPath, db)
+	meta, err := readBowDbMeta(dbPath)
+	util.Assert(err)
+	prov, err := readBowDbProvenance(dbPath)
+	util.Assert(err)
+
+	fmt.Printf("Name: %s\n", db.Name)
+	fmt.Printf("Library: %s (%s)\n",
+		db.Lib.Name(), strings.Join(query.LibraryTag(db.Lib), "/"))
+	fmt.Printf("Library Size: %d\n", db.Lib.Size())
+	fmt.Printf("Fragment Size: %d\n", db.Lib.FragmentSize())
+	fmt.Printf("Entries: %d\n", store.Len())
+	if meta != nil {
+		fmt.Printf("BOW Options: %s\n", meta.BowOpts)
+	} else {
+		fmt.Printf("BOW Options: unknown (no metadata)\n")
+	}
+	fmt.Printf("Sequences: %s\n", yesNo(hasBowDbFile(dbPath, bowDbSeqFile)))
+	fmt.Printf("Index: %s\n", yesNo(hasBowDbFile(dbPath, vpTreeFile)))
+	if cols, ok := store.(*colStore); ok {
+		fmt.Printf("Columnar File: %s\n", colPath(dbPath))
+		util.Assert(cols.Close())
+	} else {
+		fmt.Printf("Columnar File: no\n")
+	}
+
+	if prov == nil {
+		fmt.Printf("Provenance: none\n")
+		util.Assert(db.Close())
+		return
+	}
+	fmt.Printf("Created: %s\n", prov.Created.Format("2006-01-02 15:04:05 MST"))
+	fmt.Printf("Version: %s (%s)\n", prov.Version, prov.GoVersion)
+	fmt.Printf("Command Line: %s\n", strings.Join(prov.CommandLine, " "))
+	fmt.Printf("Inputs: %d\n", len(prov.Inputs))
+
+	w := tabwriter.NewWriter(os.Stdout, 5, 0, 4, ' ', 0)
+	fmt.Fprintf(w, "\nPath\tSize\tSHA-256\n")
+	for _, input := range prov.Inputs {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", input.Path, input.Size, input.SHA256)
+	}
+	if flagViewBowDbEntries {
+		fmt.Fprintf(w, "\nId\tSource\tChain\tResidues\tWindows\n")
+		for i := range prov.Entries {
+			e := &prov.Entries[i]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Id,
+				e.column("source"), e.column("chain"),
+				e.column("residues"), e.column("windows"))
+		}
+	}
+	w.Flush()
+	util.Assert(db.Close())
+}
+
+// hasBowDbFile returns true if the BOW database has a file with the name
+// given.
+func hasBowDbFile(dbPath, name string) bool {
+	hdr, err := statBowDbFile(dbPath, name)
+	util.Assert(err)
+	return hdr != nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
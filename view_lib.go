@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/ndaniels/esfragbag"
+	"github.com/ndaniels/flib/query"
 	"github.com/ndaniels/tools/util"
 )
 
@@ -34,17 +35,9 @@ func viewLib(c *command) {
 	lib := util.Library(c.flags.Arg(0))
 
 	fmt.Printf("Name: %s\n", lib.Name())
-	fmt.Printf("Tag: %s\n", strings.Join(libraryTag(lib), "/"))
+	fmt.Printf("Tag: %s\n", strings.Join(query.LibraryTag(lib), "/"))
 	fmt.Printf("Size: %d\n", lib.Size())
 	fmt.Printf("Fragment Size: %d\n", lib.FragmentSize())
 	fmt.Printf("IsStructure: %v\n", fragbag.IsStructure(lib))
 	fmt.Printf("IsSequence: %v\n", fragbag.IsSequence(lib))
 }
-
-func libraryTag(lib fragbag.Library) []string {
-	if sub := lib.SubLibrary(); sub == nil {
-		return []string{lib.Tag()}
-	} else {
-		return append([]string{lib.Tag()}, libraryTag(sub)...)
-	}
-}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/esfragbag/bowdb"
+	"github.com/ndaniels/flib/query"
+)
+
+// A vantage point tree (VP-tree) indexes the BOWs of a database so that the
+// nearest neighbors of a query can be found without comparing the query with
+// every entry. The tree is stored in the database's tar archive next to
+// 'bow.db', and refers to entries by their position in the database.
+//
+// A VP-tree requires a metric. Euclidean distance is used directly. Cosine
+// distance is not a metric, so a tree for cosine distance is built with the
+// Euclidean distance between unit vectors, which orders neighbors in the
+// same way (|u - v|^2 = 2 * cosine distance). It is computed from the dot
+// product and the norms of the BOWs, so the BOWs are never normalized.
+
+const vpTreeFile = "vptree.gob"
+
+type vpTree struct {
+	// Either "cosine" or "euclid".
+	Metric string
+
+	// The number of entries in the database when the tree was built, and
+	// the size and modification time (Unix nanoseconds) of 'bow.db' then
+	// (see fresh).
+	Size      int
+	DbSize    int64
+	DbModTime int64
+
+	Nodes []vpNode
+	Root  int32
+}
+
+// vpNode is either an inner node with a vantage point or a leaf with a bucket
+// of points. Every point in the Inside subtree is closer than Mu to the
+// vantage point, and every point in the Outside subtree is at least Mu away.
+// A leaf may have more than the leaf size when its points can't be split
+// (e.g., they are all the same BOW).
+type vpNode struct {
+	Point           int32
+	Mu              float64
+	Inside, Outside int32 // -1 when empty
+	Bucket          []int32
+}
+
+// buildVPTree builds a VP-tree over the BOWs given with leaves of at most
+// leafSize points.
+func buildVPTree(metric string, store query.Store, leafSize int) *vpTree {
+	tree := &vpTree{Metric: metric, Size: store.Len()}
+	space := newVPSpace(metric, query.NewSearcher(store))
+	points := make([]int32, store.Len())
+	for i := range points {
+		points[i] = int32(i)
+	}
+	if leafSize < 1 {
+		leafSize = 1
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	var build func(points []int32) int32
+	leaf := func(points []int32) int32 {
+		tree.Nodes = append(tree.Nodes, vpNode{
+			Point:  -1,
+			Inside: -1, Outside: -1,
+			Bucket: append([]int32(nil), points...),
+		})
+		return int32(len(tree.Nodes) - 1)
+	}
+	build = func(points []int32) int32 {
+		if len(points) == 0 {
+			return -1
+		}
+		if len(points) <= leafSize {
+			return leaf(points)
+		}
+
+		// Pick a random vantage point and split the rest at the median
+		// distance from it.
+		vi := rng.Intn(len(points))
+		points[0], points[vi] = points[vi], points[0]
+		vp, rest := points[0], points[1:]
+		dists := make([]float64, len(rest))
+		for i, p := range rest {
+			dists[i] = space.dist(space.rows[vp], space.norms[vp], p)
+		}
+		sort.Sort(byDist{rest, dists})
+		mid := len(rest) / 2
+		mu := dists[mid]
+
+		// Points equal to the median must all go outside. If that leaves
+		// nothing inside, the points closest to the vantage point go inside
+		// instead, and if every point is the same distance away, the
+		// points can't be split.
+		for mid > 0 && dists[mid-1] == mu {
+			mid--
+		}
+		if mid == 0 {
+			for mid < len(rest) && dists[mid] == dists[0] {
+				mid++
+			}
+			if mid == len(rest) {
+				return leaf(points)
+			}
+			mu = dists[mid]
+		}
+
+		node := int32(len(tree.Nodes))
+		tree.Nodes = append(tree.Nodes, vpNode{Point: vp, Mu: mu})
+		inside := build(rest[:mid])
+		outside := build(rest[mid:])
+		tree.Nodes[node].Inside, tree.Nodes[node].Outside = inside, outside
+		return node
+	}
+	tree.Root = build(points)
+	return tree
+}
+
+// vpSpace computes the distances of a VP-tree's metric between vectors and
+// the BOWs of a store.
+type vpSpace struct {
+	metric string
+	rows   [][]float32
+	norms  []float32
+}
+
+// newVPSpace returns the space of the BOWs searched by the searcher given.
+func newVPSpace(metric string, s *query.Searcher) *vpSpace {
+	return &vpSpace{metric: metric, rows: s.Rows(), norms: s.Norms()}
+}
+
+// dist returns the distance between the vector given, whose Euclidean norm
+// is given, and the BOW at position p.
+func (space *vpSpace) dist(vec []float32, norm float32, p int32) float64 {
+	row := space.rows[p]
+	if space.metric != "cosine" {
+		sum := 0.0
+		for i := range vec {
+			d := float64(vec[i]) - float64(row[i])
+			sum += d * d
+		}
+		return math.Sqrt(sum)
+	}
+
+	// |u - v|^2 = 2 - 2 u.v for unit vectors u and v. The cosine distance
+	// of an empty BOW is 1, so it is sqrt(2) away from everything.
+	n1, n2 := float64(norm), float64(space.norms[p])
+	if n1 == 0 || n2 == 0 {
+		return math.Sqrt2
+	}
+	sq := 2 - 2*float64(query.Dot(vec, row))/(n1*n2)
+	return math.Sqrt(math.Max(sq, 0))
+}
+
+// readVPTree reads the VP-tree stored in the BOW database given. If there is
+// no tree, nil is returned with no error.
+func readVPTree(dbPath string) (*vpTree, error) {
+	data, err := readBowDbFile(dbPath, vpTreeFile)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	tree := new(vpTree)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(tree); err != nil {
+		return nil, fmt.Errorf("Could not decode index in '%s': %s",
+			dbPath, err)
+	}
+	return tree, nil
+}
+
+// fresh returns true if the tree was built from the BOW database given as it
+// is now. Trees written before the database was recorded are never fresh.
+func (tree *vpTree) fresh(dbPath string) (bool, error) {
+	dbHdr, err := statBowDbFile(dbPath, "bow.db")
+	if err != nil || dbHdr == nil {
+		return false, err
+	}
+	return dbHdr.Size == tree.DbSize &&
+		dbHdr.ModTime.UnixNano() == tree.DbModTime, nil
+}
+
+// writeVPTree writes the tree given to the BOW database, recording the
+// state of its 'bow.db' so that changes to the database are detected.
+func writeVPTree(dbPath string, tree *vpTree) error {
+	dbHdr, err := statBowDbFile(dbPath, "bow.db")
+	if err != nil {
+		return err
+	}
+	if dbHdr == nil {
+		return fmt.Errorf("'%s' is not a BOW database", dbPath)
+	}
+	tree.DbSize, tree.DbModTime = dbHdr.Size, dbHdr.ModTime.UnixNano()
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(tree); err != nil {
+		return err
+	}
+	return writeBowDbFile(dbPath, vpTreeFile, buf.Bytes())
+}
+
+// vpSearcher searches a BOW database with a VP-tree when the search options
+// allow it, and falls back to the searcher given otherwise.
+type vpSearcher struct {
+	fallback searcher
+	tree     *vpTree
+	store    query.Store
+	space    *vpSpace
+
+	// The maximum number of distances computed per query. When 0, the
+	// search is exact.
+	ef int
+}
+
+func newVPSearcher(
+	fallback searcher,
+	tree *vpTree,
+	store query.Store,
+	ef int,
+) *vpSearcher {
+	// The BOWs and norms of a batched searcher are reused.
+	qs, ok := fallback.(*query.Searcher)
+	if !ok {
+		qs = query.NewSearcher(store)
+	}
+	space := newVPSpace(tree.Metric, qs)
+	return &vpSearcher{
+		fallback: fallback,
+		tree:     tree,
+		store:    store,
+		space:    space,
+		ef:       ef,
+	}
+}
+
+// usable returns true if the tree can answer a search with the options
+// given. The tree can only find the closest entries, so it can't be used for
+// unlimited or descending searches or with a minimum distance.
+func (tree *vpTree) usable(opts bowdb.SearchOptions) bool {
+	sortMetric := "cosine"
+	if opts.SortBy == bowdb.SortByEuclid {
+		sortMetric = "euclid"
+	}
+	return opts.Limit > 0 && opts.Order == bowdb.OrderAsc &&
+		opts.Min <= 0 && sortMetric == tree.Metric
+}
+
+func (vs *vpSearcher) Search(
+	ctx context.Context,
+	opts bowdb.SearchOptions,
+	queries []bow.Bowed,
+) ([][]bowdb.SearchResult, error) {
+	if !vs.tree.usable(opts) {
+		return vs.fallback.Search(ctx, opts, queries)
+	}
+	results := make([][]bowdb.SearchResult, len(queries))
+	for i, q := range queries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		results[i] = vs.searchOne(opts, q)
+	}
+	return results, nil
+}
+
+// searchOne searches the tree for a single query.
+func (vs *vpSearcher) searchOne(
+	opts bowdb.SearchOptions,
+	qbow bow.Bowed,
+) []bowdb.SearchResult {
+	// Convert the maximum distance to the metric of the tree.
+	q, qnorm := qbow.Bow.Freqs, query.Norm(qbow.Bow.Freqs)
+	tau := opts.Max
+	if vs.tree.Metric == "cosine" {
+		tau = math.Sqrt(2 * opts.Max)
+	}
+	if tau < 0 {
+		return nil
+	}
+
+	best := &vpResults{}
+	visit := &vpQueue{}
+	heap.Push(visit, vpVisit{vs.tree.Root, 0})
+	computed := 0
+	consider := func(p int32) {
+		computed++
+		d := vs.space.dist(q, qnorm, p)
+		if d > tau {
+			return
+		}
+		heap.Push(best, vpResult{p, d})
+		if best.Len() > opts.Limit {
+			heap.Pop(best)
+		}
+		if best.Len() == opts.Limit {
+			tau = (*best)[0].dist
+		}
+	}
+	for visit.Len() > 0 {
+		if vs.ef > 0 && computed >= vs.ef && best.Len() == opts.Limit {
+			break
+		}
+		v := heap.Pop(visit).(vpVisit)
+		if v.node < 0 || v.bound > tau {
+			continue
+		}
+		node := vs.tree.Nodes[v.node]
+		if node.Point < 0 {
+			for _, p := range node.Bucket {
+				consider(p)
+			}
+			continue
+		}
+
+		d := vs.space.dist(q, qnorm, node.Point)
+		consider(node.Point)
+		heap.Push(visit, vpVisit{node.Inside, math.Max(v.bound, d-node.Mu)})
+		heap.Push(visit, vpVisit{node.Outside, math.Max(v.bound, node.Mu-d)})
+	}
+
+	results := make([]bowdb.SearchResult, best.Len())
+	for i := len(results) - 1; i >= 0; i-- {
+		r := heap.Pop(best).(vpResult)
+		e := query.Bowed(vs.store, int(r.point))
+		results[i] = bowdb.SearchResult{
+			Bowed:  e,
+			Cosine: qbow.Bow.Cosine(e.Bow),
+			Euclid: qbow.Bow.Euclid(e.Bow),
+		}
+	}
+	return results
+}
+
+type byDist struct {
+	points []int32
+	dists  []float64
+}
+
+func (bd byDist) Len() int           { return len(bd.points) }
+func (bd byDist) Less(i, j int) bool { return bd.dists[i] < bd.dists[j] }
+func (bd byDist) Swap(i, j int) {
+	bd.points[i], bd.points[j] = bd.points[j], bd.points[i]
+	bd.dists[i], bd.dists[j] = bd.dists[j], bd.dists[i]
+}
+
+// vpVisit is a subtree to visit along with a lower bound on the distance
+// between the query and any point in it.
+type vpVisit struct {
+	node  int32
+	bound float64
+}
+
+// vpQueue is a min-heap of subtrees by their lower bound.
+type vpQueue []vpVisit
+
+func (q vpQueue) Len() int            { return len(q) }
+func (q vpQueue) Less(i, j int) bool  { return q[i].bound < q[j].bound }
+func (q vpQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *vpQueue) Push(x interface{}) { *q = append(*q, x.(vpVisit)) }
+func (q *vpQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+type vpResult struct {
+	point int32
+	dist  float64
+}
+
+// vpResults is a max-heap of the closest points found so far.
+type vpResults []vpResult
+
+func (rs vpResults) Len() int            { return len(rs) }
+func (rs vpResults) Less(i, j int) bool  { return rs[i].dist > rs[j].dist }
+func (rs vpResults) Swap(i, j int)       { rs[i], rs[j] = rs[j], rs[i] }
+func (rs *vpResults) Push(x interface{}) { *rs = append(*rs, x.(vpResult)) }
+func (rs *vpResults) Pop() interface{} {
+	old := *rs
+	x := old[len(old)-1]
+	*rs = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/ndaniels/esfragbag/bow"
+	"github.com/ndaniels/esfragbag/bowdb"
+	"github.com/ndaniels/flib/query"
+)
+
+// TestVPTreeSearch checks that an exact search with a VP-tree returns the same
+// results as comparing each query with every BOW. A quarter of the database
+// is empty BOWs, which can't be split by distance.
+func TestVPTreeSearch(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	entries := testEntries(rng, 400, 40)
+	for i := 0; i < len(entries); i += 4 {
+		entries[i].Bow = bow.Bow{Freqs: make([]float32, 40)}
+	}
+	queries := append(testEntries(rng, 10, 40), entries[:10]...)
+
+	for _, sortBy := range []bowdb.SortByType{
+		bowdb.SortByCosine, bowdb.SortByEuclid,
+	} {
+		opts := bowdb.SearchDefault
+		opts.Limit, opts.SortBy, opts.Max = 10, sortBy, 1e9
+		metric := "euclid"
+		if sortBy == bowdb.SortByCosine {
+			metric, opts.Max = "cosine", 1
+		}
+		store := query.Entries(entries)
+		tree := buildVPTree(metric, store, 4)
+		if depth := vpTreeDepth(tree, tree.Root); depth > 40 {
+			t.Errorf("%s: the tree is %d nodes deep.", metric, depth)
+		}
+
+		vs := newVPSearcher(storeSearcher{store}, tree, store, 0)
+		expected := linearSearch(entries, opts, queries)
+		all, err := vs.Search(context.Background(), opts, queries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for qi, q := range queries {
+			got := all[qi]
+			if len(got) != len(expected[qi]) {
+				t.Errorf("%s/%s: %d results, expected %d.",
+					metric, q.Id, len(got), len(expected[qi]))
+				continue
+			}
+			// Ties may be broken differently, so only the distances used to
+			// sort are compared.
+			for i := range got {
+				g, e := got[i], expected[qi][i]
+				if query.SortDist(opts, g) != query.SortDist(opts, e) {
+					t.Errorf("%s/%s: result %d is %s (cosine %g, euclid %g), "+
+						"expected %s (cosine %g, euclid %g).", metric, q.Id, i,
+						g.Bowed.Id, g.Cosine, g.Euclid,
+						e.Bowed.Id, e.Cosine, e.Euclid)
+					break
+				}
+			}
+		}
+	}
+}
+
+func vpTreeDepth(tree *vpTree, node int32) int {
+	if node < 0 {
+		return 0
+	}
+	n := tree.Nodes[node]
+	inside, outside := vpTreeDepth(tree, n.Inside), vpTreeDepth(tree, n.Outside)
+	if inside > outside {
+		return inside + 1
+	}
+	return outside + 1
+}